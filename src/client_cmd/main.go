@@ -9,8 +9,10 @@ import (
 
 	pb_struct "github.com/envoyproxy/go-control-plane/envoy/api/v2/ratelimit"
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
+	ratelimit "github.com/lyft/ratelimit/src/service"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 type descriptorValue struct {
@@ -44,6 +46,9 @@ func main() {
 	flag.Var(
 		&descriptorValue, "descriptors",
 		"descriptor list to query in <key>=<value>,<key>=<value>,... form")
+	release := flag.Bool("release", false, "release a hit acquired for a concurrency limit instead of querying")
+	leaseID := flag.String(
+		"lease_id", "", "lease id returned in the "+ratelimit.LeaseIDHeader+" header of the query, for -release")
 	flag.Parse()
 
 	fmt.Printf("dial string: %s\n", *dialString)
@@ -57,14 +62,18 @@ func main() {
 	}
 
 	defer conn.Close()
-	c := pb.NewRateLimitServiceClient(conn)
-	response, err := c.ShouldRateLimit(
-		context.Background(),
-		&pb.RateLimitRequest{
-			Domain:      *domain,
-			Descriptors: []*pb_struct.RateLimitDescriptor{descriptorValue.descriptor},
-			HitsAddend:  1,
-		})
+	request := &pb.RateLimitRequest{
+		Domain:      *domain,
+		Descriptors: []*pb_struct.RateLimitDescriptor{descriptorValue.descriptor},
+		HitsAddend:  1,
+	}
+	var response *pb.RateLimitResponse
+	if *release {
+		ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs(ratelimit.LeaseIDHeader, *leaseID))
+		response, err = ratelimit.NewConcurrencyServiceClient(conn).Release(ctx, request)
+	} else {
+		response, err = pb.NewRateLimitServiceClient(conn).ShouldRateLimit(context.Background(), request)
+	}
 	if err != nil {
 		fmt.Printf("request error: %s\n", err.Error())
 		os.Exit(1)
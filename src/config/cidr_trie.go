@@ -0,0 +1,82 @@
+package config
+
+import (
+	"net"
+)
+
+// A binary trie of network prefixes used to find the longest value_cidr that contains an address.
+// IPv4 and IPv6 networks are kept in separate tries so that an IPv6 network such as ::/0 never
+// contains an IPv4 address.
+type cidrTrie struct {
+	v4 cidrTrieNode
+	v6 cidrTrieNode
+}
+
+type cidrTrieNode struct {
+	children   [2]*cidrTrieNode
+	descriptor *rateLimitDescriptor
+}
+
+// Convert a network to the form used by the trie. IPv4 networks, including IPv4-mapped IPv6
+// networks, use the 4 byte form and all others the 16 byte form.
+// @param network supplies the network to convert.
+// @return the network address and the number of leading bits in its prefix.
+func cidrTrieKey(network *net.IPNet) (net.IP, int) {
+	ones, bits := network.Mask.Size()
+	if ip := network.IP.To4(); ip != nil {
+		return ip, ones - (bits - net.IPv4len*8)
+	}
+	return network.IP.To16(), ones
+}
+
+// @return the bit of an address at a position, counting from the most significant bit.
+func ipBit(ip net.IP, position int) int {
+	return int(ip[position/8]>>(7-uint(position%8))) & 1
+}
+
+// @return the root of the trie for the family of an address in the form used by the trie.
+func (this *cidrTrie) root(ip net.IP) *cidrTrieNode {
+	if len(ip) == net.IPv4len {
+		return &this.v4
+	}
+	return &this.v6
+}
+
+// Add a network to the trie.
+// @param network supplies the network.
+// @param descriptor supplies the descriptor returned for addresses in the network.
+func (this *cidrTrie) insert(network *net.IPNet, descriptor *rateLimitDescriptor) {
+	ip, ones := cidrTrieKey(network)
+	node := this.root(ip)
+	for i := 0; i < ones; i++ {
+		bit := ipBit(ip, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &cidrTrieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.descriptor = descriptor
+}
+
+// Find the descriptor of the longest network that contains an address.
+// @param value supplies the address as a string.
+// @return the descriptor or nil if the value is not an address or no network contains it.
+func (this *cidrTrie) longestMatch(value string) *rateLimitDescriptor {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	node := this.root(ip)
+	match := node.descriptor
+	for i := 0; i < len(ip)*8 && node != nil; i++ {
+		node = node.children[ipBit(ip, i)]
+		if node != nil && node.descriptor != nil {
+			match = node.descriptor
+		}
+	}
+	return match
+}
@@ -1,6 +1,9 @@
 package config
 
 import (
+	"fmt"
+	"strings"
+
 	pb_struct "github.com/envoyproxy/go-control-plane/envoy/api/v2/ratelimit"
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
 	stats "github.com/lyft/gostats"
@@ -12,11 +15,37 @@ import (
 // stat increase
 const NearLimitRatio = 0.8
 
-// Errors that may be raised during config parsing.
-type RateLimitConfigError string
+// The DefaultLeaseSeconds constant defines how long a slot acquired under a concurrency
+// limit is held if the caller never releases it.
+const DefaultLeaseSeconds = 60
+
+// Errors that may be returned during config parsing.
+type RateLimitConfigError struct {
+	// Name of the config file that caused the error.
+	File string
+	// Line and column of the YAML node that caused the error, or 0 if the error is not tied to a node.
+	Line   int
+	Column int
+	// Path of the descriptor that caused the error, e.g. messaging.message_type_marketing.to_number,
+	// or empty if the error is not tied to a descriptor.
+	Path    string
+	Message string
+}
 
+// @return the error in the form file:line:column: path: message, leaving out any unknown parts.
 func (e RateLimitConfigError) Error() string {
-	return string(e)
+	ret := e.Message
+	if e.Path != "" {
+		ret = e.Path + ": " + ret
+	}
+
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, ret)
+	}
+	if e.File != "" {
+		return e.File + ": " + ret
+	}
+	return ret
 }
 
 // Stats for an individual rate limit config entry.
@@ -25,13 +54,113 @@ type RateLimitStats struct {
 	OverLimit               stats.Counter
 	NearLimit               stats.Counter
 	OverLimitWithLocalCache stats.Counter
+	// Over limit hits of shadow mode limits, which are also counted in OverLimit but not rejected.
+	ShadowMode stats.Counter
+}
+
+// The algorithm used to count hits against a rate limit.
+type RateLimitAlgorithm int
+
+const (
+	// Count hits in windows aligned to the limit's unit. The counter resets at every window boundary.
+	FixedWindow RateLimitAlgorithm = iota
+	// Count hits in the current window plus the previous window's count weighted by how much of
+	// the previous window still overlaps a sliding window ending now.
+	SlidingWindow
+	// Take a token per hit from a bucket of Burst tokens that refills continuously at the limit's rate.
+	TokenBucket
+	// Space hits evenly at the limit's rate by tracking a theoretical arrival time, allowing up to
+	// Burst hits at once.
+	GCRA
+	// Count in-flight hits that are acquired by ShouldRateLimit and returned by Release. This is
+	// configured through a concurrency_limit block rather than a rate_limit algorithm.
+	Concurrency
+)
+
+var rateLimitAlgorithmNames = map[RateLimitAlgorithm]string{
+	FixedWindow:   "fixed_window",
+	SlidingWindow: "sliding_window",
+	TokenBucket:   "token_bucket",
+	GCRA:          "gcra",
+	Concurrency:   "concurrency",
+}
+
+func (a RateLimitAlgorithm) String() string {
+	return rateLimitAlgorithmNames[a]
+}
+
+// How the service answers a request whose limits cannot be checked because the cache failed.
+type FailureMode int
+
+const (
+	// No failure mode is set, so the cache error is returned to the caller.
+	FailureModeNone FailureMode = iota
+	// Answer OK, letting the request through.
+	FailureModeAllow
+	// Answer OVER_LIMIT, rejecting the request.
+	FailureModeDeny
+)
+
+var failureModeNames = map[FailureMode]string{
+	FailureModeNone:  "none",
+	FailureModeAllow: "allow",
+	FailureModeDeny:  "deny",
+}
+
+func (m FailureMode) String() string {
+	return failureModeNames[m]
+}
+
+// Parse a failure mode name. An empty name selects FailureModeNone.
+// @param name supplies the failure mode name.
+// @return the failure mode and whether the name was valid.
+func ParseFailureMode(name string) (FailureMode, bool) {
+	if name == "" {
+		return FailureModeNone, true
+	}
+
+	for mode, modeName := range failureModeNames {
+		if modeName == strings.ToLower(name) {
+			return mode, true
+		}
+	}
+	return FailureModeNone, false
 }
 
 // Wrapper for an individual rate limit config entry which includes the defined limit and stats.
 type RateLimit struct {
-	FullKey string
-	Stats   RateLimitStats
-	Limit   *pb.RateLimitResponse_RateLimit
+	FullKey   string
+	Stats     RateLimitStats
+	Limit     *pb.RateLimitResponse_RateLimit
+	Algorithm RateLimitAlgorithm
+	// Length of the limit's window in seconds. This is the length of the limit's unit unless the
+	// config defines a custom window, in which case the unit is the closest one to the window.
+	UnitSeconds int64
+	// Maximum number of hits that can be accumulated while idle. Only used by the token bucket
+	// and GCRA algorithms. 0 means the limit's requests per unit for a token bucket and 1 for GCRA.
+	Burst uint32
+	// How long a slot acquired under a concurrency limit is held before it expires on its own.
+	// Only used by concurrency limits, which store their maximum in flight as the requests per unit.
+	LeaseSeconds int64
+	// If true, hits over the limit are counted and logged but the limit is not enforced. Concurrency
+	// limits are always enforced, since a hit that is let through without a lease cannot be released.
+	ShadowMode bool
+	// Position of the limit in its descriptor's list of rate limits. Limits after the first are
+	// counted under their own cache keys and stats.
+	Index int
+	// If true, every request that matches the limit is counted under one cache key built from the
+	// FullKey, instead of under a key per distinct request value.
+	Aggregate bool
+	// Depth of the limit's descriptor in the config. Only the first Depth entries of a request
+	// descriptor are part of the cache key, so a match_prefix limit counts every descriptor that
+	// starts with the same entries together. 0 means all entries.
+	Depth int
+	// If true, every hit is allowed without being counted in the cache. Hits are still counted in
+	// the total_hits stat.
+	Unlimited bool
+	// Name of the cache backend that counts the limit's hits, or empty to choose the backend by the
+	// limit's unit.
+	Backend string
 }
 
 // Interface for interacting with a loaded rate limit config.
@@ -43,8 +172,21 @@ type RateLimitConfig interface {
 	// @param ctx supplies the calling context.
 	// @param domain supplies the domain to lookup the descriptor in.
 	// @param descriptor supplies the descriptor to look up.
-	// @return a rate limit to apply or nil if no rate limit is configured for the descriptor.
+	// @return a rate limit to apply or nil if no rate limit is configured for the descriptor. This is
+	// the first limit if the descriptor has several.
 	GetLimit(ctx context.Context, domain string, descriptor *pb_struct.RateLimitDescriptor) *RateLimit
+
+	// Get all of the configured limits for a rate limit descriptor.
+	// @param ctx supplies the calling context.
+	// @param domain supplies the domain to lookup the descriptor in.
+	// @param descriptor supplies the descriptor to look up.
+	// @return the rate limits to apply, which is empty if no rate limit is configured for the descriptor.
+	GetLimits(ctx context.Context, domain string, descriptor *pb_struct.RateLimitDescriptor) []*RateLimit
+
+	// Get the failure mode set by a domain.
+	// @param domain supplies the domain to look up.
+	// @return the domain's failure mode, or FailureModeNone if the domain does not set one or is unknown.
+	GetFailureMode(domain string) FailureMode
 }
 
 // Information for a config file to load into the aggregate config.
@@ -58,7 +200,6 @@ type RateLimitConfigLoader interface {
 	// Load a new configuration from a list of YAML files.
 	// @param configs supplies a list of full YAML files in string form.
 	// @param statsScope supplies the stats scope to use for limit stats during runtime.
-	// @return a new configuration.
-	// @throws RateLimitConfigError if the configuration could not be created.
-	Load(configs []RateLimitConfigToLoad, statsScope stats.Scope) RateLimitConfig
+	// @return a new configuration or a RateLimitConfigError if the configuration could not be created.
+	Load(configs []RateLimitConfigToLoad, statsScope stats.Scope) (RateLimitConfig, error)
 }
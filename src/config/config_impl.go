@@ -2,6 +2,11 @@ package config
 
 import (
 	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	pb_struct "github.com/envoyproxy/go-control-plane/envoy/api/v2/ratelimit"
@@ -9,47 +14,216 @@ import (
 	stats "github.com/lyft/gostats"
 	logger "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 type yamlRateLimit struct {
 	RequestsPerUnit uint32 `yaml:"requests_per_unit"`
 	Unit            string
+	UnitMultiplier  uint32 `yaml:"unit_multiplier"`
+	Algorithm       string
+	Burst           uint32
+	ShadowMode      bool `yaml:"shadow_mode"`
+	Unlimited       bool
+	Aggregate       bool
+	Backend         string
+	Template        string
+	position        yamlPosition
+}
+
+// Decode a rate limit and record where it is in the file.
+func (this *yamlRateLimit) UnmarshalYAML(node *yaml.Node) error {
+	type plainRateLimit yamlRateLimit
+	err := node.Decode((*plainRateLimit)(this))
+	this.position = newYamlPosition(node)
+	return err
+}
+
+type yamlConcurrencyLimit struct {
+	MaxInFlight  uint32 `yaml:"max_in_flight"`
+	LeaseSeconds uint32 `yaml:"lease_seconds"`
+	position     yamlPosition
+}
+
+// Decode a concurrency limit and record where it is in the file.
+func (this *yamlConcurrencyLimit) UnmarshalYAML(node *yaml.Node) error {
+	type plainConcurrencyLimit yamlConcurrencyLimit
+	err := node.Decode((*plainConcurrencyLimit)(this))
+	this.position = newYamlPosition(node)
+	return err
 }
 
 type yamlDescriptor struct {
-	Key         string
-	Value       string
-	RateLimit   *yamlRateLimit `yaml:"rate_limit"`
-	Descriptors []yamlDescriptor
+	Key              string
+	Value            string
+	ValueRegex       string                `yaml:"value_regex"`
+	ValueCIDR        string                `yaml:"value_cidr"`
+	MatchPrefix      bool                  `yaml:"match_prefix"`
+	RateLimit        *yamlRateLimit        `yaml:"rate_limit"`
+	RateLimits       []yamlRateLimit       `yaml:"rate_limits"`
+	ConcurrencyLimit *yamlConcurrencyLimit `yaml:"concurrency_limit"`
+	Descriptors      []yamlDescriptor
+	position         yamlPosition
+}
+
+// Decode a descriptor and record where it is in the file.
+func (this *yamlDescriptor) UnmarshalYAML(node *yaml.Node) error {
+	type plainDescriptor yamlDescriptor
+	err := node.Decode((*plainDescriptor)(this))
+	this.position = newYamlPosition(node)
+	return err
+}
+
+// @return the name of the descriptor in descriptor paths and stats, which is its key and any value
+// joined by '_'. A value_regex is used as is and a value_cidr in its canonical form.
+func (this *yamlDescriptor) finalKey() string {
+	value := this.Value
+	if this.ValueRegex != "" {
+		value = this.ValueRegex
+	}
+	if this.ValueCIDR != "" {
+		value = this.ValueCIDR
+		if _, network, err := net.ParseCIDR(this.ValueCIDR); err == nil {
+			value = network.String()
+		}
+	}
+
+	if value == "" {
+		return this.Key
+	}
+	return this.Key + "_" + value
 }
 
 type yamlRoot struct {
-	Domain      string
-	Descriptors []yamlDescriptor
+	Domain         string
+	ShadowMode     bool                     `yaml:"shadow_mode"`
+	FailureMode    string                   `yaml:"failure_mode"`
+	LimitTemplates map[string]yamlRateLimit `yaml:"limit_templates"`
+	Descriptors    []yamlDescriptor
+	domainPosition yamlPosition
+	// Position of the failure mode, used to report an invalid one.
+	failureModePosition yamlPosition
+}
+
+// Position of a YAML node in its file, used to report config errors.
+type yamlPosition struct {
+	line   int
+	column int
+}
+
+func newYamlPosition(node *yaml.Node) yamlPosition {
+	return yamlPosition{node.Line, node.Column}
 }
 
 type rateLimitDescriptor struct {
+	key   string
+	value string
+	// Compiled value of a descriptor defined with a value_regex. The value holds the source.
+	valueRegex *regexp.Regexp
+	// Network of a descriptor defined with a value_cidr. The value holds the network in CIDR notation.
+	valueCIDR   *net.IPNet
 	descriptors map[string]*rateLimitDescriptor
-	limit       *RateLimit
+	// Descriptors whose value is a prefix wildcard, grouped by key and sorted from the longest
+	// prefix to the shortest.
+	prefixDescriptors map[string][]*rateLimitDescriptor
+	// Descriptors with a value_regex, grouped by key in file order.
+	regexDescriptors map[string][]*rateLimitDescriptor
+	// Descriptors with a value_cidr, grouped by key and sorted from the longest prefix to the shortest.
+	cidrDescriptors map[string][]*rateLimitDescriptor
+	// Tries of the value_cidr networks, by key, used to look up the longest network containing an address.
+	cidrTries map[string]*cidrTrie
+	// Limits of the descriptor, which are all applied to every matching request.
+	limits []*RateLimit
+	// If true, the limits also apply to request descriptors with more entries than the descriptor's depth.
+	matchPrefix bool
+	// Number of entries a request descriptor has when it matches the descriptor. 0 for a domain.
+	depth int
 }
 
 type rateLimitDomain struct {
 	rateLimitDescriptor
+	failureMode FailureMode
 }
 
 type rateLimitConfigImpl struct {
 	domains map[string]*rateLimitDomain
+	// Names of the cache backends that limits can name, or nil if the names are not checked.
+	backends map[string]bool
+	// Algorithms the cache supports, or nil if the cache supports every algorithm.
+	algorithms map[RateLimitAlgorithm]bool
 }
 
 var validKeys = map[string]bool{
 	"domain":            true,
 	"key":               true,
 	"value":             true,
+	"value_regex":       true,
+	"value_cidr":        true,
+	"match_prefix":      true,
 	"descriptors":       true,
+	"failure_mode":      true,
 	"rate_limit":        true,
+	"rate_limits":       true,
 	"unit":              true,
 	"requests_per_unit": true,
+	"unit_multiplier":   true,
+	"algorithm":         true,
+	"burst":             true,
+	"concurrency_limit": true,
+	"max_in_flight":     true,
+	"lease_seconds":     true,
+	"shadow_mode":       true,
+	"unlimited":         true,
+	"aggregate":         true,
+	"backend":           true,
+	"limit_templates":   true,
+	"template":          true,
+}
+
+// Length of each rate limit unit in seconds, in increasing order of length.
+var unitSeconds = []struct {
+	unit    pb.RateLimitResponse_RateLimit_Unit
+	seconds int64
+}{
+	{pb.RateLimitResponse_RateLimit_SECOND, 1},
+	{pb.RateLimitResponse_RateLimit_MINUTE, 60},
+	{pb.RateLimitResponse_RateLimit_HOUR, 60 * 60},
+	{pb.RateLimitResponse_RateLimit_DAY, 60 * 60 * 24},
+}
+
+// Length of each duration suffix that can be used as a rate limit unit, in seconds.
+var durationSuffixSeconds = map[string]int64{
+	"s": 1,
+	"m": 60,
+	"h": 60 * 60,
+	"d": 60 * 60 * 24,
+	"w": 60 * 60 * 24 * 7,
+}
+
+var durationRegex = regexp.MustCompile(`^([0-9]+)([smhdw])$`)
+
+// Separates the index of a descriptor's further rate limits from the descriptor's key.
+const rateLimitIndexSeparator = "#"
+
+// A descriptor value ending in this suffix matches any value that starts with the rest of it.
+const prefixWildcard = "*"
+
+// Create a new, empty descriptor level.
+// @param key supplies the descriptor key, or "" for a domain.
+// @param value supplies the descriptor value, or "" to match any value of the key.
+// @param limits supplies the rate limits of the descriptor (may be empty).
+// @return the new descriptor.
+func newRateLimitDescriptor(key string, value string, limits []*RateLimit) *rateLimitDescriptor {
+	return &rateLimitDescriptor{
+		key:               key,
+		value:             value,
+		descriptors:       map[string]*rateLimitDescriptor{},
+		prefixDescriptors: map[string][]*rateLimitDescriptor{},
+		regexDescriptors:  map[string][]*rateLimitDescriptor{},
+		cidrDescriptors:   map[string][]*rateLimitDescriptor{},
+		cidrTries:         map[string]*cidrTrie{},
+		limits:            limits,
+	}
 }
 
 // Create new rate limit stats for a config entry.
@@ -62,6 +236,7 @@ func newRateLimitStats(statsScope stats.Scope, key string) RateLimitStats {
 	ret.OverLimit = statsScope.NewCounter(key + ".over_limit")
 	ret.NearLimit = statsScope.NewCounter(key + ".near_limit")
 	ret.OverLimitWithLocalCache = statsScope.NewCounter(key + ".over_limit_with_local_cache")
+	ret.ShadowMode = statsScope.NewCounter(key + ".shadow_mode")
 	return ret
 }
 
@@ -74,18 +249,252 @@ func newRateLimitStats(statsScope stats.Scope, key string) RateLimitStats {
 func NewRateLimit(
 	requestsPerUnit uint32, unit pb.RateLimitResponse_RateLimit_Unit, key string, scope stats.Scope) *RateLimit {
 
-	return &RateLimit{FullKey: key, Stats: newRateLimitStats(scope, key), Limit: &pb.RateLimitResponse_RateLimit{RequestsPerUnit: requestsPerUnit, Unit: unit}}
+	ret := &RateLimit{FullKey: key, Stats: newRateLimitStats(scope, key), Limit: &pb.RateLimitResponse_RateLimit{RequestsPerUnit: requestsPerUnit, Unit: unit}}
+	for _, entry := range unitSeconds {
+		if entry.unit == unit {
+			ret.UnitSeconds = entry.seconds
+		}
+	}
+	return ret
+}
+
+// Create a new rate limit config entry with a custom window length.
+// @param requestsPerUnit supplies the requests per window for the entry.
+// @param windowSeconds supplies the length of the window in seconds.
+// @param key supplies the fully resolved key name of the entry.
+// @param scope supplies the owning scope.
+// @return the new config entry. Its unit is the one closest to the window length.
+func NewRateLimitWithWindow(requestsPerUnit uint32, windowSeconds int64, key string, scope stats.Scope) *RateLimit {
+	ret := NewRateLimit(requestsPerUnit, closestRateLimitUnit(windowSeconds), key, scope)
+	ret.UnitSeconds = windowSeconds
+	return ret
+}
+
+// Find the unit whose length is closest to a window length.
+// @param windowSeconds supplies the length of the window in seconds.
+// @return the closest unit.
+func closestRateLimitUnit(windowSeconds int64) pb.RateLimitResponse_RateLimit_Unit {
+	closest := unitSeconds[0]
+	for _, entry := range unitSeconds {
+		if abs(windowSeconds-entry.seconds) < abs(windowSeconds-closest.seconds) {
+			closest = entry
+		}
+	}
+	return closest.unit
+}
+
+func abs(a int64) int64 {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+// Parse the window length of a rate limit from the YAML config. The unit is either the name of a
+// unit such as "minute" or a duration such as "10s", "15m", "12h", "7d" or "1w". It is multiplied
+// by the unit multiplier if one is set.
+// @param unit supplies the unit.
+// @param multiplier supplies the unit multiplier, or 0 if none is set.
+// @return the window length in seconds and whether the unit was valid.
+func parseRateLimitWindow(unit string, multiplier uint32) (int64, bool) {
+	var seconds int64 = 0
+	value, present := pb.RateLimitResponse_RateLimit_Unit_value[strings.ToUpper(unit)]
+	if present {
+		for _, entry := range unitSeconds {
+			if int32(entry.unit) == value {
+				seconds = entry.seconds
+			}
+		}
+	} else if match := durationRegex.FindStringSubmatch(strings.ToLower(unit)); match != nil {
+		count, err := strconv.ParseInt(match[1], 10, 32)
+		if err != nil {
+			return 0, false
+		}
+		seconds = count * durationSuffixSeconds[match[2]]
+	}
+
+	if multiplier == 0 {
+		multiplier = 1
+	}
+
+	// Windows are limited to what fits in the expiration of a cache entry.
+	if seconds <= 0 || seconds > math.MaxInt32/int64(multiplier) {
+		return 0, false
+	}
+	return seconds * int64(multiplier), true
+}
+
+// Parse a rate limit algorithm name from the YAML config. An empty name selects the fixed window.
+// @param name supplies the algorithm name.
+// @return the algorithm and whether the name was valid.
+func parseRateLimitAlgorithm(name string) (RateLimitAlgorithm, bool) {
+	if name == "" {
+		return FixedWindow, true
+	}
+
+	for algorithm, algorithmName := range rateLimitAlgorithmNames {
+		if algorithmName == strings.ToLower(name) && algorithm != Concurrency {
+			return algorithm, true
+		}
+	}
+
+	return FixedWindow, false
+}
+
+// Create a new concurrency limit config entry.
+// @param maxInFlight supplies the maximum number of hits that can be in flight at once.
+// @param leaseSeconds supplies how long an acquired slot is held if it is not released.
+// @param key supplies the fully resolved key name of the entry.
+// @param scope supplies the owning scope.
+// @return the new config entry.
+func NewConcurrencyLimit(maxInFlight uint32, leaseSeconds int64, key string, scope stats.Scope) *RateLimit {
+	ret := NewRateLimit(maxInFlight, pb.RateLimitResponse_RateLimit_UNKNOWN, key, scope)
+	ret.Algorithm = Concurrency
+	ret.LeaseSeconds = leaseSeconds
+	return ret
+}
+
+// @return whether the descriptor's value is a prefix wildcard.
+func (this *rateLimitDescriptor) isPrefix() bool {
+	return this.valueRegex == nil && this.valueCIDR == nil && strings.HasSuffix(this.value, prefixWildcard)
+}
+
+// @return the prefix matched by a prefix wildcard descriptor.
+func (this *rateLimitDescriptor) prefix() string {
+	return strings.TrimSuffix(this.value, prefixWildcard)
+}
+
+// @return whether the value of the descriptor is matched by a regex or a network rather than by equality.
+func (this *rateLimitDescriptor) isPattern() bool {
+	return this.valueRegex != nil || this.valueCIDR != nil
+}
+
+// @return how the descriptor matches request entries: exact, cidr, prefix, regex or key.
+func (this *rateLimitDescriptor) matchType() string {
+	switch {
+	case this.value == "":
+		return "key"
+	case this.valueRegex != nil:
+		return "regex"
+	case this.valueCIDR != nil:
+		return "cidr"
+	case this.isPrefix():
+		return "prefix"
+	default:
+		return "exact"
+	}
+}
+
+// Order the descriptors of a level the way a lookup considers them: by key, then exact values, then
+// networks and prefixes from the longest to the shortest, then regexes in file order, then the key only.
+// @return the sorted descriptors.
+func (this *rateLimitDescriptor) sortedDescriptors() []*rateLimitDescriptor {
+	keys := []string{}
+	exact := map[string][]*rateLimitDescriptor{}
+	for _, descriptor := range this.descriptors {
+		if _, present := exact[descriptor.key]; !present {
+			keys = append(keys, descriptor.key)
+			exact[descriptor.key] = []*rateLimitDescriptor{}
+		}
+		if descriptor.matchType() == "exact" {
+			exact[descriptor.key] = append(exact[descriptor.key], descriptor)
+		}
+	}
+	sort.Strings(keys)
+
+	ret := make([]*rateLimitDescriptor, 0, len(this.descriptors))
+	for _, key := range keys {
+		sort.Slice(exact[key], func(i, j int) bool { return exact[key][i].value < exact[key][j].value })
+		ret = append(ret, exact[key]...)
+		ret = append(ret, this.cidrDescriptors[key]...)
+		ret = append(ret, this.prefixDescriptors[key]...)
+		ret = append(ret, this.regexDescriptors[key]...)
+		if descriptor, present := this.descriptors[key]; present {
+			ret = append(ret, descriptor)
+		}
+	}
+	return ret
+}
+
+// Find the descriptor with the longest prefix wildcard that matches a request entry.
+// @param key supplies the entry key.
+// @param value supplies the entry value.
+// @return the matching descriptor or nil if none match.
+func (this *rateLimitDescriptor) longestPrefixMatch(key string, value string) *rateLimitDescriptor {
+	for _, descriptor := range this.prefixDescriptors[key] {
+		if strings.HasPrefix(value, descriptor.prefix()) {
+			return descriptor
+		}
+	}
+	return nil
+}
+
+// Find the descriptor with the longest value_cidr network that contains a request entry's address.
+// @param key supplies the entry key.
+// @param value supplies the entry value.
+// @return the matching descriptor or nil if the value is not an address or no network contains it.
+func (this *rateLimitDescriptor) longestCIDRMatch(key string, value string) *rateLimitDescriptor {
+	trie := this.cidrTries[key]
+	if trie == nil {
+		return nil
+	}
+	return trie.longestMatch(value)
+}
+
+// Find the first descriptor in file order whose value_regex matches a request entry.
+// @param key supplies the entry key.
+// @param value supplies the entry value.
+// @return the matching descriptor or nil if none match.
+func (this *rateLimitDescriptor) firstRegexMatch(key string, value string) *rateLimitDescriptor {
+	for _, descriptor := range this.regexDescriptors[key] {
+		if descriptor.valueRegex.MatchString(value) {
+			return descriptor
+		}
+	}
+	return nil
+}
+
+// Create a new unlimited rate limit config entry. Hits are counted in its stats but never in the cache.
+// @param key supplies the fully resolved key name of the entry.
+// @param scope supplies the owning scope.
+// @return the new config entry.
+func NewUnlimitedRateLimit(key string, scope stats.Scope) *RateLimit {
+	ret := NewRateLimit(0, pb.RateLimitResponse_RateLimit_UNKNOWN, key, scope)
+	ret.Unlimited = true
+	return ret
 }
 
-// Dump an individual descriptor for debugging purposes.
+// Dump an individual descriptor for debugging purposes. Descriptors are listed in the order a
+// lookup considers them.
 func (this *rateLimitDescriptor) dump() string {
 	ret := ""
-	if this.limit != nil {
-		ret += fmt.Sprintf(
-			"%s: unit=%s requests_per_unit=%d\n", this.limit.FullKey,
-			this.limit.Limit.Unit.String(), this.limit.Limit.RequestsPerUnit)
+	matchPrefix := ""
+	if this.matchPrefix {
+		matchPrefix = " match_prefix=true"
 	}
-	for _, descriptor := range this.descriptors {
+	for _, limit := range this.limits {
+		if limit.Unlimited {
+			ret += fmt.Sprintf("%s: match=%s%s unlimited=true\n", limit.FullKey, this.matchType(), matchPrefix)
+		} else if limit.Algorithm == Concurrency {
+			ret += fmt.Sprintf(
+				"%s: match=%s%s max_in_flight=%d lease_seconds=%d\n", limit.FullKey, this.matchType(),
+				matchPrefix, limit.Limit.RequestsPerUnit, limit.LeaseSeconds)
+		} else {
+			aggregate := ""
+			if limit.Aggregate {
+				aggregate = " aggregate=true"
+			}
+			backend := ""
+			if limit.Backend != "" {
+				backend = " backend=" + limit.Backend
+			}
+			ret += fmt.Sprintf(
+				"%s: match=%s%s unit=%s unit_seconds=%d requests_per_unit=%d algorithm=%s burst=%d shadow_mode=%t%s%s\n",
+				limit.FullKey, this.matchType(), matchPrefix, limit.Limit.Unit.String(), limit.UnitSeconds,
+				limit.Limit.RequestsPerUnit, limit.Algorithm.String(), limit.Burst, limit.ShadowMode, aggregate, backend)
+		}
+	}
+	for _, descriptor := range this.sortedDescriptors() {
 		ret += descriptor.dump()
 	}
 	return ret
@@ -95,141 +504,686 @@ func (this *rateLimitDescriptor) dump() string {
 // @param config supplies the config file that generated the error.
 // @param err supplies the error string.
 func newRateLimitConfigError(config RateLimitConfigToLoad, err string) RateLimitConfigError {
-	return RateLimitConfigError(fmt.Sprintf("%s: %s", config.Name, err))
+	return RateLimitConfigError{File: config.Name, Message: err}
+}
+
+// Create a new config error which includes the owning file and where in it the error is.
+// @param config supplies the config file that generated the error.
+// @param position supplies the position of the YAML node that caused the error.
+// @param path supplies the path of the descriptor that caused the error or empty if there is none.
+// @param err supplies the error string.
+func newRateLimitConfigErrorAt(
+	config RateLimitConfigToLoad, position yamlPosition, path string, err string) RateLimitConfigError {
+
+	return RateLimitConfigError{
+		File:    config.Name,
+		Line:    position.line,
+		Column:  position.column,
+		Path:    path,
+		Message: err,
+	}
+}
+
+// Load a rate limit from the YAML config.
+// @param config supplies the config file that owns the rate limit.
+// @param parentKey supplies the fully resolved key name of the descriptor that owns the rate limit.
+// @param index supplies the position of the rate limit in the descriptor's list of rate limits.
+// @param rateLimitConfig supplies the YAML rate limit to load.
+// @param domainShadowMode supplies whether the owning domain puts all of its rate limits in shadow mode.
+// @param statsScope supplies the owning scope.
+// @return the new rate limit and a description of it for debug logging, or a RateLimitConfigError if the
+// rate limit is not valid.
+func loadRateLimit(
+	config RateLimitConfigToLoad, parentKey string, index int, rateLimitConfig *yamlRateLimit,
+	domainShadowMode bool, statsScope stats.Scope) (*RateLimit, string, error) {
+
+	// The first limit of a descriptor has the descriptor's key. Any others are told apart by their index.
+	key := parentKey
+	if index > 0 {
+		key += rateLimitIndexSeparator + strconv.Itoa(index)
+	}
+
+	var rateLimit *RateLimit = nil
+	var debugString string = ""
+	if rateLimitConfig.Unlimited {
+		unlimitedConfig := *rateLimitConfig
+		unlimitedConfig.Unlimited = false
+		unlimitedConfig.ShadowMode = false
+		unlimitedConfig.position = yamlPosition{}
+		if unlimitedConfig != (yamlRateLimit{}) {
+			return nil, "", newRateLimitConfigErrorAt(
+				config, rateLimitConfig.position, parentKey, "unlimited rate limit cannot have any other settings")
+		}
+
+		rateLimit = NewUnlimitedRateLimit(key, statsScope)
+		debugString = " ratelimit={unlimited=true}"
+	} else {
+		windowSeconds, present := parseRateLimitWindow(rateLimitConfig.Unit, rateLimitConfig.UnitMultiplier)
+		if !present {
+			return nil, "", newRateLimitConfigErrorAt(
+				config, rateLimitConfig.position, parentKey,
+				fmt.Sprintf("invalid rate limit unit '%s'", rateLimitConfig.Unit))
+		}
+
+		algorithm, present := parseRateLimitAlgorithm(rateLimitConfig.Algorithm)
+		if !present {
+			return nil, "", newRateLimitConfigErrorAt(
+				config, rateLimitConfig.position, parentKey,
+				fmt.Sprintf("invalid rate limit algorithm '%s'", rateLimitConfig.Algorithm))
+		}
+
+		if rateLimitConfig.Burst > 0 && algorithm != TokenBucket && algorithm != GCRA {
+			return nil, "", newRateLimitConfigErrorAt(
+				config, rateLimitConfig.position, parentKey,
+				fmt.Sprintf("burst is not supported by rate limit algorithm '%s'", algorithm.String()))
+		}
+
+		rateLimit = NewRateLimitWithWindow(rateLimitConfig.RequestsPerUnit, windowSeconds, key, statsScope)
+		rateLimit.Algorithm = algorithm
+		rateLimit.Burst = rateLimitConfig.Burst
+		rateLimit.ShadowMode = rateLimitConfig.ShadowMode || domainShadowMode
+		rateLimit.Aggregate = rateLimitConfig.Aggregate
+		rateLimit.Backend = rateLimitConfig.Backend
+		debugString = fmt.Sprintf(
+			" ratelimit={requests_per_unit=%d, unit=%s, unit_seconds=%d, algorithm=%s, burst=%d, shadow_mode=%t, "+
+				"aggregate=%t, backend=%s}",
+			rateLimit.Limit.RequestsPerUnit, rateLimit.Limit.Unit.String(), rateLimit.UnitSeconds,
+			rateLimit.Algorithm.String(), rateLimit.Burst, rateLimit.ShadowMode, rateLimit.Aggregate,
+			rateLimit.Backend)
+	}
+	rateLimit.Index = index
+	return rateLimit, debugString, nil
 }
 
 // Load a set of config descriptors from the YAML file and check the input.
 // @param config supplies the config file that owns the descriptor.
 // @param parentKey supplies the fully resolved key name that owns this config level.
 // @param descriptors supplies the YAML descriptors to load.
+// @param domainShadowMode supplies whether the owning domain puts all of its rate limits in shadow mode.
+// @param limitKeys supplies the full keys of the domain's rate limits loaded so far.
 // @param statsScope supplies the owning scope.
+// @return a RateLimitConfigError if any descriptor is not valid.
 func (this *rateLimitDescriptor) loadDescriptors(
 	config RateLimitConfigToLoad, parentKey string, descriptors []yamlDescriptor,
-	statsScope stats.Scope) {
+	domainShadowMode bool, limitKeys map[string]bool, statsScope stats.Scope) error {
 
 	for _, descriptorConfig := range descriptors {
 		if descriptorConfig.Key == "" {
-			panic(newRateLimitConfigError(config, "descriptor has empty key"))
+			return newRateLimitConfigErrorAt(
+				config, descriptorConfig.position, strings.TrimSuffix(parentKey, "."), "descriptor has empty key")
 		}
 
-		// Value is optional, so the final key for the map is either the key only or key_value.
-		finalKey := descriptorConfig.Key
-		if descriptorConfig.Value != "" {
-			finalKey += "_" + descriptorConfig.Value
+		valueCount := 0
+		for _, value := range []string{
+			descriptorConfig.Value, descriptorConfig.ValueRegex, descriptorConfig.ValueCIDR} {
+
+			if value != "" {
+				valueCount++
+			}
+		}
+		if valueCount > 1 {
+			return newRateLimitConfigErrorAt(
+				config, descriptorConfig.position, parentKey+descriptorConfig.Key,
+				"descriptor can only have one of value, value_regex and value_cidr")
+		}
+
+		value := descriptorConfig.Value
+		var valueRegex *regexp.Regexp = nil
+		if descriptorConfig.ValueRegex != "" {
+			var err error
+			value = descriptorConfig.ValueRegex
+			valueRegex, err = regexp.Compile(descriptorConfig.ValueRegex)
+			if err != nil {
+				return newRateLimitConfigErrorAt(
+					config, descriptorConfig.position, parentKey+descriptorConfig.Key,
+					fmt.Sprintf("invalid value_regex '%s': %s", descriptorConfig.ValueRegex, err.Error()))
+			}
+		}
+
+		var valueCIDR *net.IPNet = nil
+		if descriptorConfig.ValueCIDR != "" {
+			var err error
+			_, valueCIDR, err = net.ParseCIDR(descriptorConfig.ValueCIDR)
+			if err != nil {
+				return newRateLimitConfigErrorAt(
+					config, descriptorConfig.position, parentKey+descriptorConfig.Key,
+					fmt.Sprintf("invalid value_cidr '%s': %s", descriptorConfig.ValueCIDR, err.Error()))
+			}
+			// Use the canonical form so that equivalent networks are detected as duplicates.
+			value = valueCIDR.String()
 		}
 
+		// Value is optional, so the final key for the map is either the key only or key_value.
+		finalKey := descriptorConfig.finalKey()
 		newParentKey := parentKey + finalKey
 		if _, present := this.descriptors[finalKey]; present {
-			panic(newRateLimitConfigError(
-				config, fmt.Sprintf("duplicate descriptor composite key '%s'", newParentKey)))
+			return newRateLimitConfigErrorAt(
+				config, descriptorConfig.position, newParentKey, "duplicate descriptor composite key")
+		}
+
+		if descriptorConfig.RateLimit != nil && len(descriptorConfig.RateLimits) > 0 {
+			return newRateLimitConfigErrorAt(
+				config, descriptorConfig.position, newParentKey,
+				"descriptor cannot have both a rate_limit and rate_limits")
 		}
 
-		var rateLimit *RateLimit = nil
-		var rateLimitDebugString string = ""
+		// A single rate_limit is the same as a rate_limits list with one entry.
+		rateLimitConfigs := descriptorConfig.RateLimits
 		if descriptorConfig.RateLimit != nil {
-			value, present :=
-				pb.RateLimitResponse_RateLimit_Unit_value[strings.ToUpper(descriptorConfig.RateLimit.Unit)]
-			if !present || value == int32(pb.RateLimitResponse_RateLimit_UNKNOWN) {
-				panic(newRateLimitConfigError(
-					config,
-					fmt.Sprintf("invalid rate limit unit '%s'", descriptorConfig.RateLimit.Unit)))
+			rateLimitConfigs = []yamlRateLimit{*descriptorConfig.RateLimit}
+		}
+
+		rateLimits := []*RateLimit{}
+		rateLimitDebugString := ""
+		for i := range rateLimitConfigs {
+			rateLimit, debugString, err := loadRateLimit(
+				config, newParentKey, i, &rateLimitConfigs[i], domainShadowMode, statsScope)
+			if err != nil {
+				return err
+			}
+			rateLimits = append(rateLimits, rateLimit)
+			rateLimitDebugString += debugString
+		}
+
+		if descriptorConfig.ConcurrencyLimit != nil {
+			if len(rateLimits) > 0 {
+				return newRateLimitConfigErrorAt(
+					config, descriptorConfig.position, newParentKey,
+					"descriptor cannot have both a rate_limit and a concurrency_limit")
 			}
 
-			rateLimit = NewRateLimit(
-				descriptorConfig.RateLimit.RequestsPerUnit, pb.RateLimitResponse_RateLimit_Unit(value), newParentKey,
-				statsScope)
+			// A limit of 0 would reject every hit, which is never what is meant.
+			if descriptorConfig.ConcurrencyLimit.MaxInFlight == 0 {
+				return newRateLimitConfigErrorAt(
+					config, descriptorConfig.ConcurrencyLimit.position, newParentKey,
+					"concurrency limit must have a max_in_flight greater than 0")
+			}
+
+			leaseSeconds := int64(descriptorConfig.ConcurrencyLimit.LeaseSeconds)
+			if leaseSeconds == 0 {
+				leaseSeconds = DefaultLeaseSeconds
+			}
+
+			rateLimit := NewConcurrencyLimit(
+				descriptorConfig.ConcurrencyLimit.MaxInFlight, leaseSeconds, newParentKey, statsScope)
+			rateLimits = append(rateLimits, rateLimit)
 			rateLimitDebugString = fmt.Sprintf(
-				" ratelimit={requests_per_unit=%d, unit=%s}", rateLimit.Limit.RequestsPerUnit,
-				rateLimit.Limit.Unit.String())
+				" concurrencylimit={max_in_flight=%d, lease_seconds=%d}", rateLimit.Limit.RequestsPerUnit,
+				rateLimit.LeaseSeconds)
+		}
+
+		// Limits with the same full key would share stats, and counters too when aggregated. This happens
+		// when a key or value contains the separators the full key is built with.
+		for _, rateLimit := range rateLimits {
+			if limitKeys[rateLimit.FullKey] {
+				return newRateLimitConfigErrorAt(
+					config, descriptorConfig.position, newParentKey,
+					fmt.Sprintf("rate limit key '%s' collides with another rate limit", rateLimit.FullKey))
+			}
+			limitKeys[rateLimit.FullKey] = true
+		}
+
+		if descriptorConfig.MatchPrefix && len(rateLimits) == 0 {
+			return newRateLimitConfigErrorAt(
+				config, descriptorConfig.position, newParentKey, "descriptor has match_prefix but no rate limit")
 		}
 
 		logger.Debugf(
-			"loading descriptor: key=%s%s", newParentKey, rateLimitDebugString)
-		newDescriptor := &rateLimitDescriptor{map[string]*rateLimitDescriptor{}, rateLimit}
-		newDescriptor.loadDescriptors(
-			config, newParentKey+".", descriptorConfig.Descriptors, statsScope)
+			"loading descriptor: key=%s match_prefix=%t%s", newParentKey, descriptorConfig.MatchPrefix,
+			rateLimitDebugString)
+		for _, rateLimit := range rateLimits {
+			rateLimit.Depth = this.depth + 1
+		}
+		newDescriptor := newRateLimitDescriptor(descriptorConfig.Key, value, rateLimits)
+		newDescriptor.depth = this.depth + 1
+		newDescriptor.valueRegex = valueRegex
+		newDescriptor.valueCIDR = valueCIDR
+		newDescriptor.matchPrefix = descriptorConfig.MatchPrefix
+		err := newDescriptor.loadDescriptors(
+			config, newParentKey+".", descriptorConfig.Descriptors, domainShadowMode, limitKeys, statsScope)
+		if err != nil {
+			return err
+		}
 		this.descriptors[finalKey] = newDescriptor
+		if newDescriptor.isPrefix() {
+			prefixes := append(this.prefixDescriptors[descriptorConfig.Key], newDescriptor)
+			sort.SliceStable(prefixes, func(i, j int) bool {
+				return len(prefixes[i].prefix()) > len(prefixes[j].prefix())
+			})
+			this.prefixDescriptors[descriptorConfig.Key] = prefixes
+		}
+		if newDescriptor.valueRegex != nil {
+			this.regexDescriptors[descriptorConfig.Key] = append(
+				this.regexDescriptors[descriptorConfig.Key], newDescriptor)
+		}
+		if newDescriptor.valueCIDR != nil {
+			networks := append(this.cidrDescriptors[descriptorConfig.Key], newDescriptor)
+			sort.SliceStable(networks, func(i, j int) bool {
+				iIP, iOnes := cidrTrieKey(networks[i].valueCIDR)
+				jIP, jOnes := cidrTrieKey(networks[j].valueCIDR)
+				if len(iIP) != len(jIP) {
+					return len(iIP) < len(jIP)
+				}
+				return iOnes > jOnes
+			})
+			this.cidrDescriptors[descriptorConfig.Key] = networks
+
+			if this.cidrTries[descriptorConfig.Key] == nil {
+				this.cidrTries[descriptorConfig.Key] = &cidrTrie{}
+			}
+			this.cidrTries[descriptorConfig.Key].insert(newDescriptor.valueCIDR, newDescriptor)
+		}
+	}
+
+	return nil
+}
+
+// @return the node an alias points to, or the node itself if it is not an alias.
+func resolveYamlAlias(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
 	}
+	return node
+}
+
+// Find the value of a key in a YAML mapping.
+// @param node supplies the mapping.
+// @param key supplies the key to find.
+// @return the value or nil if the mapping does not have the key.
+func yamlMappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return resolveYamlAlias(node.Content[i+1])
+		}
+	}
+	return nil
+}
+
+// Build the name of a YAML descriptor from its mapping, without decoding the rest of it.
+// @param node supplies the descriptor's mapping.
+// @return the descriptor's name, as returned by yamlDescriptor.finalKey().
+func yamlDescriptorName(node *yaml.Node) string {
+	descriptor := yamlDescriptor{}
+	for key, field := range map[string]*string{
+		"key":         &descriptor.Key,
+		"value":       &descriptor.Value,
+		"value_regex": &descriptor.ValueRegex,
+		"value_cidr":  &descriptor.ValueCIDR,
+	} {
+		if value := yamlMappingValue(node, key); value != nil && value.Kind == yaml.ScalarNode {
+			*field = value.Value
+		}
+	}
+	return descriptor.finalKey()
 }
 
 // Validate a YAML config file's keys.
 // @param config specifies the file contents to load.
-// @param any specifies the yaml file and a map.
-func validateYamlKeys(config RateLimitConfigToLoad, config_map map[interface{}]interface{}) {
-	for k, v := range config_map {
-		if _, ok := k.(string); !ok {
-			errorText := fmt.Sprintf("config error, key is not of type string: %v", k)
-			logger.Debugf(errorText)
-			panic(newRateLimitConfigError(config, errorText))
-		}
-		if _, ok := validKeys[k.(string)]; !ok {
-			errorText := fmt.Sprintf("config error, unknown key '%s'", k)
-			logger.Debugf(errorText)
-			panic(newRateLimitConfigError(config, errorText))
-		}
-		switch v := v.(type) {
-		case []interface{}:
-			for _, e := range v {
-				if _, ok := e.(map[interface{}]interface{}); !ok {
-					errorText := fmt.Sprintf("config error, yaml file contains list of type other than map: %v", e)
-					logger.Debugf(errorText)
-					panic(newRateLimitConfigError(config, errorText))
+// @param node supplies the YAML mapping to validate.
+// @param path supplies the path of the descriptor that owns the mapping.
+// @return a RateLimitConfigError if any key is not valid.
+func validateYamlKeys(config RateLimitConfigToLoad, node *yaml.Node, path string) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], resolveYamlAlias(node.Content[i+1])
+		if k.Kind != yaml.ScalarNode || k.Tag != "!!str" {
+			return newRateLimitConfigErrorAt(
+				config, newYamlPosition(k), path, fmt.Sprintf("config error, key is not of type string: %s", k.Value))
+		}
+		if _, ok := validKeys[k.Value]; !ok {
+			return newRateLimitConfigErrorAt(
+				config, newYamlPosition(k), path, fmt.Sprintf("config error, unknown key '%s'", k.Value))
+		}
+		switch v.Kind {
+		case yaml.SequenceNode:
+			for _, e := range v.Content {
+				e = resolveYamlAlias(e)
+				if e.Kind != yaml.MappingNode {
+					return newRateLimitConfigErrorAt(
+						config, newYamlPosition(e), path,
+						fmt.Sprintf("config error, yaml file contains list of type other than map: %s", e.Value))
+				}
+
+				// Entries of a descriptors list start a new level of the descriptor path.
+				elementPath := path
+				if k.Value == "descriptors" {
+					elementPath = yamlDescriptorName(e)
+					if path != "" {
+						elementPath = path + "." + elementPath
+					}
+				}
+				if err := validateYamlKeys(config, e, elementPath); err != nil {
+					return err
+				}
+			}
+		// The keys of limit_templates are template names, so only the templates themselves are validated.
+		case yaml.MappingNode:
+			if k.Value != "limit_templates" {
+				if err := validateYamlKeys(config, v, path); err != nil {
+					return err
 				}
-				element := e.(map[interface{}]interface{})
-				validateYamlKeys(config, element)
+				break
+			}
+			for j := 0; j+1 < len(v.Content); j += 2 {
+				name, template := v.Content[j], resolveYamlAlias(v.Content[j+1])
+				if template.Kind != yaml.MappingNode {
+					return newRateLimitConfigErrorAt(
+						config, newYamlPosition(template), path,
+						fmt.Sprintf("config error, limit template '%s' is not a map", name.Value))
+				}
+				if err := validateYamlKeys(config, template, "limit_templates."+name.Value); err != nil {
+					return err
+				}
+			}
+		case yaml.ScalarNode:
+			switch v.Tag {
+			// strings, ints and bools are leaf types in ratelimit config. No need to keep validating.
+			case "!!str", "!!int", "!!bool", "!!timestamp":
+			// null is an incorrectly formed yaml. However, because this function's purpose is to validate
+			// the yaml's keys we don't return an error here.
+			case "!!null":
+			default:
+				return newRateLimitConfigErrorAt(config, newYamlPosition(v), path, "error checking config")
 			}
-		case map[interface{}]interface{}:
-			validateYamlKeys(config, v)
-		// string is a leaf type in ratelimit config. No need to keep validating.
-		case string:
-		// int is a leaf type in ratelimit config. No need to keep validating.
-		case int:
-		// nil case is an incorrectly formed yaml. However, because this function's purpose is to validate
-		// the yaml's keys we don't panic here.
-		case nil:
 		default:
-			errorText := fmt.Sprintf("error checking config")
-			logger.Debugf(errorText)
-			panic(newRateLimitConfigError(config, errorText))
+			return newRateLimitConfigErrorAt(config, newYamlPosition(v), path, "error checking config")
 		}
 	}
+
+	return nil
 }
 
-// Load a single YAML config file into the global config.
-// @param config specifies the file contents to load.
-// @param statsScope supplies the owning scope.
-func (this *rateLimitConfigImpl) loadConfig(config RateLimitConfigToLoad, statsScope stats.Scope) {
-	// validate keys in config with generic map
-	any := map[interface{}]interface{}{}
-	err := yaml.Unmarshal([]byte(config.FileBytes), &any)
+// Parse a single YAML config file and check its keys.
+// @param config specifies the file contents to parse.
+// @return the parsed file or a RateLimitConfigError if the file is not valid.
+func parseConfig(config RateLimitConfigToLoad) (yamlRoot, error) {
+	var document yaml.Node
+	err := yaml.Unmarshal([]byte(config.FileBytes), &document)
 	if err != nil {
 		errorText := fmt.Sprintf("error loading config file: %s", err.Error())
 		logger.Debugf(errorText)
-		panic(newRateLimitConfigError(config, errorText))
+		return yamlRoot{}, newRateLimitConfigError(config, errorText)
 	}
-	validateYamlKeys(config, any)
 
+	// An empty file has no content and is treated like a file with no domain.
 	var root yamlRoot
-	err = yaml.Unmarshal([]byte(config.FileBytes), &root)
+	if len(document.Content) == 0 {
+		return root, nil
+	}
+
+	node := document.Content[0]
+	if node.Kind == yaml.MappingNode {
+		path := ""
+		if domain := yamlMappingValue(node, "domain"); domain != nil {
+			path = domain.Value
+			root.domainPosition = newYamlPosition(domain)
+		}
+		if failureMode := yamlMappingValue(node, "failure_mode"); failureMode != nil {
+			root.failureModePosition = newYamlPosition(failureMode)
+		}
+		if err := validateYamlKeys(config, node, path); err != nil {
+			return yamlRoot{}, err
+		}
+	}
+
+	err = node.Decode(&root)
 	if err != nil {
 		errorText := fmt.Sprintf("error loading config file: %s", err.Error())
 		logger.Debugf(errorText)
-		panic(newRateLimitConfigError(config, errorText))
+		return yamlRoot{}, newRateLimitConfigError(config, errorText)
+	}
+
+	return root, nil
+}
+
+// Check that a YAML rate limit only names a cache backend that exists.
+// @param config supplies the config file that owns the rate limit.
+// @param rateLimit supplies the rate limit to check.
+// @param path supplies the path of the descriptor or template that owns the rate limit.
+// @param backends supplies the names of the backends, or nil if the names are not checked.
+// @return a RateLimitConfigError if the backend does not exist.
+func checkBackend(
+	config RateLimitConfigToLoad, rateLimit *yamlRateLimit, path string, backends map[string]bool) error {
+
+	if backends == nil || rateLimit.Backend == "" || backends[rateLimit.Backend] {
+		return nil
+	}
+	return newRateLimitConfigErrorAt(
+		config, rateLimit.position, path, fmt.Sprintf("unknown cache backend '%s'", rateLimit.Backend))
+}
+
+// Check that a YAML rate limit only uses an algorithm the cache supports. An invalid algorithm is
+// left for loadRateLimit() to report.
+// @param config supplies the config file that owns the rate limit.
+// @param rateLimit supplies the rate limit to check.
+// @param path supplies the path of the descriptor or template that owns the rate limit.
+// @param algorithms supplies the supported algorithms, or nil if every algorithm is supported.
+// @return a RateLimitConfigError if the algorithm is not supported.
+func checkAlgorithm(
+	config RateLimitConfigToLoad, rateLimit *yamlRateLimit, path string, algorithms map[RateLimitAlgorithm]bool) error {
+
+	algorithm, present := parseRateLimitAlgorithm(rateLimit.Algorithm)
+	if algorithms == nil || rateLimit.Unlimited || !present || algorithms[algorithm] {
+		return nil
+	}
+	return newRateLimitConfigErrorAt(
+		config, rateLimit.position, path,
+		fmt.Sprintf("rate limit algorithm '%s' is not supported by the cache", algorithm.String()))
+}
+
+// Check that the limits of a list of YAML descriptors only use algorithms the cache supports.
+// @param config supplies the config file that owns the descriptors.
+// @param parentKey supplies the fully resolved key name that owns the descriptors.
+// @param descriptors supplies the descriptors to check.
+// @param algorithms supplies the supported algorithms, or nil if every algorithm is supported.
+// @return a RateLimitConfigError if any algorithm is not supported.
+func checkAlgorithms(
+	config RateLimitConfigToLoad, parentKey string, descriptors []yamlDescriptor,
+	algorithms map[RateLimitAlgorithm]bool) error {
+
+	if algorithms == nil {
+		return nil
+	}
+
+	for i := range descriptors {
+		path := parentKey + descriptors[i].finalKey()
+		if descriptors[i].RateLimit != nil {
+			if err := checkAlgorithm(config, descriptors[i].RateLimit, path, algorithms); err != nil {
+				return err
+			}
+		}
+		for j := range descriptors[i].RateLimits {
+			if err := checkAlgorithm(config, &descriptors[i].RateLimits[j], path, algorithms); err != nil {
+				return err
+			}
+		}
+		if descriptors[i].ConcurrencyLimit != nil && !algorithms[Concurrency] {
+			return newRateLimitConfigErrorAt(
+				config, descriptors[i].ConcurrencyLimit.position, path, "concurrency limits are not supported by the cache")
+		}
+		if err := checkAlgorithms(config, path+".", descriptors[i].Descriptors, algorithms); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Check that the rate limits of a list of YAML descriptors only name cache backends that exist.
+// @param config supplies the config file that owns the descriptors.
+// @param parentKey supplies the fully resolved key name that owns the descriptors.
+// @param descriptors supplies the descriptors to check.
+// @param backends supplies the names of the backends, or nil if the names are not checked.
+// @return a RateLimitConfigError if any backend does not exist.
+func checkBackends(
+	config RateLimitConfigToLoad, parentKey string, descriptors []yamlDescriptor, backends map[string]bool) error {
+
+	for i := range descriptors {
+		path := parentKey + descriptors[i].finalKey()
+		if descriptors[i].RateLimit != nil {
+			if err := checkBackend(config, descriptors[i].RateLimit, path, backends); err != nil {
+				return err
+			}
+		}
+		for j := range descriptors[i].RateLimits {
+			if err := checkBackend(config, &descriptors[i].RateLimits[j], path, backends); err != nil {
+				return err
+			}
+		}
+		if err := checkBackends(config, path+".", descriptors[i].Descriptors, backends); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add the limit templates of a single YAML config file to the templates shared by all files.
+// @param config specifies the file that defines the templates.
+// @param root supplies the parsed file.
+// @param templates supplies the templates defined so far, which the file's templates are added to.
+// @param backends supplies the names of the cache backends, or nil if the names are not checked.
+// @param algorithms supplies the algorithms the cache supports, or nil if every algorithm is supported.
+// @return a RateLimitConfigError if any template is not valid.
+func loadTemplates(
+	config RateLimitConfigToLoad, root yamlRoot, templates map[string]yamlRateLimit, backends map[string]bool,
+	algorithms map[RateLimitAlgorithm]bool) error {
+
+	// Templates are checked like any other rate limit, so errors are reported against the file that
+	// defines them. The limits are thrown away, so their stats go nowhere.
+	checkScope := stats.NewStore(stats.NewNullSink(), false)
+	names := make([]string, 0, len(root.LimitTemplates))
+	for name := range root.LimitTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		template := root.LimitTemplates[name]
+		if _, present := templates[name]; present {
+			return newRateLimitConfigErrorAt(
+				config, template.position, "", fmt.Sprintf("duplicate limit template '%s'", name))
+		}
+		if template.Template != "" {
+			return newRateLimitConfigErrorAt(
+				config, template.position, "", fmt.Sprintf("limit template '%s' cannot reference another template", name))
+		}
+
+		_, _, err := loadRateLimit(config, "limit_templates."+name, 0, &template, false, checkScope)
+		if err != nil {
+			return err
+		}
+		if err := checkBackend(config, &template, "limit_templates."+name, backends); err != nil {
+			return err
+		}
+		if err := checkAlgorithm(config, &template, "limit_templates."+name, algorithms); err != nil {
+			return err
+		}
+		logger.Debugf("loading limit template: %s", name)
+		templates[name] = template
+	}
+
+	return nil
+}
+
+// Replace the template references in a list of YAML descriptors with the templates' settings.
+// @param config supplies the config file that owns the descriptors.
+// @param parentKey supplies the fully resolved key name that owns the descriptors.
+// @param descriptors supplies the descriptors to update in place.
+// @param templates supplies the templates defined by all files.
+// @return a RateLimitConfigError if any template reference is not valid.
+func resolveTemplates(
+	config RateLimitConfigToLoad, parentKey string, descriptors []yamlDescriptor,
+	templates map[string]yamlRateLimit) error {
+
+	resolve := func(rateLimit *yamlRateLimit, path string) error {
+		if rateLimit.Template == "" {
+			return nil
+		}
+
+		template, present := templates[rateLimit.Template]
+		if !present {
+			return newRateLimitConfigErrorAt(
+				config, rateLimit.position, path, fmt.Sprintf("unknown limit template '%s'", rateLimit.Template))
+		}
+		if *rateLimit != (yamlRateLimit{Template: rateLimit.Template, position: rateLimit.position}) {
+			return newRateLimitConfigErrorAt(
+				config, rateLimit.position, path,
+				fmt.Sprintf("rate limit using template '%s' cannot have any other settings", rateLimit.Template))
+		}
+		*rateLimit = template
+		return nil
+	}
+
+	for i := range descriptors {
+		path := parentKey + descriptors[i].finalKey()
+		if descriptors[i].RateLimit != nil {
+			if err := resolve(descriptors[i].RateLimit, path); err != nil {
+				return err
+			}
+		}
+		for j := range descriptors[i].RateLimits {
+			if err := resolve(&descriptors[i].RateLimits[j], path); err != nil {
+				return err
+			}
+		}
+		if err := resolveTemplates(config, path+".", descriptors[i].Descriptors, templates); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Load a single YAML config file into the global config.
+// @param config specifies the file to load.
+// @param root supplies the parsed file.
+// @param templates supplies the limit templates defined by all files.
+// @param statsScope supplies the owning scope.
+// @return a RateLimitConfigError if the file is not valid.
+func (this *rateLimitConfigImpl) loadConfig(
+	config RateLimitConfigToLoad, root yamlRoot, templates map[string]yamlRateLimit, statsScope stats.Scope) error {
+
+	// A file can hold nothing but templates for other files to use.
+	if root.Domain == "" && len(root.Descriptors) == 0 && len(root.LimitTemplates) > 0 {
+		return nil
 	}
 
 	if root.Domain == "" {
-		panic(newRateLimitConfigError(config, "config file cannot have empty domain"))
+		return newRateLimitConfigError(config, "config file cannot have empty domain")
 	}
 
 	if _, present := this.domains[root.Domain]; present {
-		panic(newRateLimitConfigError(
-			config, fmt.Sprintf("duplicate domain '%s' in config file", root.Domain)))
+		return newRateLimitConfigErrorAt(
+			config, root.domainPosition, "", fmt.Sprintf("duplicate domain '%s' in config file", root.Domain))
+	}
+
+	if err := resolveTemplates(config, root.Domain+".", root.Descriptors, templates); err != nil {
+		return err
+	}
+	if err := checkBackends(config, root.Domain+".", root.Descriptors, this.backends); err != nil {
+		return err
+	}
+	if err := checkAlgorithms(config, root.Domain+".", root.Descriptors, this.algorithms); err != nil {
+		return err
+	}
+
+	// A domain can only allow or deny. A domain without a failure mode uses the server-wide one.
+	failureMode, valid := ParseFailureMode(root.FailureMode)
+	if !valid || failureMode == FailureModeNone && root.FailureMode != "" {
+		return newRateLimitConfigErrorAt(
+			config, root.failureModePosition, root.Domain, fmt.Sprintf("invalid failure mode '%s'", root.FailureMode))
 	}
 
-	logger.Debugf("loading domain: %s", root.Domain)
-	newDomain := &rateLimitDomain{rateLimitDescriptor{map[string]*rateLimitDescriptor{}, nil}}
-	newDomain.loadDescriptors(config, root.Domain+".", root.Descriptors, statsScope)
+	logger.Debugf(
+		"loading domain: %s shadow_mode=%t failure_mode=%s", root.Domain, root.ShadowMode, failureMode.String())
+	newDomain := &rateLimitDomain{*newRateLimitDescriptor("", "", nil), failureMode}
+	err := newDomain.loadDescriptors(
+		config, root.Domain+".", root.Descriptors, root.ShadowMode, map[string]bool{}, statsScope)
+	if err != nil {
+		return err
+	}
 	this.domains[root.Domain] = newDomain
+	return nil
 }
 
 func (this *rateLimitConfigImpl) Dump() string {
@@ -244,31 +1198,72 @@ func (this *rateLimitConfigImpl) Dump() string {
 func (this *rateLimitConfigImpl) GetLimit(
 	ctx context.Context, domain string, descriptor *pb_struct.RateLimitDescriptor) *RateLimit {
 
+	rateLimits := this.GetLimits(ctx, domain, descriptor)
+	if len(rateLimits) == 0 {
+		return nil
+	}
+	return rateLimits[0]
+}
+
+func (this *rateLimitConfigImpl) GetLimits(
+	ctx context.Context, domain string, descriptor *pb_struct.RateLimitDescriptor) []*RateLimit {
+
 	logger.Debugf("starting get limit lookup")
-	var rateLimit *RateLimit = nil
+	var rateLimits []*RateLimit = nil
 	value := this.domains[domain]
 	if value == nil {
 		logger.Debugf("unknown domain '%s'", domain)
-		return rateLimit
+		return rateLimits
 	}
 
-	descriptorsMap := value.descriptors
+	descriptors := &value.rateLimitDescriptor
 	for i, entry := range descriptor.Entries {
-		// First see if key_value is in the map. If that isn't in the map we look for just key
-		// to check for a default value.
+		// First see if key_value is in the map. If that isn't in the map we look for the longest
+		// network that contains the value, then the longest prefix wildcard that matches it, then the
+		// first regex that matches it, and then for just key to check for a default value.
 		finalKey := entry.Key + "_" + entry.Value
 		logger.Debugf("looking up key: %s", finalKey)
-		nextDescriptor := descriptorsMap[finalKey]
+		nextDescriptor := descriptors.descriptors[finalKey]
+		if nextDescriptor != nil && nextDescriptor.isPattern() {
+			// The value happens to be the source of a regex or network, which has to match like any
+			// other value.
+			nextDescriptor = nil
+		}
+		if nextDescriptor == nil {
+			logger.Debugf("looking up network of key: %s", finalKey)
+			nextDescriptor = descriptors.longestCIDRMatch(entry.Key, entry.Value)
+			if nextDescriptor != nil {
+				finalKey = nextDescriptor.key + "_" + nextDescriptor.value
+			}
+		}
+		if nextDescriptor == nil {
+			logger.Debugf("looking up prefix of key: %s", finalKey)
+			nextDescriptor = descriptors.longestPrefixMatch(entry.Key, entry.Value)
+			if nextDescriptor != nil {
+				finalKey = nextDescriptor.key + "_" + nextDescriptor.value
+			}
+		}
+		if nextDescriptor == nil {
+			logger.Debugf("looking up regex of key: %s", finalKey)
+			nextDescriptor = descriptors.firstRegexMatch(entry.Key, entry.Value)
+			if nextDescriptor != nil {
+				finalKey = nextDescriptor.key + "_" + nextDescriptor.value
+			}
+		}
 		if nextDescriptor == nil {
 			finalKey = entry.Key
 			logger.Debugf("looking up key: %s", finalKey)
-			nextDescriptor = descriptorsMap[finalKey]
+			nextDescriptor = descriptors.descriptors[finalKey]
 		}
 
-		if nextDescriptor != nil && nextDescriptor.limit != nil {
+		if nextDescriptor != nil && len(nextDescriptor.limits) > 0 {
 			logger.Debugf("found rate limit: %s", finalKey)
+			// A deeper match replaces a shallower match_prefix one, so the most specific limits win.
 			if i == len(descriptor.Entries)-1 {
-				rateLimit = nextDescriptor.limit
+				rateLimits = nextDescriptor.limits
+			} else if nextDescriptor.matchPrefix {
+				logger.Debugf("request depth is deeper than config depth, using match_prefix rate limit")
+				rateLimits = nextDescriptor.limits
 			} else {
 				logger.Debugf("request depth does not match config depth, there are more entries in the request's descriptor")
 			}
@@ -276,39 +1271,134 @@ func (this *rateLimitConfigImpl) GetLimit(
 
 		if nextDescriptor != nil && len(nextDescriptor.descriptors) > 0 {
 			logger.Debugf("iterating to next level")
-			descriptorsMap = nextDescriptor.descriptors
+			descriptors = nextDescriptor
 		} else {
 			break
 		}
 	}
 
-	return rateLimit
+	return rateLimits
+}
+
+func (this *rateLimitConfigImpl) GetFailureMode(domain string) FailureMode {
+	value := this.domains[domain]
+	if value == nil {
+		return FailureModeNone
+	}
+	return value.failureMode
 }
 
-// Create rate limit config from a list of input YAML files.
+// Create rate limit config from a list of input YAML files. The cache backends named by limits are
+// not checked.
 // @param configs specifies a list of YAML files to load.
 // @param stats supplies the stats scope to use for limit stats during runtime.
-// @return a new config.
+// @return a new config or a RateLimitConfigError if any file is not valid.
 func NewRateLimitConfigImpl(
-	configs []RateLimitConfigToLoad, statsScope stats.Scope) RateLimitConfig {
+	configs []RateLimitConfigToLoad, statsScope stats.Scope) (RateLimitConfig, error) {
+
+	return newRateLimitConfigImpl(configs, statsScope, nil, nil)
+}
+
+// Create rate limit config from a list of input YAML files whose limits can only name the given
+// cache backends.
+// @param configs specifies a list of YAML files to load.
+// @param stats supplies the stats scope to use for limit stats during runtime.
+// @param backends supplies the names of the cache backends, which may be empty if the cache has no
+// named backends.
+// @return a new config or a RateLimitConfigError if any file is not valid.
+func NewRateLimitConfigImplForBackends(
+	configs []RateLimitConfigToLoad, statsScope stats.Scope, backends []string) (RateLimitConfig, error) {
+
+	return NewRateLimitConfigImplForCache(configs, statsScope, backends, nil)
+}
+
+// Create rate limit config from a list of input YAML files whose limits can only name the given
+// cache backends and use the given algorithms.
+// @param configs specifies a list of YAML files to load.
+// @param stats supplies the stats scope to use for limit stats during runtime.
+// @param backends supplies the names of the cache backends, which may be empty if the cache has no
+// named backends.
+// @param algorithms supplies the algorithms the cache supports, or nil if it supports every algorithm.
+// @return a new config or a RateLimitConfigError if any file is not valid.
+func NewRateLimitConfigImplForCache(
+	configs []RateLimitConfigToLoad, statsScope stats.Scope, backends []string,
+	algorithms []RateLimitAlgorithm) (RateLimitConfig, error) {
 
-	ret := &rateLimitConfigImpl{map[string]*rateLimitDomain{}}
-	for _, config := range configs {
-		ret.loadConfig(config, statsScope)
+	backendSet := map[string]bool{}
+	for _, backend := range backends {
+		backendSet[backend] = true
 	}
+	var algorithmSet map[RateLimitAlgorithm]bool = nil
+	if algorithms != nil {
+		algorithmSet = map[RateLimitAlgorithm]bool{}
+		for _, algorithm := range algorithms {
+			algorithmSet[algorithm] = true
+		}
+	}
+	return newRateLimitConfigImpl(configs, statsScope, backendSet, algorithmSet)
+}
 
-	return ret
+func newRateLimitConfigImpl(
+	configs []RateLimitConfigToLoad, statsScope stats.Scope, backends map[string]bool,
+	algorithms map[RateLimitAlgorithm]bool) (RateLimitConfig, error) {
+
+	ret := &rateLimitConfigImpl{map[string]*rateLimitDomain{}, backends, algorithms}
+
+	// Templates can be used by any file, so they are all loaded before any descriptors.
+	roots := make([]yamlRoot, len(configs))
+	templates := map[string]yamlRateLimit{}
+	for i, config := range configs {
+		var err error
+		roots[i], err = parseConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		if err = loadTemplates(config, roots[i], templates, backends, algorithms); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, config := range configs {
+		if err := ret.loadConfig(config, roots[i], templates, statsScope); err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
 }
 
-type rateLimitConfigLoaderImpl struct{}
+type rateLimitConfigLoaderImpl struct {
+	backends   []string
+	algorithms []RateLimitAlgorithm
+}
 
 func (this *rateLimitConfigLoaderImpl) Load(
-	configs []RateLimitConfigToLoad, statsScope stats.Scope) RateLimitConfig {
+	configs []RateLimitConfigToLoad, statsScope stats.Scope) (RateLimitConfig, error) {
 
-	return NewRateLimitConfigImpl(configs, statsScope)
+	if this.backends == nil {
+		return NewRateLimitConfigImpl(configs, statsScope)
+	}
+	return NewRateLimitConfigImplForCache(configs, statsScope, this.backends, this.algorithms)
 }
 
 // @return a new default config loader implementation.
 func NewRateLimitConfigLoaderImpl() RateLimitConfigLoader {
 	return &rateLimitConfigLoaderImpl{}
 }
+
+// @param backends supplies the names of the cache backends that limits can name.
+// @return a new config loader implementation that rejects limits naming any other backend.
+func NewRateLimitConfigLoaderImplForBackends(backends []string) RateLimitConfigLoader {
+	return NewRateLimitConfigLoaderImplForCache(backends, nil)
+}
+
+// @param backends supplies the names of the cache backends that limits can name.
+// @param algorithms supplies the algorithms the cache supports, or nil if it supports every algorithm.
+// @return a new config loader implementation that rejects limits naming any other backend or using
+// any other algorithm.
+func NewRateLimitConfigLoaderImplForCache(backends []string, algorithms []RateLimitAlgorithm) RateLimitConfigLoader {
+	if backends == nil {
+		backends = []string{}
+	}
+	return &rateLimitConfigLoaderImpl{backends, algorithms}
+}
@@ -11,19 +11,6 @@ import (
 	"github.com/lyft/ratelimit/src/config"
 )
 
-func loadConfigs(allConfigs []config.RateLimitConfigToLoad) {
-	defer func() {
-		err := recover()
-		if err != nil {
-			fmt.Printf("error loading rate limit configs: %s\n", err.(error).Error())
-			os.Exit(1)
-		}
-	}()
-
-	dummyStats := stats.NewStore(stats.NewNullSink(), false)
-	config.NewRateLimitConfigImpl(allConfigs, dummyStats)
-}
-
 func main() {
 	configDirectory := flag.String(
 		"config_dir", "", "path to directory containing rate limit configs")
@@ -49,6 +36,12 @@ func main() {
 		allConfigs = append(allConfigs, config.RateLimitConfigToLoad{finalPath, string(bytes)})
 	}
 
-	loadConfigs(allConfigs)
+	dummyStats := stats.NewStore(stats.NewNullSink(), false)
+	rlConfig, err := config.NewRateLimitConfigImpl(allConfigs, dummyStats)
+	if err != nil {
+		fmt.Printf("error loading rate limit configs: %s\n", err.Error())
+		os.Exit(1)
+	}
 	fmt.Printf("all rate limit configs ok\n")
+	fmt.Printf("rate limits in lookup order:\n%s", rlConfig.Dump())
 }
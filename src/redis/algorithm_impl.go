@@ -0,0 +1,366 @@
+package redis
+
+import (
+	"math"
+
+	"github.com/lyft/ratelimit/src/config"
+)
+
+// Interface for the redis operations of a rate limit algorithm. Every algorithm counts hits
+// through the same pipeline so that all descriptors in a request share a single round trip.
+type limitAlgorithm interface {
+	// Generate the cache key(s) for a limit lookup.
+	// @param prefix supplies the domain and descriptor portion of the key.
+	// @param limit supplies the rate limit to generate the key for.
+	// @param now supplies the current unix time.
+	// @return cacheKey struct.
+	generateCacheKey(prefix string, limit *config.RateLimit, now int64) cacheKey
+
+	// Append the commands that count the hits onto the connection's pipeline.
+	// @param conn supplies the connection to append to.
+	// @param key supplies the cache key generated by generateCacheKey().
+	// @param limit supplies the rate limit being counted.
+	// @param hitsAddend supplies the number of hits to add.
+	// @param expirationSeconds supplies the expiration of the counter for a single window.
+	pipelineAppend(conn Connection, key cacheKey, limit *config.RateLimit, hitsAddend uint32, expirationSeconds int64)
+
+	// Fetch the responses for the commands appended by pipelineAppend().
+	// @param conn supplies the connection to fetch from.
+	// @param key supplies the cache key generated by generateCacheKey().
+	// @return the number of hits counted against the limit, including this request's hits, or a
+	// RedisError if a response could not be fetched.
+	pipelineFetch(conn Connection, key cacheKey) (uint32, error)
+
+	// @param limit supplies the rate limit being counted.
+	// @return the number of hits that can be counted before the limit is exceeded.
+	overLimitThreshold(limit *config.RateLimit) uint32
+
+	// @param limit supplies the rate limit being counted.
+	// @return the expiration of the limit's keys in seconds before jitter is added.
+	expirationSeconds(limit *config.RateLimit) int64
+}
+
+// Fetch the next response of a connection's pipeline as an integer.
+// @param conn supplies the connection to fetch from.
+// @return the response as an integer or a RedisError if it could not be fetched.
+func pipeResponseInt(conn Connection) (int64, error) {
+	response, err := conn.PipeResponse()
+	if err != nil {
+		return 0, err
+	}
+	return response.Int()
+}
+
+var limitAlgorithms = map[config.RateLimitAlgorithm]limitAlgorithm{
+	config.FixedWindow:   fixedWindowAlgorithm{},
+	config.SlidingWindow: slidingWindowAlgorithm{},
+	config.TokenBucket:   tokenBucketAlgorithm{},
+	config.GCRA:          gcraAlgorithm{},
+	config.Concurrency:   concurrencyAlgorithm{},
+}
+
+// The fixed window algorithm increments a single counter per window.
+type fixedWindowAlgorithm struct{}
+
+func (fixedWindowAlgorithm) generateCacheKey(prefix string, limit *config.RateLimit, now int64) cacheKey {
+	return cacheKey{key: windowKey(prefix, limit.UnitSeconds, now)}
+}
+
+func (fixedWindowAlgorithm) pipelineAppend(
+	conn Connection, key cacheKey, limit *config.RateLimit, hitsAddend uint32, expirationSeconds int64) {
+
+	conn.PipeAppend("INCRBY", key.key, hitsAddend)
+	conn.PipeAppend("EXPIRE", key.key, expirationSeconds)
+}
+
+func (fixedWindowAlgorithm) pipelineFetch(conn Connection, key cacheKey) (uint32, error) {
+	ret, err := pipeResponseInt(conn)
+	if err != nil {
+		return 0, err
+	}
+	// Pop off EXPIRE response and check for error.
+	if _, err := conn.PipeResponse(); err != nil {
+		return 0, err
+	}
+	return uint32(ret), nil
+}
+
+func (fixedWindowAlgorithm) overLimitThreshold(limit *config.RateLimit) uint32 {
+	return limit.Limit.RequestsPerUnit
+}
+
+func (fixedWindowAlgorithm) expirationSeconds(limit *config.RateLimit) int64 {
+	return limit.UnitSeconds
+}
+
+// The sliding window algorithm increments the counter for the current window and reads the
+// counter for the previous window. The previous count is weighted by the fraction of the
+// previous window that still falls within a window-sized interval ending now. This smooths out
+// bursts across window boundaries without storing a timestamp per hit.
+type slidingWindowAlgorithm struct{}
+
+func (slidingWindowAlgorithm) generateCacheKey(prefix string, limit *config.RateLimit, now int64) cacheKey {
+	divider := limit.UnitSeconds
+	elapsed := now % divider
+	return cacheKey{
+		key:            windowKey(prefix, divider, now),
+		previousKey:    windowKey(prefix, divider, now-divider),
+		previousWeight: float64(divider-elapsed) / float64(divider),
+	}
+}
+
+func (slidingWindowAlgorithm) pipelineAppend(
+	conn Connection, key cacheKey, limit *config.RateLimit, hitsAddend uint32, expirationSeconds int64) {
+
+	conn.PipeAppend("INCRBY", key.key, hitsAddend)
+	conn.PipeAppend("EXPIRE", key.key, expirationSeconds)
+	conn.PipeAppend("GET", key.previousKey)
+}
+
+func (slidingWindowAlgorithm) pipelineFetch(conn Connection, key cacheKey) (uint32, error) {
+	current, err := pipeResponseInt(conn)
+	if err != nil {
+		return 0, err
+	}
+	// Pop off EXPIRE response and check for error.
+	if _, err := conn.PipeResponse(); err != nil {
+		return 0, err
+	}
+	previous, err := pipeResponseInt(conn)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(current + int64(math.Floor(float64(previous)*key.previousWeight))), nil
+}
+
+func (slidingWindowAlgorithm) overLimitThreshold(limit *config.RateLimit) uint32 {
+	return limit.Limit.RequestsPerUnit
+}
+
+func (slidingWindowAlgorithm) expirationSeconds(limit *config.RateLimit) int64 {
+	// The counter is read as the previous window during the next window, so it has to outlive it.
+	return limit.UnitSeconds * 2
+}
+
+// Refill the bucket for the time elapsed since it was last updated and take hitsAddend tokens if
+// there are enough left. Tokens are fractional so that slow refill rates are not rounded away.
+// Redis' clock is used so that the bucket refills smoothly with millisecond resolution and every
+// ratelimit instance refills it against the same time, which requires script effects replication
+// (Redis 3.2 or later). If the clock goes back, the bucket refills from the new time on.
+// KEYS[1]: the bucket hash.
+// ARGV: capacity, requests per unit, unit in seconds, hits, expiration seconds.
+// Returns the number of tokens in use after the request, which exceeds the capacity when the
+// request was rejected.
+const tokenBucketScript = `
+redis.replicate_commands()
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2]) / (tonumber(ARGV[3]) * 1000)
+local hits = tonumber(ARGV[4])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or capacity
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+local used = capacity - math.floor(tokens)
+if tokens < hits then
+  return used + hits
+end
+tokens = tokens - hits
+redis.call("HMSET", KEYS[1], "tokens", tokens, "ts", now)
+redis.call("EXPIRE", KEYS[1], ARGV[5])
+return capacity - math.floor(tokens)
+`
+
+// The token bucket algorithm refills a bucket of burst tokens at requests_per_unit per unit and
+// takes one token per hit. Rejected hits do not take tokens. The bucket is updated atomically by a
+// Lua script so that concurrent requests cannot both take the last token.
+type tokenBucketAlgorithm struct{}
+
+func (tokenBucketAlgorithm) generateCacheKey(prefix string, limit *config.RateLimit, now int64) cacheKey {
+	return cacheKey{key: prefix + "token_bucket"}
+}
+
+func (this tokenBucketAlgorithm) pipelineAppend(
+	conn Connection, key cacheKey, limit *config.RateLimit, hitsAddend uint32, expirationSeconds int64) {
+
+	conn.PipeAppend(
+		"EVAL", tokenBucketScript, 1, key.key, this.overLimitThreshold(limit), limit.Limit.RequestsPerUnit,
+		limit.UnitSeconds, hitsAddend, expirationSeconds)
+}
+
+func (tokenBucketAlgorithm) pipelineFetch(conn Connection, key cacheKey) (uint32, error) {
+	ret, err := pipeResponseInt(conn)
+	return uint32(ret), err
+}
+
+func (tokenBucketAlgorithm) overLimitThreshold(limit *config.RateLimit) uint32 {
+	if limit.Burst > 0 {
+		return limit.Burst
+	}
+	return limit.Limit.RequestsPerUnit
+}
+
+func (this tokenBucketAlgorithm) expirationSeconds(limit *config.RateLimit) int64 {
+	divider := limit.UnitSeconds
+	if limit.Limit.RequestsPerUnit == 0 {
+		return divider
+	}
+
+	// An untouched bucket is full again once it has refilled from empty, so it can be dropped.
+	return int64(math.Ceil(
+		float64(this.overLimitThreshold(limit)) * float64(divider) / float64(limit.Limit.RequestsPerUnit)))
+}
+
+// Advance the theoretical arrival time (TAT) by one emission interval per hit and accept the hits
+// if the TAT stays within burst emission intervals of now. Redis' clock is used so that all
+// ratelimit instances pace against the same time with millisecond resolution, which requires
+// script effects replication (Redis 3.2 or later).
+// KEYS[1]: the TAT key.
+// ARGV: requests per unit, unit in seconds, burst, hits.
+// Returns the number of emission intervals between now and the TAT after the request, which
+// exceeds the burst when the request was rejected.
+const gcraScript = `
+redis.replicate_commands()
+local requests = tonumber(ARGV[1])
+local burst = tonumber(ARGV[3])
+local hits = tonumber(ARGV[4])
+if requests == 0 then
+  return burst + hits
+end
+local emission = tonumber(ARGV[2]) * 1000 / requests
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local tat = tonumber(redis.call("GET", KEYS[1])) or now
+if tat < now then
+  tat = now
+end
+local newTat = tat + hits * emission
+local used = math.ceil((newTat - now) / emission)
+if newTat - now > burst * emission then
+  return used
+end
+redis.call("SET", KEYS[1], newTat, "PX", math.ceil(newTat - now))
+return used
+`
+
+// The generic cell rate algorithm (GCRA) stores a single theoretical arrival time per key and
+// spaces hits at least unit/requests_per_unit apart, allowing up to burst hits at once. Unlike
+// the windowed algorithms it never lets a full window's worth of hits through at the same time
+// unless the burst allows it.
+type gcraAlgorithm struct{}
+
+func (gcraAlgorithm) generateCacheKey(prefix string, limit *config.RateLimit, now int64) cacheKey {
+	return cacheKey{key: prefix + "gcra"}
+}
+
+func (this gcraAlgorithm) pipelineAppend(
+	conn Connection, key cacheKey, limit *config.RateLimit, hitsAddend uint32, expirationSeconds int64) {
+
+	// The key expires on its own once the TAT has passed, so expirationSeconds is not needed.
+	conn.PipeAppend(
+		"EVAL", gcraScript, 1, key.key, limit.Limit.RequestsPerUnit, limit.UnitSeconds,
+		this.overLimitThreshold(limit), hitsAddend)
+}
+
+func (gcraAlgorithm) pipelineFetch(conn Connection, key cacheKey) (uint32, error) {
+	ret, err := pipeResponseInt(conn)
+	return uint32(ret), err
+}
+
+func (gcraAlgorithm) overLimitThreshold(limit *config.RateLimit) uint32 {
+	if limit.Burst > 0 {
+		return limit.Burst
+	}
+	return 1
+}
+
+func (gcraAlgorithm) expirationSeconds(limit *config.RateLimit) int64 {
+	return 0
+}
+
+// Drop expired leases and add a lease per hit if that keeps the number of leases within the
+// maximum. Leases are members of a sorted set scored by their expiration time in milliseconds, and
+// are named after the call's lease ID and their position in the call so that a release removes
+// exactly the leases of its call. Redis' clock is used so that lease expiration is consistent
+// across ratelimit instances.
+// KEYS[1]: the lease set.
+// ARGV: max in flight, lease seconds, hits, lease ID.
+// Returns the number of leases after the request, which exceeds the maximum when the request was
+// rejected.
+const concurrencyAcquireScript = `
+redis.replicate_commands()
+local max = tonumber(ARGV[1])
+local lease = tonumber(ARGV[2]) * 1000
+local hits = tonumber(ARGV[3])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now)
+local used = redis.call("ZCARD", KEYS[1]) + hits
+if used > max then
+  return used
+end
+for i = 1, hits do
+  redis.call("ZADD", KEYS[1], now + lease, ARGV[4] .. "." .. i)
+end
+redis.call("PEXPIRE", KEYS[1], lease)
+return used
+`
+
+// Remove the leases a call acquired. Leases that already expired are gone, so releasing them does
+// not free a slot held by another call.
+// KEYS[1]: the lease set.
+// ARGV: hits, lease ID.
+// Returns the number of leases left.
+const concurrencyReleaseScript = `
+for i = 1, tonumber(ARGV[1]) do
+  redis.call("ZREM", KEYS[1], ARGV[2] .. "." .. i)
+end
+return redis.call("ZCARD", KEYS[1])
+`
+
+// The concurrency algorithm counts hits that are in flight rather than hits per unit of time.
+// Each hit acquires a lease that is held until it is released or expires.
+type concurrencyAlgorithm struct{}
+
+func (concurrencyAlgorithm) generateCacheKey(prefix string, limit *config.RateLimit, now int64) cacheKey {
+	return cacheKey{key: prefix + "concurrency"}
+}
+
+func (concurrencyAlgorithm) pipelineAppend(
+	conn Connection, key cacheKey, limit *config.RateLimit, hitsAddend uint32, expirationSeconds int64) {
+
+	// The lease length is part of the limit's semantics, so expirationSeconds and its jitter are not used.
+	conn.PipeAppend(
+		"EVAL", concurrencyAcquireScript, 1, key.key, limit.Limit.RequestsPerUnit, limit.LeaseSeconds, hitsAddend,
+		key.leaseID)
+}
+
+func (concurrencyAlgorithm) pipelineFetch(conn Connection, key cacheKey) (uint32, error) {
+	ret, err := pipeResponseInt(conn)
+	return uint32(ret), err
+}
+
+func (concurrencyAlgorithm) overLimitThreshold(limit *config.RateLimit) uint32 {
+	return limit.Limit.RequestsPerUnit
+}
+
+func (concurrencyAlgorithm) expirationSeconds(limit *config.RateLimit) int64 {
+	return limit.LeaseSeconds
+}
+
+// Append the commands that release hits onto the connection's pipeline.
+// @param conn supplies the connection to append to.
+// @param key supplies the cache key generated by generateCacheKey().
+// @param hitsAddend supplies the number of hits to release.
+func (concurrencyAlgorithm) releaseAppend(conn Connection, key cacheKey, hitsAddend uint32) {
+	conn.PipeAppend("EVAL", concurrencyReleaseScript, 1, key.key, hitsAddend, key.leaseID)
+}
+
+// Fetch the response for the commands appended by releaseAppend().
+// @param conn supplies the connection to fetch from.
+// @return the number of hits still in flight or a RedisError if the response could not be fetched.
+func (concurrencyAlgorithm) releaseFetch(conn Connection) (uint32, error) {
+	ret, err := pipeResponseInt(conn)
+	return uint32(ret), err
+}
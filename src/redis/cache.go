@@ -1,6 +1,7 @@
 package redis
 
 import (
+	"github.com/bradfitz/gomemcache/memcache"
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
 	"github.com/lyft/ratelimit/src/config"
 	"golang.org/x/net/context"
@@ -20,6 +21,40 @@ type JitterRandSource interface {
 	Seed(seed int64)
 }
 
+// Name of the backend that stores the limits that are not routed to another backend.
+const DefaultBackend = "default"
+
+// Name of the backend that NewRateLimitCacheImpl() stores per second limits in.
+const PerSecondBackend = "per_second"
+
+// A shard of the cache keys and the pool of the redis that stores them.
+type Shard struct {
+	// Name of the shard, which decides the keys it owns.
+	Name string
+	Pool Pool
+}
+
+// Interface for a memcached client, which is implemented by *memcache.Client.
+type MemcachedClient interface {
+	// Add to a counter.
+	// @param key supplies the counter's key.
+	// @param delta supplies the amount to add.
+	// @return the counter's new value, memcache.ErrCacheMiss if the counter does not exist or
+	// another error if memcached could not be reached.
+	Increment(key string, delta uint64) (uint64, error)
+
+	// Store an item unless its key already exists.
+	// @param item supplies the item.
+	// @return memcache.ErrNotStored if the key already exists or another error if memcached could
+	// not be reached.
+	Add(item *memcache.Item) error
+
+	// @param key supplies the key to read.
+	// @return the key's item, memcache.ErrCacheMiss if the key does not exist or another error if
+	// memcached could not be reached.
+	Get(key string) (*memcache.Item, error)
+}
+
 // Interface for interacting with a cache backend for rate limiting.
 type RateLimitCache interface {
 	// Contact the cache and perform rate limiting for a set of descriptors and limits.
@@ -29,10 +64,28 @@ type RateLimitCache interface {
 	//               which means that the associated descriptor does not need to be checked. This
 	//               is done for simplicity reasons in the overall service API. The length of this
 	//               list must be same as the length of the descriptors list.
-	// @return a list of DescriptorStatuses which corresponds to each passed in descriptor/limit pair.
-	// 				 Throws RedisError if there was any error talking to the cache.
+	// @param leaseID supplies the ID of the leases acquired for concurrency limits, which is needed
+	//                to release them. It may be empty if there are no concurrency limits.
+	// @return a list of DescriptorStatuses which corresponds to each passed in descriptor/limit pair,
+	//         or a RedisError if there was any error talking to the cache.
 	DoLimit(
 		ctx context.Context,
 		request *pb.RateLimitRequest,
-		limits []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus
+		limits []*config.RateLimit,
+		leaseID string) ([]*pb.RateLimitResponse_DescriptorStatus, error)
+
+	// Contact the cache and release hits previously acquired by DoLimit for concurrency limits.
+	// @param ctx supplies the request context.
+	// @param request supplies the Release service request.
+	// @param limits supplies the list of associated limits. Limits that are nil or that are not
+	//               concurrency limits are skipped. The length of this list must be same as the
+	//               length of the descriptors list.
+	// @param leaseID supplies the ID the leases were acquired with. Only leases with this ID are released.
+	// @return a list of DescriptorStatuses which corresponds to each passed in descriptor/limit pair,
+	//         or a RedisError if there was any error talking to the cache.
+	Release(
+		ctx context.Context,
+		request *pb.RateLimitRequest,
+		limits []*config.RateLimit,
+		leaseID string) ([]*pb.RateLimitResponse_DescriptorStatus, error)
 }
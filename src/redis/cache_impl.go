@@ -5,6 +5,7 @@ import (
 	"math"
 	"math/rand"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,13 +19,42 @@ import (
 	"golang.org/x/net/context"
 )
 
+// A limit whose hits are counted in the store by a single call.
+type cacheLookup struct {
+	// Position of the limit in the call's list of descriptors.
+	index int
+	key   cacheKey
+	limit *config.RateLimit
+	// Expiration of the limit's counter for a single window, including jitter.
+	expirationSeconds int64
+}
+
+// Interface for the storage that counts the hits of rate limits. Key generation, the local cache
+// and stats are shared by every store.
+type limitStore interface {
+	// Count the hits of a call against a set of limits.
+	// @param ctx supplies the call's context, which may be nil. The store stops waiting for its
+	// backend once the context is done.
+	// @param deadline supplies the time by which the store must answer, or the zero time for no deadline.
+	// @param lookups supplies the limits to count the hits against.
+	// @param hitsAddend supplies the number of hits to add.
+	// @return the number of hits counted against each limit, including this call's hits, or an error
+	// if the store could not count them.
+	doLimit(ctx context.Context, deadline time.Time, lookups []cacheLookup, hitsAddend uint32) ([]uint32, error)
+
+	// Release hits acquired under concurrency limits.
+	// @param ctx supplies the call's context, which may be nil. The store stops waiting for its
+	// backend once the context is done.
+	// @param deadline supplies the time by which the store must answer, or the zero time for no deadline.
+	// @param lookups supplies the concurrency limits to release hits from.
+	// @param hitsAddend supplies the number of hits to release.
+	// @return the number of hits still in flight for each limit, or an error if the store could not
+	// release them.
+	release(ctx context.Context, deadline time.Time, lookups []cacheLookup, hitsAddend uint32) ([]uint32, error)
+}
+
 type rateLimitCacheImpl struct {
-	pool Pool
-	// Optional Pool for a dedicated cache of per second limits.
-	// If this pool is nil, then the Cache will use the pool for all
-	// limits regardless of unit. If this pool is not nil, then it
-	// is used for limits that have a SECOND unit.
-	perSecondPool              Pool
+	store                      limitStore
 	timeSource                 TimeSource
 	jitterRand                 *rand.Rand
 	expirationJitterMaxSeconds int64
@@ -34,22 +64,21 @@ type rateLimitCacheImpl struct {
 	latency    stats.Timer
 }
 
-// Convert a rate limit into a time divider.
-// @param unit supplies the unit to convert.
-// @return the divider to use in time computations.
-func unitToDivider(unit pb.RateLimitResponse_RateLimit_Unit) int64 {
-	switch unit {
-	case pb.RateLimitResponse_RateLimit_SECOND:
-		return 1
-	case pb.RateLimitResponse_RateLimit_MINUTE:
-		return 60
-	case pb.RateLimitResponse_RateLimit_HOUR:
-		return 60 * 60
-	case pb.RateLimitResponse_RateLimit_DAY:
-		return 60 * 60 * 24
+// Write a part of a cache key, doubling any '#' so that it cannot be mistaken for the index of a
+// further limit.
+// @param b supplies the buffer to write to.
+// @param part supplies the part to write.
+func writeCacheKeyPart(b *bytes.Buffer, part string) {
+	for {
+		i := strings.IndexByte(part, '#')
+		if i < 0 {
+			b.WriteString(part)
+			return
+		}
+		b.WriteString(part[:i+1])
+		b.WriteByte('#')
+		part = part[i+1:]
 	}
-
-	panic("should not get here")
 }
 
 // Generate a cache key for a limit lookup.
@@ -61,10 +90,9 @@ func unitToDivider(unit pb.RateLimitResponse_RateLimit_Unit) int64 {
 func (this *rateLimitCacheImpl) generateCacheKey(
 	domain string, descriptor *pb_struct.RateLimitDescriptor, limit *config.RateLimit, now int64) cacheKey {
 
-	if limit == nil {
+	if limit == nil || limit.Unlimited {
 		return cacheKey{
-			key:       "",
-			perSecond: false,
+			key: "",
 		}
 	}
 
@@ -72,26 +100,49 @@ func (this *rateLimitCacheImpl) generateCacheKey(
 	defer this.bufferPool.Put(b)
 	b.Reset()
 
-	b.WriteString(domain)
-	b.WriteByte('_')
-
-	for _, entry := range descriptor.Entries {
-		b.WriteString(entry.Key)
+	if limit.Aggregate {
+		// Every value that matches the limit shares one counter. The full key already starts with the domain.
+		writeCacheKeyPart(b, limit.FullKey)
 		b.WriteByte('_')
-		b.WriteString(entry.Value)
+	} else {
+		writeCacheKeyPart(b, domain)
 		b.WriteByte('_')
+
+		// A match_prefix limit is counted by the entries its descriptor matched, so the entries after
+		// them are left out.
+		entries := descriptor.Entries
+		if limit.Depth > 0 && limit.Depth < len(entries) {
+			entries = entries[:limit.Depth]
+		}
+		for _, entry := range entries {
+			writeCacheKeyPart(b, entry.Key)
+			b.WriteByte('_')
+			writeCacheKeyPart(b, entry.Value)
+			b.WriteByte('_')
+		}
 	}
 
-	divider := unitToDivider(limit.Limit.Unit)
-	b.WriteString(strconv.FormatInt((now/divider)*divider, 10))
+	// Further limits on the same descriptor are counted separately from the first. Every other '#' in
+	// the key is doubled, so a single one only ever comes from the index.
+	if limit.Index > 0 {
+		b.WriteByte('#')
+		b.WriteString(strconv.Itoa(limit.Index))
+		b.WriteByte('_')
+	}
 
-	return cacheKey{
-		key:       b.String(),
-		perSecond: isPerSecondLimit(limit.Limit.Unit)}
+	prefix := b.String()
+	ret := limitAlgorithms[limit.Algorithm].generateCacheKey(prefix, limit, now)
+	ret.shardKey = prefix
+	return ret
 }
 
-func isPerSecondLimit(unit pb.RateLimitResponse_RateLimit_Unit) bool {
-	return unit == pb.RateLimitResponse_RateLimit_SECOND
+// Generate the key of the window that contains a point in time.
+// @param prefix supplies the domain and descriptor portion of the key.
+// @param divider supplies the window length in seconds.
+// @param now supplies the unix time to find the window for.
+// @return the prefix suffixed with the start time of the window.
+func windowKey(prefix string, divider int64, now int64) string {
+	return prefix + strconv.FormatInt((now/divider)*divider, 10)
 }
 
 func max(a uint32, b uint32) uint32 {
@@ -103,46 +154,70 @@ func max(a uint32, b uint32) uint32 {
 
 type cacheKey struct {
 	key string
-	// True if the key corresponds to a limit with a SECOND unit. False otherwise.
-	perSecond bool
+	// Key of the previous window. Only used by the sliding window algorithm.
+	previousKey string
+	// Weight of the previous window's count. Only used by the sliding window algorithm.
+	previousWeight float64
+	// ID of the call's leases. Only used by the concurrency algorithm.
+	leaseID string
+	// Key that decides the shard of the limit. It leaves out the window so that every key of a
+	// limit lives on the same shard.
+	shardKey string
 }
 
-func pipelineAppend(conn Connection, key string, hitsAddend uint32, expirationSeconds int64) {
-	conn.PipeAppend("INCRBY", key, hitsAddend)
-	conn.PipeAppend("EXPIRE", key, expirationSeconds)
+// Turn the error of a context that is done into the error a call fails with.
+// @param err supplies the context's error.
+// @param when supplies when the context was found to be done, for the error message.
+// @return a RedisTimeoutError if the deadline passed or else the context's error.
+func contextError(err error, when string) error {
+	if err == context.DeadlineExceeded {
+		return RedisTimeoutError("deadline exceeded " + when)
+	}
+	return err
 }
 
-func pipelineFetch(conn Connection) uint32 {
-	ret := uint32(conn.PipeResponse().Int())
-	// Pop off EXPIRE response and check for error.
-	conn.PipeResponse()
-	return ret
+// Check that a call can still go to redis and find when its redis operations must complete by.
+// @param ctx supplies the call's context, which may be nil.
+// @return the context's deadline or the zero time if it has none, a RedisTimeoutError if the deadline
+// already passed or the context's error if it was cancelled.
+func contextDeadline(ctx context.Context) (time.Time, error) {
+	if ctx == nil {
+		return time.Time{}, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, contextError(err, "before calling redis")
+	}
+
+	deadline, _ := ctx.Deadline()
+	return deadline, nil
 }
 
 func (this *rateLimitCacheImpl) DoLimit(
 	ctx context.Context,
 	request *pb.RateLimitRequest,
-	limits []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
+	limits []*config.RateLimit,
+	leaseID string) ([]*pb.RateLimitResponse_DescriptorStatus, error) {
 
 	logger.Debugf("starting cache lookup")
 
-	var conn Connection = nil // lazy initialized
-
-	// Optional connection for per second limits. If the cache has a perSecondPool setup,
-	// then use a connection from the pool for per second limits.
-	var perSecondConn Connection = nil // lazy initialized
+	deadline, err := contextDeadline(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	// request.HitsAddend could be 0 (default value) if not specified by the caller in the Ratelimit request.
 	hitsAddend := max(1, request.HitsAddend)
 
 	// First build a list of all cache keys that we are actually going to hit. generateCacheKey()
-	// returns an empty string in the key if there is no limit so that we can keep the arrays
-	// all the same size.
+	// returns an empty string in the key if there is no limit or the limit is unlimited so that we
+	// can keep the arrays all the same size.
 	assert.Assert(len(request.Descriptors) == len(limits))
 	cacheKeys := make([]cacheKey, len(request.Descriptors))
 	now := this.timeSource.UnixNow()
 	for i := 0; i < len(request.Descriptors); i++ {
 		cacheKeys[i] = this.generateCacheKey(request.Domain, request.Descriptors[i], limits[i], now)
+		cacheKeys[i].leaseID = leaseID
 
 		// Increase statistics for limits hit by their respective requests.
 		if limits[i] != nil {
@@ -152,14 +227,17 @@ func (this *rateLimitCacheImpl) DoLimit(
 
 	isOverLimitWithLocalCache := make([]bool, len(request.Descriptors))
 
-	// Now, actually setup the pipeline, skipping empty cache keys.
+	// Now, actually count the hits in the store, skipping empty cache keys.
 	timespan := this.latency.AllocateSpan()
+	lookups := make([]cacheLookup, 0, len(cacheKeys))
 	for i, cacheKey := range cacheKeys {
 		if cacheKey.key == "" {
 			continue
 		}
 
-		if this.localCache != nil {
+		// Only a fixed window is guaranteed to stay over the limit until its key changes, so other
+		// algorithms always go to the store.
+		if this.localCache != nil && limits[i].Algorithm == config.FixedWindow {
 			// Get returns the value or not found error.
 			_, err := this.localCache.Get([]byte(cacheKey.key))
 			if err == nil {
@@ -171,31 +249,23 @@ func (this *rateLimitCacheImpl) DoLimit(
 
 		logger.Debugf("looking up cache key: %s", cacheKey.key)
 
-		expirationSeconds := unitToDivider(limits[i].Limit.Unit)
+		expirationSeconds := limitAlgorithms[limits[i].Algorithm].expirationSeconds(limits[i])
 		if this.expirationJitterMaxSeconds > 0 {
 			expirationSeconds += this.jitterRand.Int63n(this.expirationJitterMaxSeconds)
 		}
-
-		// Use the perSecondConn if it is not nil and the cacheKey represents a per second Limit.
-		if this.perSecondPool != nil && cacheKey.perSecond {
-			if perSecondConn == nil {
-				perSecondConn = this.perSecondPool.Get()
-				defer this.perSecondPool.Put(perSecondConn)
-			}
-
-			pipelineAppend(perSecondConn, cacheKey.key, hitsAddend, expirationSeconds)
-		} else {
-			if conn == nil {
-				conn = this.pool.Get()
-				defer this.pool.Put(conn)
-			}
-
-			pipelineAppend(conn, cacheKey.key, hitsAddend, expirationSeconds)
-		}
+		lookups = append(lookups, cacheLookup{i, cacheKey, limits[i], expirationSeconds})
 	}
+
+	counts, err := this.store.doLimit(ctx, deadline, lookups, hitsAddend)
 	timespan.Complete()
+	if err != nil {
+		return nil, err
+	}
+	limitsAfterIncrease := make([]uint32, len(request.Descriptors))
+	for j, lookup := range lookups {
+		limitsAfterIncrease[lookup.index] = counts[j]
+	}
 
-	// Now fetch the pipeline.
 	responseDescriptorStatuses := make([]*pb.RateLimitResponse_DescriptorStatus,
 		len(request.Descriptors))
 	for i, cacheKey := range cacheKeys {
@@ -221,19 +291,18 @@ func (this *rateLimitCacheImpl) DoLimit(
 			continue
 		}
 
-		var limitAfterIncrease uint32
-		// Use the perSecondConn if it is not nil and the cacheKey represents a per second Limit.
-		if this.perSecondPool != nil && cacheKey.perSecond {
-			limitAfterIncrease = pipelineFetch(perSecondConn)
-		} else {
-			limitAfterIncrease = pipelineFetch(conn)
-		}
-
+		algorithm := limitAlgorithms[limits[i].Algorithm]
+		limitAfterIncrease := limitsAfterIncrease[i]
 		limitBeforeIncrease := limitAfterIncrease - hitsAddend
-		overLimitThreshold := limits[i].Limit.RequestsPerUnit
+		overLimitThreshold := algorithm.overLimitThreshold(limits[i])
 		// The nearLimitThreshold is the number of requests that can be made before hitting the NearLimitRatio.
 		// We need to know it in both the OK and OVER_LIMIT scenarios.
 		nearLimitThreshold := uint32(math.Floor(float64(float32(overLimitThreshold) * config.NearLimitRatio)))
+		// A GCRA limit with a burst of 1 accepts a single hit at a time, so an accepted hit uses the whole
+		// burst without being any closer to the limit. None of its hits are near the limit.
+		if limits[i].Algorithm == config.GCRA && overLimitThreshold == 1 {
+			nearLimitThreshold = overLimitThreshold
+		}
 
 		logger.Debugf("cache key: %s current: %d", cacheKey.key, limitAfterIncrease)
 		if limitAfterIncrease > overLimitThreshold {
@@ -249,16 +318,23 @@ func (this *rateLimitCacheImpl) DoLimit(
 			// N hits was over the limit, then all the N hits were over limit.
 			// Otherwise, only the difference between the current limit value and the over limit threshold
 			// were over limit hits.
-			if limitBeforeIncrease >= overLimitThreshold {
-				limits[i].Stats.OverLimit.Add(uint64(hitsAddend))
-			} else {
-				limits[i].Stats.OverLimit.Add(uint64(limitAfterIncrease - overLimitThreshold))
+			overLimitHits := hitsAddend
+			if limitBeforeIncrease < overLimitThreshold {
+				overLimitHits = limitAfterIncrease - overLimitThreshold
 
 				// If the limit before increase was below the over limit value, then some of the hits were
 				// in the near limit range.
 				limits[i].Stats.NearLimit.Add(uint64(overLimitThreshold - max(nearLimitThreshold, limitBeforeIncrease)))
 			}
-			if this.localCache != nil {
+			limits[i].Stats.OverLimit.Add(uint64(overLimitHits))
+
+			// A shadow mode limit reports the hits it would have rejected but lets them through. It is
+			// never added to the local cache, so that every hit keeps being counted in the store.
+			if limits[i].ShadowMode {
+				logger.Infof("cache key is over the limit in shadow mode: %s", cacheKey.key)
+				responseDescriptorStatuses[i].Code = pb.RateLimitResponse_OK
+				limits[i].Stats.ShadowMode.Add(uint64(overLimitHits))
+			} else if this.localCache != nil && limits[i].Algorithm == config.FixedWindow {
 				// Set the TTL of the local_cache to be the entire duration.
 				// Since the cache_key gets changed once the time crosses over current time slot, the over-the-limit
 				// cache keys in local_cache lose effectiveness.
@@ -266,7 +342,7 @@ func (this *rateLimitCacheImpl) DoLimit(
 				// similar to mongo_1h, mongo_2h, etc. In the hour 1 (0h0m - 0h59m), the cache key is mongo_1h, we start
 				// to get ratelimited in the 50th minute, the ttl of local_cache will be set as 1 hour(0h50m-1h49m).
 				// In the time of 1h1m, since the cache key becomes different (mongo_2h), it won't get ratelimited.
-				err := this.localCache.Set([]byte(cacheKey.key), []byte{}, int(unitToDivider(limits[i].Limit.Unit)))
+				err := this.localCache.Set([]byte(cacheKey.key), []byte{}, int(limits[i].UnitSeconds))
 				if err != nil {
 					logger.Errorf("Failing to set local cache key: %s", cacheKey.key)
 				}
@@ -294,13 +370,117 @@ func (this *rateLimitCacheImpl) DoLimit(
 		}
 	}
 
-	return responseDescriptorStatuses
+	return responseDescriptorStatuses, nil
 }
 
+func (this *rateLimitCacheImpl) Release(
+	ctx context.Context,
+	request *pb.RateLimitRequest,
+	limits []*config.RateLimit,
+	leaseID string) ([]*pb.RateLimitResponse_DescriptorStatus, error) {
+
+	logger.Debugf("starting cache release")
+
+	deadline, err := contextDeadline(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hitsAddend := max(1, request.HitsAddend)
+
+	// Only concurrency limits hold anything that can be released. Everything else gets an empty key
+	// so that the arrays stay the same size.
+	assert.Assert(len(request.Descriptors) == len(limits))
+	cacheKeys := make([]cacheKey, len(request.Descriptors))
+	now := this.timeSource.UnixNow()
+	for i := 0; i < len(request.Descriptors); i++ {
+		if limits[i] != nil && limits[i].Algorithm == config.Concurrency {
+			cacheKeys[i] = this.generateCacheKey(request.Domain, request.Descriptors[i], limits[i], now)
+			cacheKeys[i].leaseID = leaseID
+		}
+	}
+
+	lookups := make([]cacheLookup, 0, len(cacheKeys))
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.key == "" {
+			continue
+		}
+
+		logger.Debugf("releasing cache key: %s", cacheKey.key)
+		lookups = append(lookups, cacheLookup{index: i, key: cacheKey, limit: limits[i]})
+	}
+
+	counts, err := this.store.release(ctx, deadline, lookups, hitsAddend)
+	if err != nil {
+		return nil, err
+	}
+	inFlights := make([]uint32, len(request.Descriptors))
+	for j, lookup := range lookups {
+		inFlights[lookup.index] = counts[j]
+	}
+
+	responseDescriptorStatuses := make([]*pb.RateLimitResponse_DescriptorStatus,
+		len(request.Descriptors))
+	for i, cacheKey := range cacheKeys {
+		if cacheKey.key == "" {
+			responseDescriptorStatuses[i] =
+				&pb.RateLimitResponse_DescriptorStatus{
+					Code:           pb.RateLimitResponse_OK,
+					CurrentLimit:   nil,
+					LimitRemaining: 0,
+				}
+			continue
+		}
+
+		inFlight := inFlights[i]
+		limitRemaining := uint32(0)
+		if inFlight < limits[i].Limit.RequestsPerUnit {
+			limitRemaining = limits[i].Limit.RequestsPerUnit - inFlight
+		}
+
+		responseDescriptorStatuses[i] =
+			&pb.RateLimitResponse_DescriptorStatus{
+				Code:           pb.RateLimitResponse_OK,
+				CurrentLimit:   limits[i].Limit,
+				LimitRemaining: limitRemaining,
+			}
+	}
+
+	return responseDescriptorStatuses, nil
+}
+
+// Create a cache that stores every limit in one pool, or per second limits in a pool of their own.
+// @param pool supplies the pool of the default backend.
+// @param perSecondPool supplies the pool of per second limits, or nil to store them in the default backend.
+// @return the new cache.
 func NewRateLimitCacheImpl(pool Pool, perSecondPool Pool, timeSource TimeSource, jitterRand *rand.Rand, expirationJitterMaxSeconds int64, localCache *freecache.Cache, scope stats.Scope) RateLimitCache {
+	backends := map[string][]Shard{DefaultBackend: {{Name: DefaultBackend, Pool: pool}}}
+	unitBackends := map[pb.RateLimitResponse_RateLimit_Unit]string{}
+	if perSecondPool != nil {
+		backends[PerSecondBackend] = []Shard{{Name: PerSecondBackend, Pool: perSecondPool}}
+		unitBackends[pb.RateLimitResponse_RateLimit_SECOND] = PerSecondBackend
+	}
+	return NewRoutedRateLimitCacheImpl(
+		backends, unitBackends, timeSource, jitterRand, expirationJitterMaxSeconds, localCache, scope)
+}
+
+// Create a cache that routes limits to named backends, each of which spreads its limits over
+// shards with consistent hashing. A limit is stored in the backend it names, or else in the backend
+// of its unit or the default backend.
+// @param backends supplies the shards of each backend by name, which must include the default backend.
+// @param unitBackends supplies the backend of the limits of each unit that do not name one.
+// @return the new cache.
+func NewRoutedRateLimitCacheImpl(backends map[string][]Shard, unitBackends map[pb.RateLimitResponse_RateLimit_Unit]string, timeSource TimeSource, jitterRand *rand.Rand, expirationJitterMaxSeconds int64, localCache *freecache.Cache, scope stats.Scope) RateLimitCache {
+	return newRateLimitCacheImpl(
+		newRedisStore(backends, unitBackends), timeSource, jitterRand, expirationJitterMaxSeconds, localCache, scope)
+}
+
+// Create a cache that counts hits in a store.
+// @param store supplies the store.
+// @return the new cache.
+func newRateLimitCacheImpl(store limitStore, timeSource TimeSource, jitterRand *rand.Rand, expirationJitterMaxSeconds int64, localCache *freecache.Cache, scope stats.Scope) RateLimitCache {
 	return &rateLimitCacheImpl{
-		pool:                       pool,
-		perSecondPool:              perSecondPool,
+		store:                      store,
 		timeSource:                 timeSource,
 		jitterRand:                 jitterRand,
 		expirationJitterMaxSeconds: expirationJitterMaxSeconds,
@@ -0,0 +1,214 @@
+package redis
+
+import (
+	"sync"
+	"time"
+
+	stats "github.com/lyft/gostats"
+	logger "github.com/sirupsen/logrus"
+)
+
+type circuitBreakerStats struct {
+	state    stats.Gauge
+	tripped  stats.Counter
+	rejected stats.Counter
+}
+
+func newCircuitBreakerStats(scope stats.Scope) circuitBreakerStats {
+	ret := circuitBreakerStats{}
+	ret.state = scope.NewGauge("state")
+	ret.tripped = scope.NewCounter("tripped")
+	ret.rejected = scope.NewCounter("rejected")
+	return ret
+}
+
+type circuitBreakerPoolImpl struct {
+	pool       Pool
+	timeSource TimeSource
+	stats      circuitBreakerStats
+	// Fraction of failed connections in a window that trips the breaker.
+	errorRate float64
+	// Number of connections a window needs before its error rate can trip the breaker.
+	minRequests int
+	// Length in seconds of the windows that errors are counted in.
+	windowSeconds int64
+	// Length in seconds of the cool-down window that the breaker stays open for.
+	coolDownSeconds int64
+	// Number of probe connections that must succeed in a row to close a half open breaker.
+	probes int
+
+	lock  sync.Mutex
+	state CircuitBreakerState
+	// Start of the current error counting window while closed, or of the cool-down window while open.
+	stateStart     int64
+	requests       int
+	failures       int
+	probesInFlight int
+	probeSuccesses int
+}
+
+// A connection obtained through a circuit breaker, which reports whether it failed when it is put back.
+type circuitBreakerConnection struct {
+	Connection
+	probe  bool
+	failed bool
+}
+
+func (this *circuitBreakerConnection) PipeResponse() (Response, error) {
+	response, err := this.Connection.PipeResponse()
+	if err != nil {
+		this.failed = true
+	}
+	return response, err
+}
+
+// Move the breaker into a new state. The lock must be held.
+// @param state supplies the new state.
+// @param now supplies the current unix time in seconds.
+func (this *circuitBreakerPoolImpl) setState(state CircuitBreakerState, now int64) {
+	if state != this.state {
+		logger.Warnf("redis circuit breaker moving from %s to %s", this.state.String(), state.String())
+	}
+	if state == CircuitBreakerOpen {
+		this.stats.tripped.Inc()
+	}
+
+	this.state = state
+	this.stateStart = now
+	this.requests = 0
+	this.failures = 0
+	this.probesInFlight = 0
+	this.probeSuccesses = 0
+	this.stats.state.Set(uint64(state))
+}
+
+// Check whether a connection can be requested from redis.
+// @return whether the connection is allowed and whether it is a half open probe.
+func (this *circuitBreakerPoolImpl) allow() (bool, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := this.timeSource.UnixNow()
+	if this.state == CircuitBreakerOpen && now-this.stateStart >= this.coolDownSeconds {
+		this.setState(CircuitBreakerHalfOpen, now)
+	}
+
+	switch this.state {
+	case CircuitBreakerOpen:
+		return false, false
+	case CircuitBreakerHalfOpen:
+		if this.probesInFlight >= this.probes {
+			return false, false
+		}
+		this.probesInFlight++
+		return true, true
+	}
+	return true, false
+}
+
+// Record the outcome of a connection.
+// @param probe supplies whether the connection was a half open probe.
+// @param failed supplies whether the connection failed.
+func (this *circuitBreakerPoolImpl) record(probe bool, failed bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := this.timeSource.UnixNow()
+	switch this.state {
+	case CircuitBreakerClosed:
+		if now-this.stateStart >= this.windowSeconds {
+			this.setState(CircuitBreakerClosed, now)
+		}
+		this.requests++
+		if failed {
+			this.failures++
+		}
+		if this.requests >= this.minRequests &&
+			float64(this.failures) >= this.errorRate*float64(this.requests) {
+			this.setState(CircuitBreakerOpen, now)
+		}
+	case CircuitBreakerHalfOpen:
+		// Connections obtained before the breaker opened do not say anything about recovery.
+		if !probe {
+			return
+		}
+		if failed {
+			this.setState(CircuitBreakerOpen, now)
+			return
+		}
+		this.probeSuccesses++
+		if this.probeSuccesses >= this.probes {
+			this.setState(CircuitBreakerClosed, now)
+		}
+	}
+}
+
+func (this *circuitBreakerPoolImpl) Get() (Connection, error) {
+	allowed, probe := this.allow()
+	if !allowed {
+		this.stats.rejected.Inc()
+		return nil, RedisError("redis circuit breaker is open")
+	}
+
+	c, err := this.pool.Get()
+	if err != nil {
+		this.record(probe, true)
+		return nil, err
+	}
+	return &circuitBreakerConnection{c, probe, false}, nil
+}
+
+func (this *circuitBreakerPoolImpl) Put(c Connection) {
+	impl := c.(*circuitBreakerConnection)
+	this.pool.Put(impl.Connection)
+	this.record(impl.probe, impl.failed)
+}
+
+func (this *circuitBreakerPoolImpl) State() CircuitBreakerState {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.state
+}
+
+// Seconds in a duration, rounded up so that a non zero duration lasts at least a second.
+func durationSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// Create a circuit breaker around a pool. The breaker trips once the fraction of failed connections
+// in a window reaches the error rate, and then fails every connection request until the cool-down
+// window ends. It then lets probe connections through, and closes once they all succeed or trips
+// again as soon as one fails.
+// @param pool supplies the pool to protect.
+// @param scope supplies the stats scope of the breaker.
+// @param timeSource supplies the source of the current time.
+// @param errorRate supplies the fraction of failed connections, between 0 and 1, that trips the breaker.
+// @param minRequests supplies the number of connections a window needs before the breaker can trip.
+// @param window supplies the length of the windows that errors are counted in.
+// @param coolDown supplies how long the breaker stays open before probing redis.
+// @param probes supplies the number of probe connections let through while half open.
+// @return the new pool.
+func NewCircuitBreakerPoolImpl(
+	pool Pool, scope stats.Scope, timeSource TimeSource, errorRate float64, minRequests int,
+	window time.Duration, coolDown time.Duration, probes int) CircuitBreakerPool {
+
+	if minRequests < 1 {
+		minRequests = 1
+	}
+	if probes < 1 {
+		probes = 1
+	}
+
+	ret := &circuitBreakerPoolImpl{
+		pool:            pool,
+		timeSource:      timeSource,
+		stats:           newCircuitBreakerStats(scope),
+		errorRate:       errorRate,
+		minRequests:     minRequests,
+		windowSeconds:   durationSeconds(window),
+		coolDownSeconds: durationSeconds(coolDown),
+		probes:          probes,
+	}
+	ret.setState(CircuitBreakerClosed, timeSource.UnixNow())
+	return ret
+}
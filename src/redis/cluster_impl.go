@@ -0,0 +1,282 @@
+package redis
+
+import (
+	"strings"
+	"time"
+
+	stats "github.com/lyft/gostats"
+	"github.com/mediocregopher/radix.v2/cluster"
+	"github.com/mediocregopher/radix.v2/redis"
+	logger "github.com/sirupsen/logrus"
+)
+
+// The parts of a radix cluster that the pool uses, which is implemented by *cluster.Cluster.
+type ClusterTopology interface {
+	// @return the address of the node that owns a key.
+	GetAddrForKey(key string) string
+
+	// @return a connection to the node that owns a key, or to any node if the owner cannot be
+	// reached, or an error if no node can be reached.
+	GetForKey(key string) (*redis.Client, error)
+
+	// Put back a connection returned by GetForKey().
+	Put(client *redis.Client)
+
+	// Reload the topology from the cluster.
+	Reset() error
+}
+
+type clusterPoolImpl struct {
+	cluster ClusterTopology
+	// Connects to the node a command is redirected to.
+	dial             func(network, addr string) (*redis.Client, error)
+	stats            poolStats
+	operationTimeout time.Duration
+}
+
+// A pipelined command and the node it was sent to.
+type clusterCommand struct {
+	node *connectionImpl
+	// Error getting a connection to the node, which is returned instead of the command's response.
+	err  error
+	cmd  string
+	args []interface{}
+}
+
+// A connection to a redis cluster, which sends each pipelined command to the node that owns its
+// key. Each node gets its own pipeline, and responses are returned in the order the commands were
+// appended.
+type clusterConnectionImpl struct {
+	pool *clusterPoolImpl
+	// Connections to the nodes used so far, by address.
+	nodes map[string]*connectionImpl
+	// Connections made for redirections to nodes whose connection was busy, which are closed
+	// instead of being put back in a pool.
+	redirects []*connectionImpl
+	commands  []clusterCommand
+	deadline  time.Time
+}
+
+// Find the key a command operates on, which decides the node of the cluster that runs it. Scripts
+// have their keys after the script and the number of keys.
+// @param cmd supplies the command.
+// @param args supplies the command's arguments.
+// @return the key or empty if the command has none.
+func commandKey(cmd string, args []interface{}) string {
+	if (strings.EqualFold(cmd, "EVAL") || strings.EqualFold(cmd, "EVALSHA")) && len(args) > 2 {
+		args = args[2:]
+	}
+	key, err := redis.KeyFromArgs(args...)
+	if err != nil {
+		return ""
+	}
+	return key
+}
+
+// @return whether a response is a redirection to another node of the cluster.
+func isRedirection(resp *redis.Resp) bool {
+	if !resp.IsType(redis.AppErr) {
+		return false
+	}
+	msg := resp.Err.Error()
+	return strings.HasPrefix(msg, "MOVED ") || strings.HasPrefix(msg, "ASK ")
+}
+
+// Parse a redirection, which is of the form "MOVED <slot> <address>" or "ASK <slot> <address>".
+// @param msg supplies the redirection's error message.
+// @return the address of the node to send the command to, whether the redirection is an ASK and
+// whether the message could be parsed.
+func parseRedirection(msg string) (string, bool, bool) {
+	parts := strings.Split(msg, " ")
+	if len(parts) != 3 || parts[0] != "MOVED" && parts[0] != "ASK" || parts[2] == "" {
+		return "", false, false
+	}
+	return parts[2], parts[0] == "ASK", true
+}
+
+func (this *clusterPoolImpl) Get() (Connection, error) {
+	this.stats.connectionActive.Inc()
+	this.stats.connectionTotal.Inc()
+	return &clusterConnectionImpl{pool: this, nodes: map[string]*connectionImpl{}}, nil
+}
+
+func (this *clusterPoolImpl) Put(c Connection) {
+	impl := c.(*clusterConnectionImpl)
+	this.stats.connectionActive.Dec()
+	for _, node := range impl.nodes {
+		if node.pending == 0 {
+			this.cluster.Put(node.client)
+		} else {
+			// See poolImpl.Put().
+			node.client.Close()
+			this.stats.connectionClose.Inc()
+		}
+	}
+	for _, node := range impl.redirects {
+		node.client.Close()
+		this.stats.connectionClose.Inc()
+	}
+}
+
+// Get the connection to the node that owns a key, connecting to it if this is the first command
+// that goes to the node.
+// @param key supplies the key.
+// @return the connection or a RedisError if the node cannot be reached.
+func (this *clusterConnectionImpl) node(key string) (*connectionImpl, error) {
+	addr := this.pool.cluster.GetAddrForKey(key)
+	if node, ok := this.nodes[addr]; ok {
+		return node, nil
+	}
+
+	client, err := this.pool.cluster.GetForKey(key)
+	if err != nil {
+		return nil, RedisError(err.Error())
+	}
+	// The cluster falls back to any node if the owner cannot be reached, and the command is
+	// then redirected.
+	if node, ok := this.nodes[client.Addr]; ok {
+		this.pool.cluster.Put(client)
+		return node, nil
+	}
+
+	node := &connectionImpl{client, 0, this.pool.operationTimeout, this.deadline}
+	this.nodes[client.Addr] = node
+	return node, nil
+}
+
+func (this *clusterConnectionImpl) PipeAppend(cmd string, args ...interface{}) {
+	node, err := this.node(commandKey(cmd, args))
+	if err == nil {
+		node.PipeAppend(cmd, args...)
+	}
+	this.commands = append(this.commands, clusterCommand{node, err, cmd, args})
+}
+
+func (this *clusterConnectionImpl) SetDeadline(deadline time.Time) {
+	this.deadline = deadline
+	for _, node := range this.nodes {
+		node.SetDeadline(deadline)
+	}
+	for _, node := range this.redirects {
+		node.SetDeadline(deadline)
+	}
+}
+
+// Get a connection to a node that a command is redirected to. The call's connection to the node is
+// used if it has no responses left to read, or else a new connection is made.
+// @param addr supplies the address of the node.
+// @return the connection or a RedisError if the node cannot be reached.
+func (this *clusterConnectionImpl) redirectNode(addr string) (*connectionImpl, error) {
+	node, ok := this.nodes[addr]
+	if ok && node.pending == 0 {
+		return node, nil
+	}
+
+	client, err := this.pool.dial("tcp", addr)
+	if err != nil {
+		return nil, RedisError(err.Error())
+	}
+	node = &connectionImpl{client, 0, this.pool.operationTimeout, this.deadline}
+	if ok {
+		this.redirects = append(this.redirects, node)
+	} else {
+		this.nodes[addr] = node
+	}
+	return node, nil
+}
+
+// Send a command again to the node a redirection points to. The command is only redirected once,
+// so a second redirection is returned as an error.
+// @param command supplies the command.
+// @param resp supplies the redirection.
+// @return the command's response from the new node.
+func (this *clusterConnectionImpl) redirect(command clusterCommand, resp *redis.Resp) *redis.Resp {
+	addr, ask, ok := parseRedirection(resp.Err.Error())
+	if !ok {
+		return resp
+	}
+	if !ask {
+		// The slot moved for good, so the topology is reloaded for later calls. This does not hold
+		// up the call, since reloading is not bound by its deadline.
+		go func() {
+			if err := this.pool.cluster.Reset(); err != nil {
+				logger.Warnf("could not reload redis cluster topology: %s", err.Error())
+			}
+		}()
+	}
+
+	node, err := this.redirectNode(addr)
+	if err != nil {
+		return redis.NewResp(err)
+	}
+	// A node only serves a slot that is being imported if the command is preceded by ASKING.
+	if ask {
+		node.PipeAppend("ASKING")
+	}
+	node.PipeAppend(command.cmd, command.args...)
+	if ask {
+		if askingResp := node.pipeResp(); askingResp.Err != nil {
+			node.pipeResp()
+			return askingResp
+		}
+	}
+	return node.pipeResp()
+}
+
+func (this *clusterConnectionImpl) PipeResponse() (Response, error) {
+	command := this.commands[0]
+	this.commands = this.commands[1:]
+	if command.err != nil {
+		return nil, command.err
+	}
+
+	resp := command.node.pipeResp()
+	if isRedirection(resp) {
+		// The slot moved since the cluster's topology was last loaded. The command was not run, so
+		// it is sent again to the new node, with the call's deadline.
+		logger.Debugf("redis cluster redirected %s: %s", command.cmd, resp.Err.Error())
+		resp = this.redirect(command, resp)
+	}
+	return newResponse(resp)
+}
+
+// Create a pool of connections to a redis cluster. The cluster's topology is discovered from the
+// given node, and each node gets its own pool.
+// @param scope supplies the stats scope of the pool.
+// @param useTls supplies whether to connect to the nodes with TLS.
+// @param auth supplies the redis password, or empty for no authentication.
+// @param url supplies the address of any node of the cluster.
+// @param poolSize supplies the size of the pool of each node.
+// @return the pool or a RedisError if the cluster's topology cannot be loaded.
+func NewClusterPoolImpl(scope stats.Scope, useTls bool, auth string, url string, poolSize int, overflowPoolSize int, overflowDrainPeriod time.Duration, maxNewConnPerSecond int, getTimeout time.Duration, operationTimeout time.Duration) (Pool, error) {
+	logger.Warnf("connecting to redis cluster on %s with pool size %d", url, poolSize)
+	dial := newDialFunc(useTls, auth, url)
+	c, err := cluster.NewWithOpts(cluster.Opts{
+		Addr:     url,
+		PoolSize: poolSize,
+		PoolOpts: newPoolOpts(overflowPoolSize, overflowDrainPeriod, maxNewConnPerSecond, getTimeout),
+		Dialer:   dial,
+	})
+	if err != nil {
+		return nil, RedisError(err.Error())
+	}
+
+	return NewClusterPoolImplWithTopology(scope, c, dial, operationTimeout), nil
+}
+
+// Create a pool of connections to a redis cluster whose topology is already known.
+// @param scope supplies the stats scope of the pool.
+// @param topology supplies the cluster's topology, which hands out the connections to its nodes.
+// @param dial supplies the function that connects to the node a command is redirected to.
+// @param operationTimeout supplies the longest time a single operation may wait, or 0 for no limit.
+// @return the pool.
+func NewClusterPoolImplWithTopology(
+	scope stats.Scope, topology ClusterTopology, dial func(network, addr string) (*redis.Client, error),
+	operationTimeout time.Duration) Pool {
+
+	return &clusterPoolImpl{
+		cluster:          topology,
+		dial:             dial,
+		stats:            newPoolStats(scope),
+		operationTimeout: operationTimeout}
+}
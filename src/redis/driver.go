@@ -1,23 +1,65 @@
 package redis
 
-// Errors that may be raised during config parsing.
+import (
+	"time"
+)
+
+// Errors that may be returned while talking to redis.
 type RedisError string
 
 func (e RedisError) Error() string {
 	return string(e)
 }
 
+// Errors returned when redis does not answer before the call's deadline or the operation timeout.
+type RedisTimeoutError string
+
+func (e RedisTimeoutError) Error() string {
+	return string(e)
+}
+
 // Interface for a redis connection pool.
 type Pool interface {
 	// Get a connection from the pool. Call Put() on the connection when done.
-	// Throws RedisError if a connection can not be obtained.
-	Get() Connection
+	// @return the connection or a RedisError if a connection can not be obtained.
+	Get() (Connection, error)
 
 	// Put a connection back into the pool.
 	// @param c supplies the connection to put back.
 	Put(c Connection)
 }
 
+// State of a circuit breaker.
+type CircuitBreakerState int
+
+const (
+	// Redis is used as usual while the breaker counts errors.
+	CircuitBreakerClosed CircuitBreakerState = iota
+	// Every connection request fails immediately until the cool-down window ends.
+	CircuitBreakerOpen
+	// A limited number of probe connections are let through to check if redis has recovered.
+	CircuitBreakerHalfOpen
+)
+
+var circuitBreakerStateNames = map[CircuitBreakerState]string{
+	CircuitBreakerClosed:   "closed",
+	CircuitBreakerOpen:     "open",
+	CircuitBreakerHalfOpen: "half_open",
+}
+
+func (s CircuitBreakerState) String() string {
+	return circuitBreakerStateNames[s]
+}
+
+// Interface for a pool that stops using redis for a while after too many errors, so that calls
+// fail fast instead of waiting for redis while it is unavailable.
+type CircuitBreakerPool interface {
+	Pool
+
+	// @return the current state of the circuit breaker.
+	State() CircuitBreakerState
+}
+
 // Interface for a redis connection.
 type Connection interface {
 	// Append a command onto the pipeline queue.
@@ -25,15 +67,20 @@ type Connection interface {
 	// @param args supplies the additional arguments.
 	PipeAppend(command string, args ...interface{})
 
+	// Limit how long the following pipeline operations may wait for redis. Each operation may also
+	// wait no longer than the pool's operation timeout.
+	// @param deadline supplies the time by which each operation must complete.
+	SetDeadline(deadline time.Time)
+
 	// Execute the pipeline queue and wait for a response.
-	// @return a response object.
-	// Throws a RedisError if there was an error fetching the response.
-	PipeResponse() Response
+	// @return a response object, a RedisTimeoutError if redis did not answer in time or a RedisError
+	// if there was any other error fetching the response.
+	PipeResponse() (Response, error)
 }
 
 // Interface for a redis response.
 type Response interface {
-	// @return the response as an integer.
-	// Throws a RedisError if the response is not convertable to an integer.
-	Int() int64
+	// @return the response as an integer or a RedisError if the response is not convertable to an
+	// integer. A nil response (e.g. GET of a missing key) is returned as 0.
+	Int() (int64, error)
 }
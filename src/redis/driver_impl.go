@@ -2,6 +2,7 @@ package redis
 
 import (
 	"crypto/tls"
+	"fmt"
 	"net"
 
 	"time"
@@ -30,29 +31,35 @@ func newPoolStats(scope stats.Scope) poolStats {
 type poolImpl struct {
 	pool  *pool.Pool
 	stats poolStats
+	// Longest time a single operation may wait for redis, or 0 for no limit.
+	operationTimeout time.Duration
 }
 
 type connectionImpl struct {
-	client  *redis.Client
-	pending uint
+	client           *redis.Client
+	pending          uint
+	operationTimeout time.Duration
+	// Time by which each operation must complete, or the zero time for no deadline.
+	deadline time.Time
 }
 
+// radix only sets a deadline on a client's connection when the client has a timeout, so a client
+// that ever had one would keep its last deadline without one. Clients that should not time out get
+// this timeout instead, which a healthy redis never reaches.
+const unlimitedTimeout = 24 * time.Hour
+
 type responseImpl struct {
 	response *redis.Resp
 }
 
-func checkError(err error) {
+func (this *poolImpl) Get() (Connection, error) {
+	client, err := this.pool.Get()
 	if err != nil {
-		panic(RedisError(err.Error()))
+		return nil, RedisError(err.Error())
 	}
-}
-
-func (this *poolImpl) Get() Connection {
-	client, err := this.pool.Get()
-	checkError(err)
 	this.stats.connectionActive.Inc()
 	this.stats.connectionTotal.Inc()
-	return &connectionImpl{client, 0}
+	return &connectionImpl{client, 0, this.operationTimeout, time.Time{}}, nil
 }
 
 func (this *poolImpl) Put(c Connection) {
@@ -69,15 +76,18 @@ func (this *poolImpl) Put(c Connection) {
 	}
 }
 
-func NewPoolImpl(scope stats.Scope, useTls bool, auth string, url string, poolSize int, overflowPoolSize int, overflowDrainPeriod time.Duration, maxNewConnPerSecond int, getTimeout time.Duration) Pool {
-	logger.Warnf("connecting to redis on %s with pool size %d", url, poolSize)
-	df := func(network, addr string) (*redis.Client, error) {
+// Create the function that connects and authenticates new redis clients.
+// @param useTls supplies whether to connect with TLS.
+// @param auth supplies the redis password, or empty for no authentication.
+// @param url supplies the redis url, which is only used for logging.
+func newDialFunc(useTls bool, auth string, url string) func(network, addr string) (*redis.Client, error) {
+	return func(network, addr string) (*redis.Client, error) {
 		var conn net.Conn
 		var err error
 		if useTls {
-			conn, err = tls.Dial("tcp", addr, &tls.Config{})
+			conn, err = tls.Dial(network, addr, &tls.Config{})
 		} else {
-			conn, err = net.Dial("tcp", addr)
+			conn, err = net.Dial(network, addr)
 		}
 		if err != nil {
 			return nil, err
@@ -96,7 +106,10 @@ func NewPoolImpl(scope stats.Scope, useTls bool, auth string, url string, poolSi
 		}
 		return client, nil
 	}
+}
 
+// Create the options of a radix pool.
+func newPoolOpts(overflowPoolSize int, overflowDrainPeriod time.Duration, maxNewConnPerSecond int, getTimeout time.Duration) []pool.Opt {
 	var opts []pool.Opt
 	if overflowPoolSize > 0 {
 		opts = append(opts, pool.OnFullBuffer(overflowPoolSize, overflowDrainPeriod))
@@ -107,13 +120,41 @@ func NewPoolImpl(scope stats.Scope, useTls bool, auth string, url string, poolSi
 	if maxNewConnPerSecond > 0 {
 		opts = append(opts, pool.CreateLimit(0, time.Second/time.Duration(maxNewConnPerSecond)))
 	}
+	return opts
+}
+
+// Create a pool of connections to a single redis.
+// @param scope supplies the stats scope of the pool.
+// @param socketType supplies the socket type, tcp or unix.
+// @param useTls supplies whether to connect with TLS, which is only supported over tcp.
+// @param auth supplies the redis password, or empty for no authentication.
+// @param url supplies the address of redis, or the path of its socket for unix sockets.
+// @param poolSize supplies the size of the pool.
+// @return the pool or a RedisError if the settings are invalid or redis cannot be reached.
+func NewPoolImpl(scope stats.Scope, socketType string, useTls bool, auth string, url string, poolSize int, overflowPoolSize int, overflowDrainPeriod time.Duration, maxNewConnPerSecond int, getTimeout time.Duration, operationTimeout time.Duration) (Pool, error) {
+	switch socketType {
+	case "tcp":
+	case "unix":
+		if useTls {
+			return nil, RedisError("redis TLS is not supported over unix sockets")
+		}
+	default:
+		return nil, RedisError(fmt.Sprintf("unknown redis socket type '%s'", socketType))
+	}
+
+	logger.Warnf("connecting to redis on %s %s with pool size %d", socketType, url, poolSize)
+	df := newDialFunc(useTls, auth, url)
+	opts := newPoolOpts(overflowPoolSize, overflowDrainPeriod, maxNewConnPerSecond, getTimeout)
 
-	pool, err := pool.NewCustom("tcp", url, poolSize, df, opts...)
-	checkError(err)
+	pool, err := pool.NewCustom(socketType, url, poolSize, df, opts...)
+	if err != nil {
+		return nil, RedisError(err.Error())
+	}
 
 	return &poolImpl{
-		pool:  pool,
-		stats: newPoolStats(scope)}
+		pool:             pool,
+		stats:            newPoolStats(scope),
+		operationTimeout: operationTimeout}, nil
 }
 
 func (this *connectionImpl) PipeAppend(cmd string, args ...interface{}) {
@@ -121,17 +162,67 @@ func (this *connectionImpl) PipeAppend(cmd string, args ...interface{}) {
 	this.pending++
 }
 
-func (this *connectionImpl) PipeResponse() Response {
+func (this *connectionImpl) SetDeadline(deadline time.Time) {
+	this.deadline = deadline
+}
+
+// Set how long the next operation on the client may wait for redis, which is the operation
+// timeout or the time left until the deadline, whichever is shorter.
+func (this *connectionImpl) applyTimeout() {
+	timeout := this.operationTimeout
+	if !this.deadline.IsZero() {
+		remaining := time.Until(this.deadline)
+		if remaining <= 0 {
+			// The deadline already passed, so the operation should time out right away.
+			remaining = time.Nanosecond
+		}
+		if timeout == 0 || remaining < timeout {
+			timeout = remaining
+		}
+	}
+
+	if timeout == 0 && this.client.ReadTimeout != 0 {
+		timeout = unlimitedTimeout
+	}
+	this.client.ReadTimeout = timeout
+	this.client.WriteTimeout = timeout
+}
+
+// Read the next pipelined response from redis.
+// @return the raw response, which holds any error.
+func (this *connectionImpl) pipeResp() *redis.Resp {
 	assert.Assert(this.pending > 0)
 	this.pending--
 
-	resp := this.client.PipeResp()
-	checkError(resp.Err)
-	return &responseImpl{resp}
+	this.applyTimeout()
+	return this.client.PipeResp()
+}
+
+func (this *connectionImpl) PipeResponse() (Response, error) {
+	return newResponse(this.pipeResp())
+}
+
+// Wrap a raw redis response.
+// @param resp supplies the response.
+// @return the response, a RedisTimeoutError if redis did not answer in time or a RedisError if the
+// response holds any other error.
+func newResponse(resp *redis.Resp) (Response, error) {
+	if redis.IsTimeout(resp) {
+		return nil, RedisTimeoutError(resp.Err.Error())
+	}
+	if resp.Err != nil {
+		return nil, RedisError(resp.Err.Error())
+	}
+	return &responseImpl{resp}, nil
 }
 
-func (this *responseImpl) Int() int64 {
+func (this *responseImpl) Int() (int64, error) {
+	if this.response.IsType(redis.Nil) {
+		return 0, nil
+	}
 	i, err := this.response.Int64()
-	checkError(err)
-	return i
+	if err != nil {
+		return 0, RedisError(err.Error())
+	}
+	return i, nil
 }
@@ -0,0 +1,227 @@
+package redis
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/coocood/freecache"
+	stats "github.com/lyft/gostats"
+	"github.com/lyft/ratelimit/src/config"
+	"golang.org/x/net/context"
+)
+
+// Longest relative expiration memcached accepts. Longer expirations are taken as a unix time.
+const memcachedMaxRelativeExpiration = 60 * 60 * 24 * 30
+
+// Longest key memcached accepts.
+const memcachedMaxKeyLength = 250
+
+// Algorithms that memcached supports. The others need scripts.
+var MemcachedAlgorithms = []config.RateLimitAlgorithm{config.FixedWindow, config.SlidingWindow}
+
+// A store that counts hits in memcached. Each counter is created with add the first time it is hit
+// in a window and incremented with incr after that. memcached has no scripting, so only the fixed
+// and sliding window algorithms are supported.
+type memcachedStore struct {
+	client     MemcachedClient
+	timeSource TimeSource
+}
+
+// Turn an error from memcached into an error that is handled like any other cache error. Errors
+// are reported as RedisErrors so that the service counts them and applies the failure mode.
+// @param err supplies the error, which may be nil.
+// @return a RedisTimeoutError if memcached did not answer in time, a RedisError for any other
+// error, or nil if there was no error.
+func memcachedError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*memcache.ConnectTimeoutError); ok {
+		return RedisTimeoutError(err.Error())
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return RedisTimeoutError(err.Error())
+	}
+	return RedisError(err.Error())
+}
+
+// Make a cache key usable in memcached, which does not accept long keys or keys with whitespace or
+// control characters. Such keys are replaced by their md5 hash.
+// @param key supplies the cache key.
+// @return the memcached key.
+func memcachedKey(key string) string {
+	legal := len(key) <= memcachedMaxKeyLength
+	for i := 0; legal && i < len(key); i++ {
+		legal = key[i] > ' ' && key[i] != 0x7f
+	}
+	if legal {
+		return key
+	}
+
+	digest := md5.Sum([]byte(key))
+	return "md5_" + hex.EncodeToString(digest[:])
+}
+
+// Convert an expiration in seconds into the form memcached expects.
+// @param expirationSeconds supplies the expiration.
+// @return the expiration, as a unix time if it is too long to be relative.
+func (this *memcachedStore) expiration(expirationSeconds int64) int32 {
+	if expirationSeconds > memcachedMaxRelativeExpiration {
+		return int32(this.timeSource.UnixNow() + expirationSeconds)
+	}
+	return int32(expirationSeconds)
+}
+
+// Add hits to a counter, creating it if it does not exist yet.
+// @param key supplies the counter's key.
+// @param delta supplies the number of hits to add.
+// @param expirationSeconds supplies the expiration of the counter if it is created.
+// @return the counter's value including the hits, or an error.
+func (this *memcachedStore) increment(key string, delta uint32, expirationSeconds int64) (uint64, error) {
+	value, err := this.client.Increment(key, uint64(delta))
+	if err != memcache.ErrCacheMiss {
+		return value, memcachedError(err)
+	}
+
+	// The first hit of a window creates the counter. If another call created it in the meantime, its
+	// counter is incremented instead.
+	err = this.client.Add(&memcache.Item{
+		Key:        key,
+		Value:      []byte(strconv.FormatUint(uint64(delta), 10)),
+		Expiration: this.expiration(expirationSeconds),
+	})
+	if err == nil {
+		return uint64(delta), nil
+	}
+	if err != memcache.ErrNotStored {
+		return 0, memcachedError(err)
+	}
+	value, err = this.client.Increment(key, uint64(delta))
+	return value, memcachedError(err)
+}
+
+// Read a counter.
+// @param key supplies the counter's key.
+// @return the counter's value, 0 if it does not exist, or an error.
+func (this *memcachedStore) get(key string) (int64, error) {
+	item, err := this.client.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, memcachedError(err)
+	}
+
+	// memcached may pad a counter with spaces when an increment makes it shorter.
+	value, err := strconv.ParseInt(strings.TrimSpace(string(item.Value)), 10, 64)
+	if err != nil {
+		return 0, RedisError(err.Error())
+	}
+	return value, nil
+}
+
+// Count the hits of a call against a single limit.
+// @param lookup supplies the limit's lookup.
+// @param hitsAddend supplies the number of hits to add.
+// @return the number of hits counted against the limit, including this call's hits, or an error.
+func (this *memcachedStore) count(lookup cacheLookup, hitsAddend uint32) (uint32, error) {
+	current, err := this.increment(memcachedKey(lookup.key.key), hitsAddend, lookup.expirationSeconds)
+	if err != nil {
+		return 0, err
+	}
+	if lookup.limit.Algorithm != config.SlidingWindow {
+		return uint32(current), nil
+	}
+
+	previous, err := this.get(memcachedKey(lookup.key.previousKey))
+	if err != nil {
+		return 0, err
+	}
+	return uint32(int64(current) + int64(math.Floor(float64(previous)*lookup.key.previousWeight))), nil
+}
+
+// memcached operations cannot have a deadline of their own, so the call stops waiting for them when
+// its context is done and they finish in the background within the client's timeout.
+func (this *memcachedStore) doLimit(
+	ctx context.Context, deadline time.Time, lookups []cacheLookup, hitsAddend uint32) ([]uint32, error) {
+
+	// Nothing is counted if any limit cannot be, just like when redis fails.
+	for _, lookup := range lookups {
+		if lookup.limit.Algorithm != config.FixedWindow && lookup.limit.Algorithm != config.SlidingWindow {
+			return nil, RedisError(fmt.Sprintf(
+				"rate limit algorithm '%s' is not supported by memcached", lookup.limit.Algorithm.String()))
+		}
+	}
+
+	if ctx == nil || ctx.Done() == nil {
+		return this.countAll(lookups, hitsAddend)
+	}
+
+	var counts []uint32
+	var err error
+	done := make(chan struct{})
+	go func() {
+		counts, err = this.countAll(lookups, hitsAddend)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return counts, err
+	case <-ctx.Done():
+		return nil, contextError(ctx.Err(), "while calling memcached")
+	}
+}
+
+// Count the hits of a call against every limit.
+// @param lookups supplies the limits' lookups.
+// @param hitsAddend supplies the number of hits to add.
+// @return the number of hits counted against each limit, including this call's hits, or an error.
+func (this *memcachedStore) countAll(lookups []cacheLookup, hitsAddend uint32) ([]uint32, error) {
+	// Every limit needs its own round trips, so the limits are counted concurrently.
+	counts := make([]uint32, len(lookups))
+	errs := make([]error, len(lookups))
+	var wg sync.WaitGroup
+	for j := range lookups {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			counts[j], errs[j] = this.count(lookups[j], hitsAddend)
+		}(j)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+func (this *memcachedStore) release(
+	ctx context.Context, deadline time.Time, lookups []cacheLookup, hitsAddend uint32) ([]uint32, error) {
+
+	if len(lookups) > 0 {
+		return nil, RedisError("concurrency limits are not supported by memcached")
+	}
+	return []uint32{}, nil
+}
+
+// Create a cache that counts hits in memcached. Keys, the local cache and stats work just like with
+// redis, but only the MemcachedAlgorithms are supported. Calls with other limits fail with a
+// RedisError.
+// @param client supplies the memcached client.
+// @return the new cache.
+func NewMemcachedRateLimitCacheImpl(client MemcachedClient, timeSource TimeSource, jitterRand *rand.Rand, expirationJitterMaxSeconds int64, localCache *freecache.Cache, scope stats.Scope) RateLimitCache {
+	return newRateLimitCacheImpl(
+		&memcachedStore{client, timeSource}, timeSource, jitterRand, expirationJitterMaxSeconds, localCache, scope)
+}
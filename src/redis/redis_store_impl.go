@@ -0,0 +1,254 @@
+package redis
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
+	"github.com/lyft/ratelimit/src/assert"
+	"golang.org/x/net/context"
+)
+
+// A store that counts hits in redis. Limits are routed to named backends, each of which spreads
+// its limits over shards.
+type redisStore struct {
+	// Rings of the shards that each backend spreads its limits over, by backend name.
+	backends map[string]*shardRing
+	// Backend of the limits of each unit that do not name one. Limits of other units use the
+	// default backend.
+	unitBackends map[pb.RateLimitResponse_RateLimit_Unit]string
+}
+
+// The pipeline of a connection used by a single call.
+type pipeline struct {
+	conn Connection
+	// Indexes of the lookups whose commands were appended, in order.
+	indexes []int
+}
+
+// The connections used by a single call, with one pipeline for each pool.
+type pipelines struct {
+	ctx      context.Context
+	deadline time.Time
+	pools    []Pool
+	byPool   map[Pool]*pipeline
+	// Closed once a fetch that the call gave up on completes, or nil if the call did not give up.
+	abandoned chan struct{}
+}
+
+func newPipelines(ctx context.Context, deadline time.Time) *pipelines {
+	return &pipelines{ctx: ctx, deadline: deadline, byPool: map[Pool]*pipeline{}}
+}
+
+// Get the pipeline of a pool, getting a connection from the pool if this is its first command.
+// @param pool supplies the pool.
+// @return the pipeline or a RedisError if a connection can not be obtained.
+func (this *pipelines) get(pool Pool) (*pipeline, error) {
+	if p, ok := this.byPool[pool]; ok {
+		return p, nil
+	}
+
+	conn, err := pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(this.deadline)
+	p := &pipeline{conn: conn}
+	this.pools = append(this.pools, pool)
+	this.byPool[pool] = p
+	return p, nil
+}
+
+// Fetch the responses of every pipeline. The pipelines of different pools are fetched concurrently,
+// so a call waits for its slowest redis rather than for all of them in turn. The call stops waiting
+// as soon as its context is done, and the responses are then read in the background.
+// @param fetch supplies the function that fetches the responses of a lookup from a connection.
+// @return the first error of the pipelines, in the order they were created, or the context's error
+// if the call stopped waiting.
+func (this *pipelines) fetch(fetch func(conn Connection, i int) error) error {
+	if this.ctx == nil || this.ctx.Done() == nil {
+		return this.fetchAll(fetch)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- this.fetchAll(fetch)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-this.ctx.Done():
+		// The connections are busy until the responses arrive, which is bound by the deadline and the
+		// operation timeout, so they are only put back then.
+		this.abandoned = make(chan struct{})
+		go func() {
+			<-result
+			close(this.abandoned)
+		}()
+		return contextError(this.ctx.Err(), "while calling redis")
+	}
+}
+
+// Fetch the responses of every pipeline, see fetch().
+func (this *pipelines) fetchAll(fetch func(conn Connection, i int) error) error {
+	errs := make([]error, len(this.pools))
+	fetchPipeline := func(n int) {
+		p := this.byPool[this.pools[n]]
+		for _, i := range p.indexes {
+			if errs[n] = fetch(p.conn, i); errs[n] != nil {
+				return
+			}
+		}
+	}
+
+	if len(this.pools) == 1 {
+		fetchPipeline(0)
+	} else {
+		var wg sync.WaitGroup
+		for n := range this.pools {
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				fetchPipeline(n)
+			}(n)
+		}
+		wg.Wait()
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put every connection back into its pool, once any fetch the call gave up on completes.
+func (this *pipelines) put() {
+	if this.abandoned != nil {
+		go func() {
+			<-this.abandoned
+			this.putAll()
+		}()
+		return
+	}
+	this.putAll()
+}
+
+func (this *pipelines) putAll() {
+	for _, pool := range this.pools {
+		pool.Put(this.byPool[pool].conn)
+	}
+}
+
+// Find the pool that stores a limit.
+// @param lookup supplies the limit's lookup.
+// @return the pool of the key's shard in the limit's backend, or a RedisError if the backend does
+// not exist. The backend is the one named by the limit, or else the backend of its unit or the
+// default backend.
+func (this *redisStore) poolFor(lookup cacheLookup) (Pool, error) {
+	backend := lookup.limit.Backend
+	if backend == "" {
+		var ok bool
+		if backend, ok = this.unitBackends[lookup.limit.Limit.Unit]; !ok {
+			backend = DefaultBackend
+		}
+	}
+
+	shards, ok := this.backends[backend]
+	if !ok {
+		return nil, RedisError(fmt.Sprintf("unknown redis backend '%s'", backend))
+	}
+	return shards.pool(lookup.key.shardKey), nil
+}
+
+// Append the commands of every lookup to the pipeline of its pool.
+// @param pipelines supplies the pipelines of the call.
+// @param lookups supplies the lookups.
+// @param appendLookup supplies the function that appends the commands of a lookup to a connection.
+// @return a RedisError if a pool could not be found or a connection could not be obtained.
+func (this *redisStore) appendLookups(
+	pipelines *pipelines, lookups []cacheLookup, appendLookup func(conn Connection, lookup cacheLookup)) error {
+
+	for j, lookup := range lookups {
+		pool, err := this.poolFor(lookup)
+		if err != nil {
+			return err
+		}
+		p, err := pipelines.get(pool)
+		if err != nil {
+			return err
+		}
+		appendLookup(p.conn, lookup)
+		p.indexes = append(p.indexes, j)
+	}
+	return nil
+}
+
+func (this *redisStore) doLimit(
+	ctx context.Context, deadline time.Time, lookups []cacheLookup, hitsAddend uint32) ([]uint32, error) {
+
+	pipelines := newPipelines(ctx, deadline)
+	defer pipelines.put()
+
+	err := this.appendLookups(pipelines, lookups, func(conn Connection, lookup cacheLookup) {
+		limitAlgorithms[lookup.limit.Algorithm].pipelineAppend(
+			conn, lookup.key, lookup.limit, hitsAddend, lookup.expirationSeconds)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]uint32, len(lookups))
+	err = pipelines.fetch(func(conn Connection, j int) error {
+		var err error
+		counts[j], err = limitAlgorithms[lookups[j].limit.Algorithm].pipelineFetch(conn, lookups[j].key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+func (this *redisStore) release(
+	ctx context.Context, deadline time.Time, lookups []cacheLookup, hitsAddend uint32) ([]uint32, error) {
+
+	pipelines := newPipelines(ctx, deadline)
+	defer pipelines.put()
+	algorithm := concurrencyAlgorithm{}
+
+	err := this.appendLookups(pipelines, lookups, func(conn Connection, lookup cacheLookup) {
+		algorithm.releaseAppend(conn, lookup.key, hitsAddend)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]uint32, len(lookups))
+	err = pipelines.fetch(func(conn Connection, j int) error {
+		var err error
+		counts[j], err = algorithm.releaseFetch(conn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// Create a redis store.
+// @param backends supplies the shards of each backend by name, which must include the default backend.
+// @param unitBackends supplies the backend of the limits of each unit that do not name one.
+// @return the new store.
+func newRedisStore(
+	backends map[string][]Shard, unitBackends map[pb.RateLimitResponse_RateLimit_Unit]string) *redisStore {
+
+	assert.Assert(len(backends[DefaultBackend]) > 0)
+	rings := make(map[string]*shardRing, len(backends))
+	for name, shards := range backends {
+		rings[name] = newShardRing(shards)
+	}
+	return &redisStore{backends: rings, unitBackends: unitBackends}
+}
@@ -0,0 +1,247 @@
+package redis
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	stats "github.com/lyft/gostats"
+	"github.com/mediocregopher/radix.v2/pool"
+	"github.com/mediocregopher/radix.v2/pubsub"
+	"github.com/mediocregopher/radix.v2/redis"
+	logger "github.com/sirupsen/logrus"
+)
+
+// Timeout of the connections to the sentinels. The connection that watches for failovers is also
+// pinged this often.
+const sentinelTimeout = 5 * time.Second
+
+// How long to wait before trying the sentinels again when none of them can be reached, or when the
+// one reached does not accept the subscription to failovers.
+const sentinelRetryPeriod = time.Second
+
+type sentinelPoolImpl struct {
+	masterName string
+	sentinels  []string
+	stats      poolStats
+	failover   stats.Counter
+	// Creates a pool of connections to the master at the given address.
+	newPool func(addr string) (*pool.Pool, error)
+
+	operationTimeout time.Duration
+
+	lock sync.RWMutex
+	pool *poolImpl
+	addr string
+	// Address of a new master whose pool could not be created yet, or empty if there is none.
+	pendingAddr string
+}
+
+// A connection to the master, which remembers the pool it came from in case the master changes
+// before it is put back.
+type sentinelConnectionImpl struct {
+	*connectionImpl
+	pool *poolImpl
+}
+
+// Connect to the first sentinel that can be reached.
+// @return the connection or an error if no sentinel can be reached.
+func (this *sentinelPoolImpl) dialSentinel() (*redis.Client, error) {
+	var err error
+	for _, sentinel := range this.sentinels {
+		var client *redis.Client
+		client, err = redis.DialTimeout("tcp", sentinel, sentinelTimeout)
+		if err == nil {
+			return client, nil
+		}
+		logger.Warnf("could not connect to redis sentinel %s: %s", sentinel, err.Error())
+	}
+	return nil, err
+}
+
+// Ask a sentinel for the address of the current master.
+// @param client supplies the connection to the sentinel.
+// @return the master's address or an error if the sentinel does not know the master.
+func (this *sentinelPoolImpl) masterAddr(client *redis.Client) (string, error) {
+	l, err := client.Cmd("SENTINEL", "get-master-addr-by-name", this.masterName).List()
+	if err != nil {
+		return "", err
+	}
+	if len(l) != 2 {
+		return "", errors.New("unknown redis master " + this.masterName)
+	}
+	return net.JoinHostPort(l[0], l[1]), nil
+}
+
+// Parse a +switch-master message, which is "<master name> <old ip> <old port> <new ip> <new port>".
+// @param masterName supplies the name of the master being followed.
+// @param message supplies the message.
+// @return the address of the new master and whether the message is a failover of the master.
+func parseSwitchMaster(masterName string, message string) (string, bool) {
+	fields := strings.Fields(message)
+	if len(fields) != 5 || fields[0] != masterName {
+		return "", false
+	}
+	return net.JoinHostPort(fields[3], fields[4]), true
+}
+
+// Move to a new master, replacing the pool of connections to the old one. If the new pool cannot be
+// created, the old one is kept until a later attempt succeeds. This is only called by watch(), so
+// there is never more than one switch at a time.
+// @param addr supplies the address of the master.
+func (this *sentinelPoolImpl) switchMaster(addr string) {
+	this.lock.RLock()
+	currentAddr := this.addr
+	this.lock.RUnlock()
+
+	var p *pool.Pool
+	var err error
+	if addr != currentAddr {
+		logger.Warnf("redis master %s moving from %s to %s", this.masterName, currentAddr, addr)
+		// Connecting can take a while, so it is done without blocking calls to the old master.
+		p, err = this.newPool(addr)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if err != nil {
+		logger.Errorf("could not connect to redis master %s on %s: %s", this.masterName, addr, err.Error())
+		this.pendingAddr = addr
+		return
+	}
+	this.pendingAddr = ""
+	if p == nil {
+		return
+	}
+
+	// Connections that are still in use are closed when they are put back.
+	this.pool.pool.Empty()
+	this.pool = &poolImpl{p, this.stats, this.operationTimeout}
+	this.addr = addr
+	this.failover.Inc()
+}
+
+// Follow failovers of the master announced by the sentinels, moving to another sentinel whenever
+// the one being watched cannot be reached.
+func (this *sentinelPoolImpl) watch() {
+	for {
+		client, err := this.dialSentinel()
+		if err != nil {
+			time.Sleep(sentinelRetryPeriod)
+			continue
+		}
+
+		// The master may have changed while no sentinel was being watched.
+		addr, err := this.masterAddr(client)
+		if err == nil {
+			this.switchMaster(addr)
+		} else {
+			logger.Errorf("could not get redis master %s from sentinel: %s", this.masterName, err.Error())
+		}
+
+		sub := pubsub.NewSubClient(client)
+		r := sub.Subscribe("+switch-master")
+		if r.Err != nil {
+			// The sentinel can be reached but does not accept the subscription, so it is not asked
+			// again right away.
+			logger.Warnf("could not subscribe to redis sentinel failovers: %s", r.Err.Error())
+			client.Close()
+			time.Sleep(sentinelRetryPeriod)
+			continue
+		}
+		for r.Err == nil {
+			r = sub.Receive()
+			if r.Timeout() {
+				this.lock.RLock()
+				pendingAddr := this.pendingAddr
+				this.lock.RUnlock()
+				if pendingAddr != "" {
+					this.switchMaster(pendingAddr)
+				}
+				r = sub.Ping()
+				continue
+			}
+			if r.Err != nil {
+				break
+			}
+			if r.Type != pubsub.Message {
+				continue
+			}
+
+			if addr, ok := parseSwitchMaster(this.masterName, r.Message); ok {
+				this.switchMaster(addr)
+			}
+		}
+
+		logger.Warnf("lost connection to redis sentinel: %s", r.Err.Error())
+		client.Close()
+	}
+}
+
+func (this *sentinelPoolImpl) Get() (Connection, error) {
+	this.lock.RLock()
+	p := this.pool
+	this.lock.RUnlock()
+
+	c, err := p.Get()
+	if err != nil {
+		return nil, err
+	}
+	return &sentinelConnectionImpl{c.(*connectionImpl), p}, nil
+}
+
+func (this *sentinelPoolImpl) Put(c Connection) {
+	impl := c.(*sentinelConnectionImpl)
+	impl.pool.Put(impl.connectionImpl)
+}
+
+// Create a pool of connections to a redis master found through sentinels. The pool moves to the new
+// master whenever the sentinels announce a failover.
+// @param scope supplies the stats scope of the pool.
+// @param useTls supplies whether to connect to the master with TLS. Sentinels are always contacted
+// without TLS or authentication.
+// @param auth supplies the master's password, or empty for no authentication.
+// @param url supplies the name of the master followed by the addresses of the sentinels, separated by commas.
+// @param poolSize supplies the size of the pool.
+// @return the pool or a RedisError if the master cannot be found or reached.
+func NewSentinelPoolImpl(scope stats.Scope, useTls bool, auth string, url string, poolSize int, overflowPoolSize int, overflowDrainPeriod time.Duration, maxNewConnPerSecond int, getTimeout time.Duration, operationTimeout time.Duration) (Pool, error) {
+	parts := strings.Split(url, ",")
+	if len(parts) < 2 {
+		return nil, RedisError("redis sentinel url must be the master name followed by the sentinel addresses")
+	}
+
+	ret := &sentinelPoolImpl{
+		masterName:       parts[0],
+		sentinels:        parts[1:],
+		stats:            newPoolStats(scope),
+		failover:         scope.NewCounter("failover"),
+		operationTimeout: operationTimeout,
+	}
+	df := newDialFunc(useTls, auth, url)
+	opts := newPoolOpts(overflowPoolSize, overflowDrainPeriod, maxNewConnPerSecond, getTimeout)
+	ret.newPool = func(addr string) (*pool.Pool, error) {
+		return pool.NewCustom("tcp", addr, poolSize, df, opts...)
+	}
+
+	client, err := ret.dialSentinel()
+	if err != nil {
+		return nil, RedisError(err.Error())
+	}
+	ret.addr, err = ret.masterAddr(client)
+	client.Close()
+	if err != nil {
+		return nil, RedisError(err.Error())
+	}
+
+	logger.Warnf("connecting to redis master %s on %s with pool size %d", ret.masterName, ret.addr, poolSize)
+	p, err := ret.newPool(ret.addr)
+	if err != nil {
+		return nil, RedisError(err.Error())
+	}
+	ret.pool = &poolImpl{p, ret.stats, operationTimeout}
+
+	go ret.watch()
+	return ret, nil
+}
@@ -0,0 +1,77 @@
+package redis
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// Number of md5 digests hashed for each shard. Each digest gives 4 points on the ring, as in ketama.
+const shardDigests = 40
+
+type shardPoint struct {
+	hash uint32
+	name string
+	pool Pool
+}
+
+// A consistent hash ring that spreads cache keys over shards. Each shard owns the keys that hash
+// between its points and the points before them, so adding or removing a shard only moves the keys
+// of the shard that changed.
+type shardRing struct {
+	points []shardPoint
+}
+
+// Hash a string to a point on the ring.
+func shardHash(s string) uint32 {
+	digest := md5.Sum([]byte(s))
+	return binary.LittleEndian.Uint32(digest[:4])
+}
+
+// Find the pool of the shard that owns a key.
+// @param key supplies the key.
+// @return the shard's pool.
+func (this *shardRing) pool(key string) Pool {
+	if len(this.points) == 1 {
+		return this.points[0].pool
+	}
+
+	hash := shardHash(key)
+	i := sort.Search(len(this.points), func(i int) bool { return this.points[i].hash >= hash })
+	if i == len(this.points) {
+		i = 0
+	}
+	return this.points[i].pool
+}
+
+// Create a ring for a set of shards. The points of a shard only depend on its name, so a shard can
+// move to another redis without losing its keys.
+// @param shards supplies the shards.
+// @return the new ring.
+func newShardRing(shards []Shard) *shardRing {
+	ret := &shardRing{}
+	if len(shards) == 1 {
+		ret.points = []shardPoint{{0, shards[0].Name, shards[0].Pool}}
+		return ret
+	}
+
+	for _, shard := range shards {
+		for i := 0; i < shardDigests; i++ {
+			digest := md5.Sum([]byte(shard.Name + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				hash := binary.LittleEndian.Uint32(digest[j*4:])
+				ret.points = append(ret.points, shardPoint{hash, shard.Name, shard.Pool})
+			}
+		}
+	}
+
+	// The first shard by name owns a point that two shards hash to, whatever the order of the shards.
+	sort.Slice(ret.points, func(i, j int) bool {
+		if ret.points[i].hash != ret.points[j].hash {
+			return ret.points[i].hash < ret.points[j].hash
+		}
+		return ret.points[i].name < ret.points[j].name
+	})
+	return ret
+}
@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// The concurrency service releases hits acquired by ShouldRateLimit for descriptors with a
+// concurrency limit. It takes the same messages as the data-plane-api rate limit service so that
+// callers can release exactly what they acquired by sending the same request again. Because it
+// has no messages of its own, it is registered by hand instead of being generated from a proto.
+const concurrencyServiceName = "pb.lyft.ratelimit.ConcurrencyService"
+
+type ConcurrencyServiceServer interface {
+	// Release hits previously acquired for concurrency limits. Descriptors without a concurrency
+	// limit are ignored.
+	Release(context.Context, *pb.RateLimitRequest) (*pb.RateLimitResponse, error)
+}
+
+func RegisterConcurrencyServiceServer(s *grpc.Server, srv ConcurrencyServiceServer) {
+	s.RegisterService(&concurrencyServiceDesc, srv)
+}
+
+func concurrencyServiceReleaseHandler(
+	srv interface{}, ctx context.Context, dec func(interface{}) error,
+	interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+	in := new(pb.RateLimitRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ConcurrencyServiceServer).Release(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + concurrencyServiceName + "/Release",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ConcurrencyServiceServer).Release(ctx, req.(*pb.RateLimitRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var concurrencyServiceDesc = grpc.ServiceDesc{
+	ServiceName: concurrencyServiceName,
+	HandlerType: (*ConcurrencyServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Release",
+			Handler:    concurrencyServiceReleaseHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+type ConcurrencyServiceClient interface {
+	// Release hits previously acquired for concurrency limits.
+	Release(ctx context.Context, in *pb.RateLimitRequest, opts ...grpc.CallOption) (*pb.RateLimitResponse, error)
+}
+
+type concurrencyServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewConcurrencyServiceClient(cc *grpc.ClientConn) ConcurrencyServiceClient {
+	return &concurrencyServiceClient{cc}
+}
+
+func (this *concurrencyServiceClient) Release(
+	ctx context.Context, in *pb.RateLimitRequest, opts ...grpc.CallOption) (*pb.RateLimitResponse, error) {
+
+	out := new(pb.RateLimitResponse)
+	err := grpc.Invoke(ctx, "/"+concurrencyServiceName+"/Release", in, out, this.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -1,9 +1,12 @@
 package ratelimit
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"strings"
 	"sync"
 
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
 	"github.com/lyft/goruntime/loader"
 	"github.com/lyft/gostats"
@@ -12,17 +15,27 @@ import (
 	"github.com/lyft/ratelimit/src/redis"
 	logger "github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
 )
 
+// Header that ShouldRateLimit returns the ID of the leases acquired for concurrency limits in. The
+// same ID must be sent to Release in the request metadata of the same name.
+const LeaseIDHeader = "x-ratelimit-lease-id"
+
 type shouldRateLimitStats struct {
 	redisError   stats.Counter
+	redisTimeout stats.Counter
 	serviceError stats.Counter
+	// Calls whose caller gave up before the cache answered.
+	canceled stats.Counter
 }
 
 func newShouldRateLimitStats(scope stats.Scope) shouldRateLimitStats {
 	ret := shouldRateLimitStats{}
 	ret.redisError = scope.NewCounter("redis_error")
+	ret.redisTimeout = scope.NewCounter("redis_timeout")
 	ret.serviceError = scope.NewCounter("service_error")
+	ret.canceled = scope.NewCounter("canceled")
 	return ret
 }
 
@@ -30,6 +43,9 @@ type serviceStats struct {
 	configLoadSuccess stats.Counter
 	configLoadError   stats.Counter
 	shouldRateLimit   shouldRateLimitStats
+	release           shouldRateLimitStats
+	// Calls answered with a failure mode after a redis error.
+	failureModeApplied stats.Counter
 }
 
 func newServiceStats(scope stats.Scope) serviceStats {
@@ -37,11 +53,14 @@ func newServiceStats(scope stats.Scope) serviceStats {
 	ret.configLoadSuccess = scope.NewCounter("config_load_success")
 	ret.configLoadError = scope.NewCounter("config_load_error")
 	ret.shouldRateLimit = newShouldRateLimitStats(scope.Scope("call.should_rate_limit"))
+	ret.release = newShouldRateLimitStats(scope.Scope("call.release"))
+	ret.failureModeApplied = scope.NewCounter("call.should_rate_limit.failure_mode_applied")
 	return ret
 }
 
 type RateLimitServiceServer interface {
 	pb.RateLimitServiceServer
+	ConcurrencyServiceServer
 	GetCurrentConfig() config.RateLimitConfig
 	GetLegacyService() RateLimitLegacyServiceServer
 }
@@ -56,21 +75,11 @@ type service struct {
 	stats              serviceStats
 	rlStatsScope       stats.Scope
 	legacy             *legacyService
+	// Server-wide failure mode, used for domains that do not set their own.
+	failureMode config.FailureMode
 }
 
 func (this *service) reloadConfig() {
-	defer func() {
-		if e := recover(); e != nil {
-			configError, ok := e.(config.RateLimitConfigError)
-			if !ok {
-				panic(e)
-			}
-
-			this.stats.configLoadError.Inc()
-			logger.Errorf("error loading new configuration from runtime: %s", configError.Error())
-		}
-	}()
-
 	files := []config.RateLimitConfigToLoad{}
 	snapshot := this.runtime.Snapshot()
 	for _, key := range snapshot.Keys() {
@@ -81,7 +90,12 @@ func (this *service) reloadConfig() {
 		files = append(files, config.RateLimitConfigToLoad{key, snapshot.Get(key)})
 	}
 
-	newConfig := this.configLoader.Load(files, this.rlStatsScope)
+	newConfig, err := this.configLoader.Load(files, this.rlStatsScope)
+	if err != nil {
+		this.stats.configLoadError.Inc()
+		logger.Errorf("error loading new configuration from runtime: %s", err.Error())
+		return
+	}
 	this.stats.configLoadSuccess.Inc()
 	this.configLock.Lock()
 	this.config = newConfig
@@ -94,72 +108,265 @@ func (e serviceError) Error() string {
 	return string(e)
 }
 
-func checkServiceErr(something bool, msg string) {
-	if !something {
-		panic(serviceError(msg))
+// Look up the configured limits for each descriptor in a request. A descriptor with several
+// limits is repeated once per limit in the returned request, so that the cache can count every
+// limit in one pass.
+// @param ctx supplies the calling context.
+// @param request supplies the request to validate and look up.
+// @return the request to pass to the cache, the limit of each of its descriptors and the index
+// of the original descriptor of each limit, or a serviceError if the request cannot be checked.
+func (this *service) getLimits(
+	ctx context.Context, request *pb.RateLimitRequest) (*pb.RateLimitRequest, []*config.RateLimit, []int, error) {
+
+	if request.Domain == "" {
+		return nil, nil, nil, serviceError("rate limit domain must not be empty")
 	}
+	if len(request.Descriptors) == 0 {
+		return nil, nil, nil, serviceError("rate limit descriptor list must not be empty")
+	}
+
+	snappedConfig := this.GetCurrentConfig()
+	if snappedConfig == nil {
+		return nil, nil, nil, serviceError("no rate limit configuration loaded")
+	}
+
+	expandedRequest := &pb.RateLimitRequest{
+		Domain:     request.Domain,
+		HitsAddend: request.HitsAddend,
+	}
+	limits := make([]*config.RateLimit, 0, len(request.Descriptors))
+	owners := make([]int, 0, len(request.Descriptors))
+	for i, descriptor := range request.Descriptors {
+		descriptorLimits := snappedConfig.GetLimits(ctx, request.Domain, descriptor)
+		if len(descriptorLimits) == 0 {
+			descriptorLimits = []*config.RateLimit{nil}
+		}
+
+		for _, limit := range descriptorLimits {
+			expandedRequest.Descriptors = append(expandedRequest.Descriptors, descriptor)
+			limits = append(limits, limit)
+			owners = append(owners, i)
+		}
+	}
+
+	return expandedRequest, limits, owners, nil
 }
 
-func (this *service) shouldRateLimitWorker(
-	ctx context.Context, request *pb.RateLimitRequest) *pb.RateLimitResponse {
+// Merge the statuses of every limit of each descriptor into one status per descriptor. Over the
+// limit beats OK, and among OK statuses the one with the least remaining wins.
+// @param statuses supplies the status of each limit.
+// @param owners supplies the index of the original descriptor of each limit.
+// @param descriptorCount supplies the number of descriptors in the original request.
+// @return the most restrictive status of each descriptor.
+func mergeDescriptorStatuses(
+	statuses []*pb.RateLimitResponse_DescriptorStatus, owners []int,
+	descriptorCount int) []*pb.RateLimitResponse_DescriptorStatus {
+
+	assert.Assert(len(statuses) == len(owners))
+	ret := make([]*pb.RateLimitResponse_DescriptorStatus, descriptorCount)
+	for i, status := range statuses {
+		current := ret[owners[i]]
+		switch {
+		case current == nil:
+			ret[owners[i]] = status
+		case current.Code == pb.RateLimitResponse_OVER_LIMIT:
+		case status.Code == pb.RateLimitResponse_OVER_LIMIT:
+			ret[owners[i]] = status
+		case status.CurrentLimit != nil &&
+			(current.CurrentLimit == nil || status.LimitRemaining < current.LimitRemaining):
+			ret[owners[i]] = status
+		}
+	}
 
-	checkServiceErr(request.Domain != "", "rate limit domain must not be empty")
-	checkServiceErr(len(request.Descriptors) != 0, "rate limit descriptor list must not be empty")
+	return ret
+}
 
-	snappedConfig := this.GetCurrentConfig()
-	checkServiceErr(snappedConfig != nil, "no rate limit configuration loaded")
+// Generate the ID of the leases a call acquires if any of its limits is a concurrency limit.
+// @param limits supplies the limits of the call.
+// @return a new random ID, or empty if there are no concurrency limits.
+func newLeaseID(limits []*config.RateLimit) string {
+	for _, limit := range limits {
+		if limit != nil && limit.Algorithm == config.Concurrency {
+			id := make([]byte, 16)
+			rand.Read(id)
+			return hex.EncodeToString(id)
+		}
+	}
+	return ""
+}
 
-	limitsToCheck := make([]*config.RateLimit, len(request.Descriptors))
-	for i, descriptor := range request.Descriptors {
-		limitsToCheck[i] = snappedConfig.GetLimit(ctx, request.Domain, descriptor)
+// @param ctx supplies the context of a Release call.
+// @return the lease ID sent in the call's metadata, or empty if there is none.
+func incomingLeaseID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md[LeaseIDHeader]) == 0 {
+		return ""
 	}
+	return md[LeaseIDHeader][0]
+}
+
+func (this *service) shouldRateLimitWorker(
+	ctx context.Context, request *pb.RateLimitRequest) (*pb.RateLimitResponse, error) {
 
-	responseDescriptorStatuses := this.cache.DoLimit(ctx, request, limitsToCheck)
+	expandedRequest, limitsToCheck, owners, err := this.getLimits(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	leaseID := newLeaseID(limitsToCheck)
+	responseDescriptorStatuses, err := this.cache.DoLimit(ctx, expandedRequest, limitsToCheck, leaseID)
+	if err != nil {
+		return nil, err
+	}
 	assert.Assert(len(limitsToCheck) == len(responseDescriptorStatuses))
 
 	response := &pb.RateLimitResponse{}
-	response.Statuses = make([]*pb.RateLimitResponse_DescriptorStatus, len(request.Descriptors))
+	response.Statuses = mergeDescriptorStatuses(responseDescriptorStatuses, owners, len(request.Descriptors))
 	finalCode := pb.RateLimitResponse_OK
-	for i, descriptorStatus := range responseDescriptorStatuses {
-		response.Statuses[i] = descriptorStatus
+	for _, descriptorStatus := range response.Statuses {
 		if descriptorStatus.Code == pb.RateLimitResponse_OVER_LIMIT {
 			finalCode = descriptorStatus.Code
 		}
 	}
 
 	response.OverallCode = finalCode
+	if !acquiredLeases(limitsToCheck, responseDescriptorStatuses) {
+		return response, nil
+	}
+
+	// A rejected caller never releases, so the leases it acquired under other limits are given back
+	// right away instead of holding slots until they expire.
+	if finalCode == pb.RateLimitResponse_OVER_LIMIT {
+		if _, err := this.cache.Release(ctx, expandedRequest, limitsToCheck, leaseID); err != nil {
+			logger.Warnf("could not release the leases of a rejected call, they expire instead: %s", err.Error())
+		}
+		return response, nil
+	}
+
+	response.Headers = []*core.HeaderValue{{Key: LeaseIDHeader, Value: leaseID}}
+	return response, nil
+}
+
+// @param limits supplies the limits of a call.
+// @param statuses supplies the status of each limit.
+// @return whether any concurrency limit of the call acquired leases.
+func acquiredLeases(limits []*config.RateLimit, statuses []*pb.RateLimitResponse_DescriptorStatus) bool {
+	for i, limit := range limits {
+		if limit != nil && limit.Algorithm == config.Concurrency && statuses[i].Code == pb.RateLimitResponse_OK {
+			return true
+		}
+	}
+	return false
+}
+
+// Count an error returned during a call in the call's stats.
+// @param callStats supplies the stats of the call.
+// @param err supplies the error.
+func (this *service) countCallError(callStats shouldRateLimitStats, err error) {
+	logger.Debugf("caught error during call: %s", err.Error())
+	switch err.(type) {
+	case redis.RedisError:
+		callStats.redisError.Inc()
+	case redis.RedisTimeoutError:
+		callStats.redisTimeout.Inc()
+	case serviceError:
+		callStats.serviceError.Inc()
+	default:
+		if err == context.Canceled {
+			callStats.canceled.Inc()
+		}
+	}
+}
+
+// Answer a request whose limits could not be checked because of a redis error or timeout according
+// to the failure mode of the request's domain, or the server-wide failure mode if the domain has none.
+// @param request supplies the request that failed.
+// @param err supplies the error the request failed with.
+// @return the response to answer with, or nil if the error must be returned to the caller.
+func (this *service) applyFailureMode(request *pb.RateLimitRequest, err error) *pb.RateLimitResponse {
+	switch err.(type) {
+	case redis.RedisError, redis.RedisTimeoutError:
+	default:
+		return nil
+	}
+
+	failureMode := this.failureMode
+	if snappedConfig := this.GetCurrentConfig(); snappedConfig != nil {
+		if domainFailureMode := snappedConfig.GetFailureMode(request.Domain); domainFailureMode != config.FailureModeNone {
+			failureMode = domainFailureMode
+		}
+	}
+
+	code := pb.RateLimitResponse_OK
+	switch failureMode {
+	case config.FailureModeNone:
+		return nil
+	case config.FailureModeDeny:
+		code = pb.RateLimitResponse_OVER_LIMIT
+	}
+
+	logger.Debugf("applying failure mode %s to domain '%s'", failureMode.String(), request.Domain)
+	this.stats.failureModeApplied.Inc()
+	response := &pb.RateLimitResponse{OverallCode: code}
+	for range request.Descriptors {
+		response.Statuses = append(response.Statuses, &pb.RateLimitResponse_DescriptorStatus{Code: code})
+	}
 	return response
 }
 
 func (this *service) ShouldRateLimit(
 	ctx context.Context,
-	request *pb.RateLimitRequest) (finalResponse *pb.RateLimitResponse, finalError error) {
+	request *pb.RateLimitRequest) (*pb.RateLimitResponse, error) {
 
-	defer func() {
-		err := recover()
-		if err == nil {
-			return
+	response, err := this.shouldRateLimitWorker(ctx, request)
+	if err != nil {
+		this.countCallError(this.stats.shouldRateLimit, err)
+		if response = this.applyFailureMode(request, err); response != nil {
+			return response, nil
 		}
+		return nil, err
+	}
 
-		logger.Debugf("caught error during call")
-		finalResponse = nil
-		switch t := err.(type) {
-		case redis.RedisError:
-			{
-				this.stats.shouldRateLimit.redisError.Inc()
-				finalError = t
-			}
-		case serviceError:
-			{
-				this.stats.shouldRateLimit.serviceError.Inc()
-				finalError = t
-			}
-		default:
-			panic(err)
-		}
-	}()
+	logger.Debugf("returning normal response")
+	return response, nil
+}
+
+func (this *service) releaseWorker(
+	ctx context.Context, request *pb.RateLimitRequest) (*pb.RateLimitResponse, error) {
+
+	leaseID := incomingLeaseID(ctx)
+	if leaseID == "" {
+		return nil, serviceError("release needs the lease id returned by ShouldRateLimit in the " +
+			LeaseIDHeader + " metadata")
+	}
+	expandedRequest, limitsToRelease, owners, err := this.getLimits(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	responseDescriptorStatuses, err := this.cache.Release(ctx, expandedRequest, limitsToRelease, leaseID)
+	if err != nil {
+		return nil, err
+	}
+	assert.Assert(len(limitsToRelease) == len(responseDescriptorStatuses))
+
+	return &pb.RateLimitResponse{
+		OverallCode: pb.RateLimitResponse_OK,
+		Statuses:    mergeDescriptorStatuses(responseDescriptorStatuses, owners, len(request.Descriptors)),
+	}, nil
+}
+
+func (this *service) Release(
+	ctx context.Context,
+	request *pb.RateLimitRequest) (*pb.RateLimitResponse, error) {
+
+	response, err := this.releaseWorker(ctx, request)
+	if err != nil {
+		this.countCallError(this.stats.release, err)
+		return nil, err
+	}
 
-	response := this.shouldRateLimitWorker(ctx, request)
 	logger.Debugf("returning normal response")
 	return response, nil
 }
@@ -175,7 +382,8 @@ func (this *service) GetCurrentConfig() config.RateLimitConfig {
 }
 
 func NewService(runtime loader.IFace, cache redis.RateLimitCache,
-	configLoader config.RateLimitConfigLoader, stats stats.Scope) RateLimitServiceServer {
+	configLoader config.RateLimitConfigLoader, stats stats.Scope,
+	failureMode config.FailureMode) RateLimitServiceServer {
 
 	newService := &service{
 		runtime:            runtime,
@@ -186,6 +394,7 @@ func NewService(runtime loader.IFace, cache redis.RateLimitCache,
 		cache:              cache,
 		stats:              newServiceStats(stats),
 		rlStatsScope:       stats.Scope("rate_limit"),
+		failureMode:        failureMode,
 	}
 	newService.legacy = &legacyService{
 		s:                          newService,
@@ -1,6 +1,8 @@
 package ratelimit
 
 import (
+	"strings"
+
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/lyft/gostats"
@@ -89,8 +91,11 @@ func ConvertResponse(response *pb.RateLimitResponse) (*pb_legacy.RateLimitRespon
 		return nil, err
 	}
 
+	// The legacy response has no headers, so the ID of any leases acquired for concurrency limits is
+	// dropped and those leases can only expire.
 	resp := &pb_legacy.RateLimitResponse{}
-	err = jsonpb.UnmarshalString(s, resp)
+	u := &jsonpb.Unmarshaler{AllowUnknownFields: true}
+	err = u.Unmarshal(strings.NewReader(s), resp)
 	if err != nil {
 		return nil, err
 	}
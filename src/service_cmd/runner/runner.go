@@ -1,13 +1,16 @@
 package runner
 
 import (
+	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
+	"strings"
 	"time"
 
 	stats "github.com/lyft/gostats"
 
+	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/coocood/freecache"
 
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
@@ -33,6 +36,224 @@ func (runner *Runner) GetStatsStore() stats.Store {
 	return runner.statsStore
 }
 
+// Create a redis pool of the given type. The settings shared by all pools are taken from s.
+// @param redisType supplies the type of redis deployment, single, cluster or sentinel.
+// @param socketType supplies the socket type, tcp or unix, of a single redis. Cluster nodes and
+// sentinels are always reached over tcp.
+// @return the pool or an error if it cannot be created.
+func newRedisPool(s settings.Settings, redisType string, scope stats.Scope, socketType string, useTls bool, auth string, url string, poolSize int) (redis.Pool, error) {
+	switch strings.ToLower(redisType) {
+	case "single":
+		return redis.NewPoolImpl(scope, socketType, useTls, auth, url, poolSize, s.RedisPoolOverflowSize, s.RedisPoolOverflowDrainPeriod, s.RedisPoolMaxNewConnPerSecond, s.RedisPoolGetTimeout, s.RedisMaxOperationTimeout)
+	case "cluster":
+		return redis.NewClusterPoolImpl(scope, useTls, auth, url, poolSize, s.RedisPoolOverflowSize, s.RedisPoolOverflowDrainPeriod, s.RedisPoolMaxNewConnPerSecond, s.RedisPoolGetTimeout, s.RedisMaxOperationTimeout)
+	case "sentinel":
+		return redis.NewSentinelPoolImpl(scope, useTls, auth, url, poolSize, s.RedisPoolOverflowSize, s.RedisPoolOverflowDrainPeriod, s.RedisPoolMaxNewConnPerSecond, s.RedisPoolGetTimeout, s.RedisMaxOperationTimeout)
+	}
+	return nil, fmt.Errorf("unknown redis type '%s'", redisType)
+}
+
+// A circuit breaker around one of the redis pools, listed on the debug port.
+type namedCircuitBreaker struct {
+	name    string
+	breaker redis.CircuitBreakerPool
+}
+
+// Wrap a redis pool in a circuit breaker if the settings enable one.
+// @param s supplies the settings.
+// @param pool supplies the pool to wrap.
+// @param scope supplies the stats scope of the pool.
+// @param name supplies the name of the pool on the debug port.
+// @param breakers supplies the list of circuit breakers, which a new breaker is added to.
+// @return the pool to use.
+func withCircuitBreaker(
+	s settings.Settings, pool redis.Pool, scope stats.Scope, name string, breakers *[]namedCircuitBreaker) redis.Pool {
+
+	if s.RedisCircuitBreakerErrorRate <= 0 {
+		return pool
+	}
+
+	breaker := redis.NewCircuitBreakerPoolImpl(
+		pool, scope.Scope("circuit_breaker"), redis.NewTimeSourceImpl(), s.RedisCircuitBreakerErrorRate,
+		s.RedisCircuitBreakerMinRequests, s.RedisCircuitBreakerWindow, s.RedisCircuitBreakerCoolDown,
+		s.RedisCircuitBreakerProbes)
+	*breakers = append(*breakers, namedCircuitBreaker{name, breaker})
+	return breaker
+}
+
+// Split an entry of a list setting of the form name=value.
+// @param entry supplies the entry.
+// @return the name, the value and whether the entry was valid.
+func splitSetting(entry string) (string, string, bool) {
+	parts := strings.SplitN(entry, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Create the pools of the redis shards listed in REDIS_SHARDS, or of the single redis at REDIS_URL
+// if there are none. Each shard's pool has its own stats scope and circuit breaker.
+// @param s supplies the settings.
+// @param scope supplies the stats scope of the redis pools.
+// @param breakers supplies the list of circuit breakers, which the shards' breakers are added to.
+// @return the shards or an error if REDIS_SHARDS is invalid or a pool cannot be created.
+func newRedisShards(s settings.Settings, scope stats.Scope, breakers *[]namedCircuitBreaker) ([]redis.Shard, error) {
+	if s.RedisShards == "" {
+		pool, err := newRedisPool(s, s.RedisType, scope, s.RedisSocketType, s.RedisTls, s.RedisAuth, s.RedisUrl, s.RedisPoolSize)
+		if err != nil {
+			return nil, err
+		}
+		return []redis.Shard{{Name: "default", Pool: withCircuitBreaker(s, pool, scope, "redis_pool", breakers)}}, nil
+	}
+
+	var shards []redis.Shard
+	names := map[string]bool{}
+	for _, shard := range strings.Fields(s.RedisShards) {
+		name, url, valid := splitSetting(shard)
+		if !valid {
+			return nil, fmt.Errorf("redis shard '%s' is not of the form name=url", shard)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate redis shard '%s'", name)
+		}
+		names[name] = true
+
+		shardScope := scope.Scope(name)
+		pool, err := newRedisPool(s, s.RedisType, shardScope, s.RedisSocketType, s.RedisTls, s.RedisAuth, url, s.RedisPoolSize)
+		if err != nil {
+			return nil, fmt.Errorf("redis shard '%s': %v", name, err)
+		}
+		shards = append(shards, redis.Shard{Name: name, Pool: withCircuitBreaker(s, pool, shardScope, "redis_pool."+name, breakers)})
+	}
+	return shards, nil
+}
+
+// Create the redis backends and the routes of each unit's limits to them. The default backend is
+// the redis at REDIS_URL or the shards in REDIS_SHARDS. The per second redis is the per_second
+// backend, which gets the per second limits, if REDIS_PERSECOND is set. REDIS_BACKENDS adds more
+// backends, and REDIS_UNIT_BACKENDS routes units to any backend.
+// @param s supplies the settings.
+// @param scope supplies the stats scope of the server.
+// @param breakers supplies the list of circuit breakers, which the backends' breakers are added to.
+// @return the shards of each backend and the backend of each routed unit, or an error if the
+// settings are invalid or a pool cannot be created.
+func newRedisBackends(
+	s settings.Settings, scope stats.Scope, breakers *[]namedCircuitBreaker) (
+	map[string][]redis.Shard, map[pb.RateLimitResponse_RateLimit_Unit]string, error) {
+
+	backends := map[string][]redis.Shard{}
+	unitBackends := map[pb.RateLimitResponse_RateLimit_Unit]string{}
+
+	shards, err := newRedisShards(s, scope.Scope("redis_pool"), breakers)
+	if err != nil {
+		return nil, nil, err
+	}
+	backends[redis.DefaultBackend] = shards
+
+	if s.RedisPerSecond {
+		perSecondScope := scope.Scope("redis_per_second_pool")
+		pool, err := newRedisPool(s, s.RedisPerSecondType, perSecondScope, s.RedisPerSecondSocketType, s.RedisPerSecondTls, s.RedisPerSecondAuth, s.RedisPerSecondUrl, s.RedisPerSecondPoolSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("per second redis: %v", err)
+		}
+		pool = withCircuitBreaker(s, pool, perSecondScope, "redis_per_second_pool", breakers)
+		backends[redis.PerSecondBackend] = []redis.Shard{{Name: redis.PerSecondBackend, Pool: pool}}
+		unitBackends[pb.RateLimitResponse_RateLimit_SECOND] = redis.PerSecondBackend
+	}
+
+	for _, backend := range strings.Fields(s.RedisBackends) {
+		name, url, valid := splitSetting(backend)
+		if !valid {
+			return nil, nil, fmt.Errorf("redis backend '%s' is not of the form name=url", backend)
+		}
+		if _, present := backends[name]; present {
+			return nil, nil, fmt.Errorf("duplicate redis backend '%s'", name)
+		}
+
+		backendScope := scope.Scope("redis_backend").Scope(name)
+		pool, err := newRedisPool(s, s.RedisType, backendScope, s.RedisSocketType, s.RedisTls, s.RedisAuth, url, s.RedisPoolSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("redis backend '%s': %v", name, err)
+		}
+		pool = withCircuitBreaker(s, pool, backendScope, "redis_backend."+name, breakers)
+		backends[name] = []redis.Shard{{Name: name, Pool: pool}}
+	}
+
+	for _, route := range strings.Fields(s.RedisUnitBackends) {
+		unitName, backend, valid := splitSetting(route)
+		if !valid {
+			return nil, nil, fmt.Errorf("redis unit backend '%s' is not of the form unit=backend", route)
+		}
+		unit, present := pb.RateLimitResponse_RateLimit_Unit_value[strings.ToUpper(unitName)]
+		if !present || unit == int32(pb.RateLimitResponse_RateLimit_UNKNOWN) {
+			return nil, nil, fmt.Errorf("invalid rate limit unit '%s'", unitName)
+		}
+		if _, present := backends[backend]; !present {
+			return nil, nil, fmt.Errorf("unknown redis backend '%s'", backend)
+		}
+		unitBackends[pb.RateLimitResponse_RateLimit_Unit(unit)] = backend
+	}
+
+	return backends, unitBackends, nil
+}
+
+// Create a memcached client for the servers listed in MEMCACHED_SERVERS.
+// @param s supplies the settings.
+// @return the client or an error if MEMCACHED_SERVERS is empty or invalid.
+func newMemcachedClient(s settings.Settings) (*memcache.Client, error) {
+	servers := strings.Fields(s.MemcachedServers)
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no memcached servers")
+	}
+
+	var selector memcache.ServerList
+	if err := selector.SetServers(servers...); err != nil {
+		return nil, err
+	}
+	client := memcache.NewFromSelector(&selector)
+	client.Timeout = s.MemcachedTimeout
+	return client, nil
+}
+
+// Create the cache that counts hits in the backend selected by BACKEND_TYPE.
+// @param s supplies the settings.
+// @param scope supplies the stats scope of the server.
+// @param localCache supplies the local cache of over limit keys, which may be nil.
+// @param breakers supplies the list of circuit breakers, which the redis breakers are added to.
+// @return the cache, the names of the backends that limits can name and the algorithms they can use
+// (nil for all), or an error if the settings are invalid or the backend cannot be reached.
+func newRateLimitCache(
+	s settings.Settings, scope stats.Scope, localCache *freecache.Cache, breakers *[]namedCircuitBreaker) (
+	redis.RateLimitCache, []string, []config.RateLimitAlgorithm, error) {
+
+	jitterRand := rand.New(redis.NewLockedSource(time.Now().Unix()))
+	switch strings.ToLower(s.BackendType) {
+	case "redis":
+		backends, unitBackends, err := newRedisBackends(s, scope, breakers)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		names := make([]string, 0, len(backends))
+		for name := range backends {
+			names = append(names, name)
+		}
+		return redis.NewRoutedRateLimitCacheImpl(
+			backends, unitBackends, redis.NewTimeSourceImpl(), jitterRand, s.ExpirationJitterMaxSeconds, localCache,
+			scope.Scope("cache")), names, nil, nil
+	case "memcached":
+		client, err := newMemcachedClient(s)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		// memcached has no named backends, so limits cannot name one.
+		return redis.NewMemcachedRateLimitCacheImpl(
+			client, redis.NewTimeSourceImpl(), jitterRand, s.ExpirationJitterMaxSeconds, localCache,
+			scope.Scope("cache")), []string{}, redis.MemcachedAlgorithms, nil
+	}
+	return nil, nil, nil, fmt.Errorf("unknown backend type '%s'", s.BackendType)
+}
+
 func (runner *Runner) Run() {
 	s := settings.NewSettings()
 
@@ -42,6 +263,11 @@ func (runner *Runner) Run() {
 	} else {
 		logger.SetLevel(logLevel)
 	}
+	failureMode, valid := config.ParseFailureMode(s.FailureMode)
+	if !valid {
+		logger.Fatalf("Could not parse failure mode '%s'\n", s.FailureMode)
+	}
+
 	var localCache *freecache.Cache
 	if s.LocalCacheSizeInBytes != 0 {
 		localCache = freecache.NewCache(s.LocalCacheSizeInBytes)
@@ -49,26 +275,18 @@ func (runner *Runner) Run() {
 
 	srv := server.NewServer("ratelimit", runner.statsStore, localCache, settings.GrpcUnaryInterceptor(nil))
 
-	var perSecondPool redis.Pool
-	if s.RedisPerSecond {
-		perSecondPool = redis.NewPoolImpl(srv.Scope().Scope("redis_per_second_pool"), s.RedisPerSecondTls, s.RedisPerSecondAuth, s.RedisPerSecondUrl, s.RedisPerSecondPoolSize, s.RedisPoolOverflowSize, s.RedisPoolOverflowDrainPeriod, s.RedisPoolMaxNewConnPerSecond, s.RedisPoolGetTimeout)
+	var breakers []namedCircuitBreaker
+	cache, backendNames, algorithms, err := newRateLimitCache(s, srv.Scope(), localCache, &breakers)
+	if err != nil {
+		logger.Fatalf("Could not connect to the %s backend. %v\n", s.BackendType, err)
 	}
-	var otherPool redis.Pool
-	otherPool = redis.NewPoolImpl(srv.Scope().Scope("redis_pool"), s.RedisTls, s.RedisAuth, s.RedisUrl, s.RedisPoolSize, s.RedisPoolOverflowSize, s.RedisPoolOverflowDrainPeriod, s.RedisPoolMaxNewConnPerSecond, s.RedisPoolGetTimeout)
 
 	service := ratelimit.NewService(
 		srv.Runtime(),
-		redis.NewRateLimitCacheImpl(
-			otherPool,
-			perSecondPool,
-			redis.NewTimeSourceImpl(),
-			rand.New(redis.NewLockedSource(time.Now().Unix())),
-			s.ExpirationJitterMaxSeconds,
-			localCache,
-			srv.Scope().Scope("cache"),
-		),
-		config.NewRateLimitConfigLoaderImpl(),
-		srv.Scope().Scope("service"))
+		cache,
+		config.NewRateLimitConfigLoaderImplForCache(backendNames, algorithms),
+		srv.Scope().Scope("service"),
+		failureMode)
 
 	srv.AddDebugHttpEndpoint(
 		"/rlconfig",
@@ -77,12 +295,25 @@ func (runner *Runner) Run() {
 			io.WriteString(writer, service.GetCurrentConfig().Dump())
 		})
 
+	if len(breakers) > 0 {
+		srv.AddDebugHttpEndpoint(
+			"/rlcircuitbreaker",
+			"print out the state of the redis circuit breakers",
+			func(writer http.ResponseWriter, request *http.Request) {
+				for _, breaker := range breakers {
+					io.WriteString(writer, breaker.name+": "+breaker.breaker.State().String()+"\n")
+				}
+			})
+	}
+
 	// Ratelimit is compatible with two proto definitions
 	// 1. data-plane-api rls.proto: https://github.com/envoyproxy/data-plane-api/blob/master/envoy/service/ratelimit/v2/rls.proto
 	pb.RegisterRateLimitServiceServer(srv.GrpcServer(), service)
 	// 2. ratelimit.proto defined in this repository: https://github.com/lyft/ratelimit/blob/0ded92a2af8261d43096eba4132e45b99a3b8b14/proto/ratelimit/ratelimit.proto
 	pb_legacy.RegisterRateLimitServiceServer(srv.GrpcServer(), service.GetLegacyService())
 	// (1) is the current definition, and (2) is the legacy definition.
+	// Hits acquired for concurrency limits are released through a separate service that reuses (1)'s messages.
+	ratelimit.RegisterConcurrencyServiceServer(srv.GrpcServer(), service)
 
 	srv.Start()
 }
@@ -11,33 +11,48 @@ type Settings struct {
 	// runtime options
 	GrpcUnaryInterceptor grpc.ServerOption
 	// env config
-	Port                         int           `envconfig:"PORT" default:"8080"`
-	GrpcPort                     int           `envconfig:"GRPC_PORT" default:"8081"`
-	DebugPort                    int           `envconfig:"DEBUG_PORT" default:"6070"`
-	UseStatsd                    bool          `envconfig:"USE_STATSD" default:"true"`
-	StatsdHost                   string        `envconfig:"STATSD_HOST" default:"localhost"`
-	StatsdPort                   int           `envconfig:"STATSD_PORT" default:"8125"`
-	RuntimePath                  string        `envconfig:"RUNTIME_ROOT" default:"/srv/runtime_data/current"`
-	RuntimeSubdirectory          string        `envconfig:"RUNTIME_SUBDIRECTORY"`
-	RuntimeIgnoreDotFiles        bool          `envconfig:"RUNTIME_IGNOREDOTFILES" default:"false"`
-	LogLevel                     string        `envconfig:"LOG_LEVEL" default:"WARN"`
-	RedisSocketType              string        `envconfig:"REDIS_SOCKET_TYPE" default:"unix"`
-	RedisUrl                     string        `envconfig:"REDIS_URL" default:"/var/run/nutcracker/ratelimit.sock"`
-	RedisPoolSize                int           `envconfig:"REDIS_POOL_SIZE" default:"10"`
-	RedisPoolOverflowSize        int           `envconfig:"REDIS_POOL_SIZE_OVERFLOW_SIZE" default:"10"`
-	RedisPoolOverflowDrainPeriod time.Duration `envconfig:"REDIS_POOL_SIZE_OVERFLOW_DRAIN_PERIOD" default:"5s"`
-	RedisPoolMaxNewConnPerSecond int           `envconfig:"REDIS_POOL_MAX_NEW_CONN_PER_SECOND" default:"1"`
-	RedisPoolGetTimeout          time.Duration `envconfig:"REDIS_POOL_GET_TIMEOUT" default:"200ms"`
-	RedisAuth                    string        `envconfig:"REDIS_AUTH" default:""`
-	RedisTls                     bool          `envconfig:"REDIS_TLS" default:"false"`
-	RedisPerSecond               bool          `envconfig:"REDIS_PERSECOND" default:"false"`
-	RedisPerSecondSocketType     string        `envconfig:"REDIS_PERSECOND_SOCKET_TYPE" default:"unix"`
-	RedisPerSecondUrl            string        `envconfig:"REDIS_PERSECOND_URL" default:"/var/run/nutcracker/ratelimitpersecond.sock"`
-	RedisPerSecondPoolSize       int           `envconfig:"REDIS_PERSECOND_POOL_SIZE" default:"10"`
-	RedisPerSecondAuth           string        `envconfig:"REDIS_PERSECOND_AUTH" default:""`
-	RedisPerSecondTls            bool          `envconfig:"REDIS_PERSECOND_TLS" default:"false"`
-	ExpirationJitterMaxSeconds   int64         `envconfig:"EXPIRATION_JITTER_MAX_SECONDS" default:"300"`
-	LocalCacheSizeInBytes        int           `envconfig:"LOCAL_CACHE_SIZE_IN_BYTES" default:"0"`
+	Port                           int           `envconfig:"PORT" default:"8080"`
+	GrpcPort                       int           `envconfig:"GRPC_PORT" default:"8081"`
+	DebugPort                      int           `envconfig:"DEBUG_PORT" default:"6070"`
+	UseStatsd                      bool          `envconfig:"USE_STATSD" default:"true"`
+	StatsdHost                     string        `envconfig:"STATSD_HOST" default:"localhost"`
+	StatsdPort                     int           `envconfig:"STATSD_PORT" default:"8125"`
+	RuntimePath                    string        `envconfig:"RUNTIME_ROOT" default:"/srv/runtime_data/current"`
+	RuntimeSubdirectory            string        `envconfig:"RUNTIME_SUBDIRECTORY"`
+	RuntimeIgnoreDotFiles          bool          `envconfig:"RUNTIME_IGNOREDOTFILES" default:"false"`
+	LogLevel                       string        `envconfig:"LOG_LEVEL" default:"WARN"`
+	BackendType                    string        `envconfig:"BACKEND_TYPE" default:"redis"`
+	RedisSocketType                string        `envconfig:"REDIS_SOCKET_TYPE" default:"unix"`
+	RedisType                      string        `envconfig:"REDIS_TYPE" default:"single"`
+	RedisUrl                       string        `envconfig:"REDIS_URL" default:"/var/run/nutcracker/ratelimit.sock"`
+	RedisShards                    string        `envconfig:"REDIS_SHARDS" default:""`
+	RedisBackends                  string        `envconfig:"REDIS_BACKENDS" default:""`
+	RedisUnitBackends              string        `envconfig:"REDIS_UNIT_BACKENDS" default:""`
+	RedisPoolSize                  int           `envconfig:"REDIS_POOL_SIZE" default:"10"`
+	RedisPoolOverflowSize          int           `envconfig:"REDIS_POOL_SIZE_OVERFLOW_SIZE" default:"10"`
+	RedisPoolOverflowDrainPeriod   time.Duration `envconfig:"REDIS_POOL_SIZE_OVERFLOW_DRAIN_PERIOD" default:"5s"`
+	RedisPoolMaxNewConnPerSecond   int           `envconfig:"REDIS_POOL_MAX_NEW_CONN_PER_SECOND" default:"1"`
+	RedisPoolGetTimeout            time.Duration `envconfig:"REDIS_POOL_GET_TIMEOUT" default:"200ms"`
+	RedisMaxOperationTimeout       time.Duration `envconfig:"REDIS_MAX_OPERATION_TIMEOUT" default:"0s"`
+	RedisAuth                      string        `envconfig:"REDIS_AUTH" default:""`
+	RedisTls                       bool          `envconfig:"REDIS_TLS" default:"false"`
+	RedisCircuitBreakerErrorRate   float64       `envconfig:"REDIS_CIRCUIT_BREAKER_ERROR_RATE" default:"0"`
+	RedisCircuitBreakerMinRequests int           `envconfig:"REDIS_CIRCUIT_BREAKER_MIN_REQUESTS" default:"20"`
+	RedisCircuitBreakerWindow      time.Duration `envconfig:"REDIS_CIRCUIT_BREAKER_WINDOW" default:"10s"`
+	RedisCircuitBreakerCoolDown    time.Duration `envconfig:"REDIS_CIRCUIT_BREAKER_COOL_DOWN" default:"5s"`
+	RedisCircuitBreakerProbes      int           `envconfig:"REDIS_CIRCUIT_BREAKER_PROBES" default:"1"`
+	RedisPerSecond                 bool          `envconfig:"REDIS_PERSECOND" default:"false"`
+	RedisPerSecondSocketType       string        `envconfig:"REDIS_PERSECOND_SOCKET_TYPE" default:"unix"`
+	RedisPerSecondType             string        `envconfig:"REDIS_PERSECOND_TYPE" default:"single"`
+	RedisPerSecondUrl              string        `envconfig:"REDIS_PERSECOND_URL" default:"/var/run/nutcracker/ratelimitpersecond.sock"`
+	RedisPerSecondPoolSize         int           `envconfig:"REDIS_PERSECOND_POOL_SIZE" default:"10"`
+	RedisPerSecondAuth             string        `envconfig:"REDIS_PERSECOND_AUTH" default:""`
+	RedisPerSecondTls              bool          `envconfig:"REDIS_PERSECOND_TLS" default:"false"`
+	MemcachedServers               string        `envconfig:"MEMCACHED_SERVERS" default:""`
+	MemcachedTimeout               time.Duration `envconfig:"MEMCACHED_TIMEOUT" default:"100ms"`
+	ExpirationJitterMaxSeconds     int64         `envconfig:"EXPIRATION_JITTER_MAX_SECONDS" default:"300"`
+	LocalCacheSizeInBytes          int           `envconfig:"LOCAL_CACHE_SIZE_IN_BYTES" default:"0"`
+	FailureMode                    string        `envconfig:"FAILURE_MODE" default:""`
 }
 
 type Option func(*Settings)
@@ -22,7 +22,8 @@ func loadFile(path string) []config.RateLimitConfigToLoad {
 func TestBasicConfig(t *testing.T) {
 	assert := assert.New(t)
 	stats := stats.NewStore(stats.NewNullSink(), false)
-	rlConfig := config.NewRateLimitConfigImpl(loadFile("basic_config.yaml"), stats)
+	rlConfig, err := config.NewRateLimitConfigImpl(loadFile("basic_config.yaml"), stats)
+	assert.NoError(err)
 	rlConfig.Dump()
 	assert.Nil(rlConfig.GetLimit(nil, "foo_domain", &pb_struct.RateLimitDescriptor{}))
 	assert.Nil(rlConfig.GetLimit(nil, "test-domain", &pb_struct.RateLimitDescriptor{}))
@@ -148,122 +149,680 @@ func TestBasicConfig(t *testing.T) {
 	assert.EqualValues(1, stats.NewCounter("test-domain.key4.total_hits").Value())
 	assert.EqualValues(1, stats.NewCounter("test-domain.key4.over_limit").Value())
 	assert.EqualValues(1, stats.NewCounter("test-domain.key4.near_limit").Value())
+	assert.Equal(config.FixedWindow, rl.Algorithm)
+
+	rl = rlConfig.GetLimit(
+		nil, "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key6", Value: "foo"}},
+		})
+	assert.EqualValues(10, rl.Limit.RequestsPerUnit)
+	assert.Equal(pb.RateLimitResponse_RateLimit_MINUTE, rl.Limit.Unit)
+	assert.Equal(config.SlidingWindow, rl.Algorithm)
+
+	rl = rlConfig.GetLimit(
+		nil, "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key7", Value: "foo"}},
+		})
+	assert.EqualValues(10, rl.Limit.RequestsPerUnit)
+	assert.Equal(config.TokenBucket, rl.Algorithm)
+	assert.EqualValues(50, rl.Burst)
+
+	rl = rlConfig.GetLimit(
+		nil, "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key8", Value: "foo"}},
+		})
+	assert.EqualValues(5, rl.Limit.RequestsPerUnit)
+	assert.Equal(pb.RateLimitResponse_RateLimit_DAY, rl.Limit.Unit)
+	assert.Equal(config.GCRA, rl.Algorithm)
+	assert.EqualValues(0, rl.Burst)
+
+	rl = rlConfig.GetLimit(
+		nil, "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key9", Value: "foo"}},
+		})
+	assert.EqualValues(3, rl.Limit.RequestsPerUnit)
+	assert.Equal(config.Concurrency, rl.Algorithm)
+	assert.EqualValues(30, rl.LeaseSeconds)
+
+	rl = rlConfig.GetLimit(
+		nil, "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key10", Value: "foo"}},
+		})
+	assert.EqualValues(2, rl.Limit.RequestsPerUnit)
+	assert.Equal(config.Concurrency, rl.Algorithm)
+	assert.EqualValues(config.DefaultLeaseSeconds, rl.LeaseSeconds)
+
+	rl = rlConfig.GetLimit(
+		nil, "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key11", Value: "foo"}},
+		})
+	assert.EqualValues(100, rl.Limit.RequestsPerUnit)
+	assert.Equal(pb.RateLimitResponse_RateLimit_SECOND, rl.Limit.Unit)
+	assert.EqualValues(10, rl.UnitSeconds)
+
+	rl = rlConfig.GetLimit(
+		nil, "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key12", Value: "foo"}},
+		})
+	assert.EqualValues(50, rl.Limit.RequestsPerUnit)
+	assert.Equal(pb.RateLimitResponse_RateLimit_MINUTE, rl.Limit.Unit)
+	assert.EqualValues(15*60, rl.UnitSeconds)
+	assert.Equal(config.SlidingWindow, rl.Algorithm)
+
+	rl = rlConfig.GetLimit(
+		nil, "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key13", Value: "foo"}},
+		})
+	assert.EqualValues(1000, rl.Limit.RequestsPerUnit)
+	assert.Equal(pb.RateLimitResponse_RateLimit_DAY, rl.Limit.Unit)
+	assert.EqualValues(7*24*60*60, rl.UnitSeconds)
+	assert.False(rl.ShadowMode)
+
+	rl = rlConfig.GetLimit(
+		nil, "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key14", Value: "foo"}},
+		})
+	assert.EqualValues(5, rl.Limit.RequestsPerUnit)
+	assert.True(rl.ShadowMode)
+	rl.Stats.ShadowMode.Inc()
+	assert.EqualValues(1, stats.NewCounter("test-domain.key14.shadow_mode").Value())
+
+	rl = rlConfig.GetLimit(
+		nil, "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key15", Value: "foo"}, {Key: "tenant", Value: "internal"}},
+		})
+	assert.True(rl.Unlimited)
+	assert.Equal("test-domain.key15.tenant_internal", rl.FullKey)
+	rl.Stats.TotalHits.Inc()
+	assert.EqualValues(1, stats.NewCounter("test-domain.key15.tenant_internal.total_hits").Value())
+	assert.Contains(rlConfig.Dump(), "test-domain.key15.tenant_internal: match=exact unlimited=true\n")
+
+	key16 := &pb_struct.RateLimitDescriptor{
+		Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key16", Value: "foo"}},
+	}
+	rls := rlConfig.GetLimits(nil, "test-domain", key16)
+	assert.Len(rls, 2)
+	assert.Equal("test-domain.key16", rls[0].FullKey)
+	assert.EqualValues(10, rls[0].Limit.RequestsPerUnit)
+	assert.Equal(pb.RateLimitResponse_RateLimit_SECOND, rls[0].Limit.Unit)
+	assert.Equal(0, rls[0].Index)
+	assert.Equal("test-domain.key16#1", rls[1].FullKey)
+	assert.EqualValues(1000, rls[1].Limit.RequestsPerUnit)
+	assert.Equal(pb.RateLimitResponse_RateLimit_DAY, rls[1].Limit.Unit)
+	assert.Equal(1, rls[1].Index)
+	assert.Equal(rls[0], rlConfig.GetLimit(nil, "test-domain", key16))
+	rls[1].Stats.OverLimit.Inc()
+	assert.EqualValues(1, stats.NewCounter("test-domain.key16#1.over_limit").Value())
+	assert.EqualValues(0, stats.NewCounter("test-domain.key16.over_limit").Value())
+
+	assert.Empty(rlConfig.GetLimits(
+		nil, "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key2", Value: "value3"}},
+		}))
+	assert.False(rls[0].Aggregate)
+
+	rl = rlConfig.GetLimit(
+		nil, "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key17", Value: "foo"}},
+		})
+	assert.EqualValues(500, rl.Limit.RequestsPerUnit)
+	assert.True(rl.Aggregate)
+	assert.Contains(
+		rlConfig.Dump(),
+		"test-domain.key17: match=key unit=SECOND unit_seconds=1 requests_per_unit=500 algorithm=fixed_window burst=0 shadow_mode=false aggregate=true\n")
+	assert.Equal("", rl.Backend)
+
+	rl = rlConfig.GetLimit(
+		nil, "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key18", Value: "foo"}},
+		})
+	assert.Equal("persistent", rl.Backend)
+	assert.Contains(
+		rlConfig.Dump(),
+		"test-domain.key18: match=key unit=DAY unit_seconds=86400 requests_per_unit=100000 algorithm=fixed_window burst=0 shadow_mode=false backend=persistent\n")
+}
+
+func TestShadowDomain(t *testing.T) {
+	assert := assert.New(t)
+	stats := stats.NewStore(stats.NewNullSink(), false)
+	rlConfig, err := config.NewRateLimitConfigImpl(loadFile("shadow_domain.yaml"), stats)
+	assert.NoError(err)
+
+	rl := rlConfig.GetLimit(
+		nil, "shadow-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key1", Value: "foo"}},
+		})
+	assert.True(rl.ShadowMode)
+
+	// Concurrency limits are always enforced.
+	rl = rlConfig.GetLimit(
+		nil, "shadow-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "key2", Value: "foo"}},
+		})
+	assert.False(rl.ShadowMode)
+}
+
+func TestFailureMode(t *testing.T) {
+	assert := assert.New(t)
+	stats := stats.NewStore(stats.NewNullSink(), false)
+	rlConfig, err := config.NewRateLimitConfigImpl(
+		append(loadFile("failure_mode.yaml"), loadFile("basic_config.yaml")...), stats)
+	assert.NoError(err)
+
+	assert.Equal(config.FailureModeDeny, rlConfig.GetFailureMode("login"))
+	assert.Equal(config.FailureModeNone, rlConfig.GetFailureMode("test-domain"))
+	assert.Equal(config.FailureModeNone, rlConfig.GetFailureMode("unknown-domain"))
+}
+
+func TestPrefixConfig(t *testing.T) {
+	assert := assert.New(t)
+	stats := stats.NewStore(stats.NewNullSink(), false)
+	rlConfig, err := config.NewRateLimitConfigImpl(loadFile("prefix_config.yaml"), stats)
+	assert.NoError(err)
+
+	getLimit := func(entries ...*pb_struct.RateLimitDescriptor_Entry) *config.RateLimit {
+		return rlConfig.GetLimit(nil, "test-domain", &pb_struct.RateLimitDescriptor{Entries: entries})
+	}
+
+	// An exact value beats every prefix.
+	rl := getLimit(&pb_struct.RateLimitDescriptor_Entry{Key: "path", Value: "/api/v1/users"})
+	assert.EqualValues(30, rl.Limit.RequestsPerUnit)
+	assert.Equal("test-domain.path_/api/v1/users", rl.FullKey)
+
+	// The longest matching prefix wins.
+	rl = getLimit(&pb_struct.RateLimitDescriptor_Entry{Key: "path", Value: "/api/v1/users/1"})
+	assert.EqualValues(20, rl.Limit.RequestsPerUnit)
+	assert.Equal("test-domain.path_/api/v1/*", rl.FullKey)
+
+	rl = getLimit(&pb_struct.RateLimitDescriptor_Entry{Key: "path", Value: "/api/v2/users"})
+	assert.EqualValues(10, rl.Limit.RequestsPerUnit)
+
+	// The key only is used when no prefix matches.
+	rl = getLimit(&pb_struct.RateLimitDescriptor_Entry{Key: "path", Value: "/other"})
+	assert.EqualValues(1, rl.Limit.RequestsPerUnit)
+
+	// A bare wildcard matches any value and nested descriptors are matched by prefix too.
+	rl = getLimit(
+		&pb_struct.RateLimitDescriptor_Entry{Key: "method", Value: "GET"},
+		&pb_struct.RateLimitDescriptor_Entry{Key: "path", Value: "/static/logo.png"})
+	assert.EqualValues(40, rl.Limit.RequestsPerUnit)
+	assert.Equal("test-domain.method_*.path_/static/*", rl.FullKey)
+	assert.Nil(getLimit(
+		&pb_struct.RateLimitDescriptor_Entry{Key: "method", Value: "GET"},
+		&pb_struct.RateLimitDescriptor_Entry{Key: "path", Value: "/api"}))
+
+	assert.Equal(
+		"test-domain.method_*.path_/static/*: match=prefix unit=MINUTE unit_seconds=60 requests_per_unit=40 algorithm=fixed_window burst=0 shadow_mode=false\n"+
+			"test-domain.path_/api/v1/users: match=exact unit=SECOND unit_seconds=1 requests_per_unit=30 algorithm=fixed_window burst=0 shadow_mode=false\n"+
+			"test-domain.path_/api/v1/*: match=prefix unit=SECOND unit_seconds=1 requests_per_unit=20 algorithm=fixed_window burst=0 shadow_mode=false\n"+
+			"test-domain.path_/api/*: match=prefix unit=SECOND unit_seconds=1 requests_per_unit=10 algorithm=fixed_window burst=0 shadow_mode=false\n"+
+			"test-domain.path: match=key unit=SECOND unit_seconds=1 requests_per_unit=1 algorithm=fixed_window burst=0 shadow_mode=false\n",
+		rlConfig.Dump())
 }
 
-func expectConfigPanic(t *testing.T, call func(), expectedError string) {
+func TestRegexConfig(t *testing.T) {
 	assert := assert.New(t)
-	defer func() {
-		e := recover()
-		assert.NotNil(e)
-		assert.Equal(expectedError, e.(error).Error())
-	}()
+	stats := stats.NewStore(stats.NewNullSink(), false)
+	rlConfig, err := config.NewRateLimitConfigImpl(loadFile("regex_config.yaml"), stats)
+	assert.NoError(err)
 
-	call()
+	getLimit := func(value string) *config.RateLimit {
+		return rlConfig.GetLimit(
+			nil, "test-domain",
+			&pb_struct.RateLimitDescriptor{
+				Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "user", Value: value}},
+			})
+	}
+
+	// Exact values and prefixes are checked before regexes.
+	assert.EqualValues(100, getLimit("user-1").Limit.RequestsPerUnit)
+	assert.EqualValues(20, getLimit("user-x1").Limit.RequestsPerUnit)
+
+	// Regexes are checked in file order before the key only.
+	rl := getLimit("user-12")
+	assert.EqualValues(10, rl.Limit.RequestsPerUnit)
+	assert.Equal("test-domain.user_^user-[0-9]+$", rl.FullKey)
+	assert.EqualValues(5, getLimit("user-abc").Limit.RequestsPerUnit)
+	assert.EqualValues(1, getLimit("admin").Limit.RequestsPerUnit)
+
+	// The source of a regex is not matched as an exact value.
+	assert.EqualValues(1, getLimit("^user-[0-9]+$").Limit.RequestsPerUnit)
+
+	assert.Equal(
+		"test-domain.user_user-1: match=exact unit=SECOND unit_seconds=1 requests_per_unit=100 algorithm=fixed_window burst=0 shadow_mode=false\n"+
+			"test-domain.user_user-x*: match=prefix unit=SECOND unit_seconds=1 requests_per_unit=20 algorithm=fixed_window burst=0 shadow_mode=false\n"+
+			"test-domain.user_^user-[0-9]+$: match=regex unit=SECOND unit_seconds=1 requests_per_unit=10 algorithm=fixed_window burst=0 shadow_mode=false\n"+
+			"test-domain.user_^user-: match=regex unit=SECOND unit_seconds=1 requests_per_unit=5 algorithm=fixed_window burst=0 shadow_mode=false\n"+
+			"test-domain.user: match=key unit=SECOND unit_seconds=1 requests_per_unit=1 algorithm=fixed_window burst=0 shadow_mode=false\n",
+		rlConfig.Dump())
+}
+
+func TestCIDRConfig(t *testing.T) {
+	assert := assert.New(t)
+	stats := stats.NewStore(stats.NewNullSink(), false)
+	rlConfig, err := config.NewRateLimitConfigImpl(loadFile("cidr_config.yaml"), stats)
+	assert.NoError(err)
+
+	getLimit := func(value string) *config.RateLimit {
+		return rlConfig.GetLimit(
+			nil, "test-domain",
+			&pb_struct.RateLimitDescriptor{
+				Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "remote_address", Value: value}},
+			})
+	}
+
+	// Exact values are checked before networks, and the longest network wins.
+	assert.EqualValues(100, getLimit("10.1.2.3").Limit.RequestsPerUnit)
+	rl := getLimit("10.1.2.4")
+	assert.EqualValues(20, rl.Limit.RequestsPerUnit)
+	assert.Equal("test-domain.remote_address_10.1.0.0/16", rl.FullKey)
+	assert.EqualValues(10, getLimit("10.2.0.1").Limit.RequestsPerUnit)
+	assert.EqualValues(0, getLimit("2001:db8::1").Limit.RequestsPerUnit)
+	assert.EqualValues(5, getLimit("2001:db9::1").Limit.RequestsPerUnit)
+	// IPv4-mapped IPv6 addresses are matched as IPv4 addresses.
+	assert.EqualValues(10, getLimit("::ffff:10.2.0.1").Limit.RequestsPerUnit)
+
+	// Addresses outside every network and values that are not addresses fall back to the key only. IPv6
+	// networks never contain IPv4 addresses.
+	assert.EqualValues(1, getLimit("11.0.0.1").Limit.RequestsPerUnit)
+	assert.EqualValues(1, getLimit("foo").Limit.RequestsPerUnit)
+	assert.EqualValues(1, getLimit("10.0.0.0/8").Limit.RequestsPerUnit)
+
+	assert.Equal(
+		"test-domain.remote_address_10.1.2.3: match=exact unit=SECOND unit_seconds=1 requests_per_unit=100 algorithm=fixed_window burst=0 shadow_mode=false\n"+
+			"test-domain.remote_address_10.1.0.0/16: match=cidr unit=SECOND unit_seconds=1 requests_per_unit=20 algorithm=fixed_window burst=0 shadow_mode=false\n"+
+			"test-domain.remote_address_10.0.0.0/8: match=cidr unit=SECOND unit_seconds=1 requests_per_unit=10 algorithm=fixed_window burst=0 shadow_mode=false\n"+
+			"test-domain.remote_address_2001:db8::/32: match=cidr unit=SECOND unit_seconds=1 requests_per_unit=0 algorithm=fixed_window burst=0 shadow_mode=false\n"+
+			"test-domain.remote_address_::/0: match=cidr unit=SECOND unit_seconds=1 requests_per_unit=5 algorithm=fixed_window burst=0 shadow_mode=false\n"+
+			"test-domain.remote_address: match=key unit=SECOND unit_seconds=1 requests_per_unit=1 algorithm=fixed_window burst=0 shadow_mode=false\n",
+		rlConfig.Dump())
+}
+
+func TestMatchPrefixConfig(t *testing.T) {
+	assert := assert.New(t)
+	stats := stats.NewStore(stats.NewNullSink(), false)
+	rlConfig, err := config.NewRateLimitConfigImpl(loadFile("match_prefix_config.yaml"), stats)
+	assert.NoError(err)
+
+	getLimit := func(entries ...*pb_struct.RateLimitDescriptor_Entry) *config.RateLimit {
+		return rlConfig.GetLimit(nil, "test-domain", &pb_struct.RateLimitDescriptor{Entries: entries})
+	}
+
+	// A match_prefix limit applies at its own depth and to deeper requests.
+	assert.EqualValues(10, getLimit(&pb_struct.RateLimitDescriptor_Entry{Key: "client", Value: "a"}).Limit.RequestsPerUnit)
+	rl := getLimit(
+		&pb_struct.RateLimitDescriptor_Entry{Key: "client", Value: "a"},
+		&pb_struct.RateLimitDescriptor_Entry{Key: "path", Value: "/other"},
+		&pb_struct.RateLimitDescriptor_Entry{Key: "method", Value: "GET"})
+	assert.EqualValues(10, rl.Limit.RequestsPerUnit)
+	assert.Equal("test-domain.client", rl.FullKey)
+	assert.Equal(1, rl.Depth)
+
+	// Deeper matches win over the match_prefix limit.
+	rl = getLimit(
+		&pb_struct.RateLimitDescriptor_Entry{Key: "client", Value: "a"},
+		&pb_struct.RateLimitDescriptor_Entry{Key: "path", Value: "/slow"})
+	assert.EqualValues(1, rl.Limit.RequestsPerUnit)
+	assert.Equal(2, rl.Depth)
+	rl = getLimit(
+		&pb_struct.RateLimitDescriptor_Entry{Key: "client", Value: "a"},
+		&pb_struct.RateLimitDescriptor_Entry{Key: "path", Value: "/free"})
+	assert.True(rl.Unlimited)
+
+	// A deeper match only counts at the request's full depth.
+	rl = getLimit(
+		&pb_struct.RateLimitDescriptor_Entry{Key: "client", Value: "a"},
+		&pb_struct.RateLimitDescriptor_Entry{Key: "path", Value: "/slow"},
+		&pb_struct.RateLimitDescriptor_Entry{Key: "method", Value: "GET"})
+	assert.EqualValues(10, rl.Limit.RequestsPerUnit)
+
+	// Limits without match_prefix keep requiring the same depth.
+	assert.Nil(getLimit(
+		&pb_struct.RateLimitDescriptor_Entry{Key: "server", Value: "a"},
+		&pb_struct.RateLimitDescriptor_Entry{Key: "path", Value: "/slow"}))
+
+	assert.Contains(
+		rlConfig.Dump(),
+		"test-domain.client: match=key match_prefix=true unit=SECOND unit_seconds=1 requests_per_unit=10 algorithm=fixed_window burst=0 shadow_mode=false\n")
+}
+
+func expectConfigError(t *testing.T, configs []config.RateLimitConfigToLoad, expectedError string) {
+	assert := assert.New(t)
+	rlConfig, err := config.NewRateLimitConfigImpl(configs, stats.NewStore(stats.NewNullSink(), false))
+	assert.Nil(rlConfig)
+	if assert.Error(err) {
+		assert.Equal(expectedError, err.Error())
+	}
 }
 
 func TestEmptyDomain(t *testing.T) {
-	expectConfigPanic(
+	expectConfigError(
 		t,
-		func() {
-			config.NewRateLimitConfigImpl(
-				loadFile("empty_domain.yaml"), stats.NewStore(stats.NewNullSink(), false))
-		},
+		loadFile("empty_domain.yaml"),
 		"empty_domain.yaml: config file cannot have empty domain")
 }
 
 func TestDuplicateDomain(t *testing.T) {
-	expectConfigPanic(
+	expectConfigError(
 		t,
-		func() {
-			files := loadFile("basic_config.yaml")
-			files = append(files, loadFile("duplicate_domain.yaml")...)
-			config.NewRateLimitConfigImpl(files, stats.NewStore(stats.NewNullSink(), false))
-		},
-		"duplicate_domain.yaml: duplicate domain 'test-domain' in config file")
+		append(loadFile("basic_config.yaml"), loadFile("duplicate_domain.yaml")...),
+		"duplicate_domain.yaml:1:9: duplicate domain 'test-domain' in config file")
 }
 
 func TestEmptyKey(t *testing.T) {
-	expectConfigPanic(
+	expectConfigError(
 		t,
-		func() {
-			config.NewRateLimitConfigImpl(
-				loadFile("empty_key.yaml"),
-				stats.NewStore(stats.NewNullSink(), false))
-		},
-		"empty_key.yaml: descriptor has empty key")
+		loadFile("empty_key.yaml"),
+		"empty_key.yaml:3:5: test-domain: descriptor has empty key")
 }
 
 func TestDuplicateKey(t *testing.T) {
-	expectConfigPanic(
+	expectConfigError(
 		t,
-		func() {
-			config.NewRateLimitConfigImpl(
-				loadFile("duplicate_key.yaml"),
-				stats.NewStore(stats.NewNullSink(), false))
-		},
-		"duplicate_key.yaml: duplicate descriptor composite key 'test-domain.key1_value1'")
+		loadFile("duplicate_key.yaml"),
+		"duplicate_key.yaml:6:5: test-domain.key1_value1: duplicate descriptor composite key")
 }
 
 func TestBadLimitUnit(t *testing.T) {
-	expectConfigPanic(
+	expectConfigError(
 		t,
-		func() {
-			config.NewRateLimitConfigImpl(
-				loadFile("bad_limit_unit.yaml"),
-				stats.NewStore(stats.NewNullSink(), false))
-		},
-		"bad_limit_unit.yaml: invalid rate limit unit 'foo'")
+		loadFile("bad_limit_unit.yaml"),
+		"bad_limit_unit.yaml:6:7: test-domain.key1_value1: invalid rate limit unit 'foo'")
+}
+
+func TestBadLimitWindow(t *testing.T) {
+	expectConfigError(
+		t,
+		loadFile("bad_limit_window.yaml"),
+		"bad_limit_window.yaml:6:7: test-domain.key1_value1: invalid rate limit unit '0m'")
+}
+
+func TestBadValueRegex(t *testing.T) {
+	expectConfigError(
+		t,
+		loadFile("bad_value_regex.yaml"),
+		"bad_value_regex.yaml:3:5: test-domain.key1: invalid value_regex 'user-[0-9': error parsing regexp: missing closing ]: `[0-9`")
+}
+
+func TestBadValueCIDR(t *testing.T) {
+	expectConfigError(
+		t,
+		loadFile("bad_value_cidr.yaml"),
+		"bad_value_cidr.yaml:3:5: test-domain.key1: invalid value_cidr '10.0.0.0/33': invalid CIDR address: 10.0.0.0/33")
+}
+
+func TestValueAndValueRegex(t *testing.T) {
+	expectConfigError(
+		t,
+		loadFile("value_and_value_regex.yaml"),
+		"value_and_value_regex.yaml:3:5: test-domain.key1: descriptor can only have one of value, value_regex and value_cidr")
+}
+
+func TestUnlimitedWithUnit(t *testing.T) {
+	expectConfigError(
+		t,
+		loadFile("unlimited_with_unit.yaml"),
+		"unlimited_with_unit.yaml:6:7: test-domain.key1_value1: unlimited rate limit cannot have any other settings")
+}
+
+func TestRateLimitAndRateLimits(t *testing.T) {
+	expectConfigError(
+		t,
+		loadFile("rate_limit_and_rate_limits.yaml"),
+		"rate_limit_and_rate_limits.yaml:3:5: test-domain.key1: descriptor cannot have both a rate_limit and rate_limits")
+}
+
+func TestMatchPrefixWithoutLimit(t *testing.T) {
+	expectConfigError(
+		t,
+		loadFile("match_prefix_without_limit.yaml"),
+		"match_prefix_without_limit.yaml:3:5: test-domain.key1: descriptor has match_prefix but no rate limit")
+}
+
+func TestBadAlgorithm(t *testing.T) {
+	expectConfigError(
+		t,
+		loadFile("bad_algorithm.yaml"),
+		"bad_algorithm.yaml:6:7: test-domain.key1_value1: invalid rate limit algorithm 'foo'")
+}
+
+func TestBadFailureMode(t *testing.T) {
+	expectConfigError(
+		t,
+		loadFile("bad_failure_mode.yaml"),
+		"bad_failure_mode.yaml:2:15: test-domain: invalid failure mode 'none'")
+}
+
+func TestBadBurst(t *testing.T) {
+	expectConfigError(
+		t,
+		loadFile("bad_burst.yaml"),
+		"bad_burst.yaml:6:7: test-domain.key1_value1: burst is not supported by rate limit algorithm 'fixed_window'")
+}
+
+func TestRateAndConcurrencyLimit(t *testing.T) {
+	expectConfigError(
+		t,
+		loadFile("rate_and_concurrency_limit.yaml"),
+		"rate_and_concurrency_limit.yaml:3:5: test-domain.key1: descriptor cannot have both a rate_limit and a concurrency_limit")
+}
+
+func TestRateLimitKeyCollision(t *testing.T) {
+	expectConfigError(
+		t,
+		loadFile("rate_limit_key_collision.yaml"),
+		"rate_limit_key_collision.yaml:11:5: test-domain.key1_value1#1: rate limit key 'test-domain.key1_value1#1' collides with another rate limit")
+}
+
+func TestZeroMaxInFlight(t *testing.T) {
+	expectConfigError(
+		t,
+		loadFile("zero_max_in_flight.yaml"),
+		"zero_max_in_flight.yaml:5:7: test-domain.key1: concurrency limit must have a max_in_flight greater than 0")
 }
 
 func TestBadYaml(t *testing.T) {
-	expectConfigPanic(
+	expectConfigError(
 		t,
-		func() {
-			config.NewRateLimitConfigImpl(
-				loadFile("bad_yaml.yaml"),
-				stats.NewStore(stats.NewNullSink(), false))
-		},
+		loadFile("bad_yaml.yaml"),
 		"bad_yaml.yaml: error loading config file: yaml: line 2: found unexpected end of stream")
 }
 
 func TestMisspelledKey(t *testing.T) {
-	expectConfigPanic(
+	expectConfigError(
 		t,
-		func() {
-			config.NewRateLimitConfigImpl(
-				loadFile("misspelled_key.yaml"),
-				stats.NewStore(stats.NewNullSink(), false))
-		},
-		"misspelled_key.yaml: config error, unknown key 'ratelimit'")
+		loadFile("misspelled_key.yaml"),
+		"misspelled_key.yaml:5:5: test-domain.key1_value1: config error, unknown key 'ratelimit'")
 
-	expectConfigPanic(
+	expectConfigError(
 		t,
-		func() {
-			config.NewRateLimitConfigImpl(
-				loadFile("misspelled_key2.yaml"),
-				stats.NewStore(stats.NewNullSink(), false))
-		},
-		"misspelled_key2.yaml: config error, unknown key 'requestsperunit'")
+		loadFile("misspelled_key2.yaml"),
+		"misspelled_key2.yaml:7:7: test-domain.key1_value1: config error, unknown key 'requestsperunit'")
 }
 
 func TestNonStringKey(t *testing.T) {
-	expectConfigPanic(
+	expectConfigError(
 		t,
-		func() {
-			config.NewRateLimitConfigImpl(
-				loadFile("non_string_key.yaml"),
-				stats.NewStore(stats.NewNullSink(), false))
-		},
-		"non_string_key.yaml: config error, key is not of type string: 0.25")
+		loadFile("non_string_key.yaml"),
+		"non_string_key.yaml:1:1: config error, key is not of type string: 0.25")
 }
 
 func TestNonMapList(t *testing.T) {
-	expectConfigPanic(
+	expectConfigError(
+		t,
+		loadFile("non_map_list.yaml"),
+		"non_map_list.yaml:3:5: test-domain: config error, yaml file contains list of type other than map: a")
+}
+
+func TestLimitTemplates(t *testing.T) {
+	assert := assert.New(t)
+	stats := stats.NewStore(stats.NewNullSink(), false)
+	files := append(loadFile("limit_templates.yaml"), loadFile("limit_templates_usage.yaml")...)
+	rlConfig, err := config.NewRateLimitConfigImpl(files, stats)
+	assert.NoError(err)
+	rlConfig.Dump()
+
+	rl := rlConfig.GetLimit(
+		nil, "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "tier", Value: "gold"}},
+		})
+	assert.EqualValues(6000, rl.Limit.RequestsPerUnit)
+	assert.Equal(pb.RateLimitResponse_RateLimit_MINUTE, rl.Limit.Unit)
+	assert.Equal(config.FixedWindow, rl.Algorithm)
+	rl.Stats.TotalHits.Inc()
+	assert.EqualValues(1, stats.NewCounter("test-domain.tier_gold.total_hits").Value())
+
+	rl = rlConfig.GetLimit(
+		nil, "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "tier", Value: "silver"}},
+		})
+	assert.EqualValues(600, rl.Limit.RequestsPerUnit)
+	assert.Equal(config.SlidingWindow, rl.Algorithm)
+
+	limits := rlConfig.GetLimits(
+		nil, "test-domain",
+		&pb_struct.RateLimitDescriptor{
+			Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "tier", Value: "bronze"}},
+		})
+	assert.Len(limits, 2)
+	assert.EqualValues(60, limits[0].Limit.RequestsPerUnit)
+	assert.Equal(pb.RateLimitResponse_RateLimit_MINUTE, limits[0].Limit.Unit)
+	assert.EqualValues(5, limits[1].Limit.RequestsPerUnit)
+	assert.Equal(pb.RateLimitResponse_RateLimit_SECOND, limits[1].Limit.Unit)
+}
+
+func TestUnknownLimitTemplate(t *testing.T) {
+	expectConfigError(
+		t,
+		loadFile("unknown_limit_template.yaml"),
+		"unknown_limit_template.yaml:6:7: test-domain.tier_gold: unknown limit template 'platinum_tier'")
+}
+
+func TestDuplicateLimitTemplate(t *testing.T) {
+	expectConfigError(
+		t,
+		append(loadFile("limit_templates.yaml"), loadFile("limit_templates.yaml")...),
+		"limit_templates.yaml:3:5: duplicate limit template 'gold_tier'")
+}
+
+func TestTemplateWithSettings(t *testing.T) {
+	expectConfigError(
 		t,
-		func() {
-			config.NewRateLimitConfigImpl(
-				loadFile("non_map_list.yaml"),
-				stats.NewStore(stats.NewNullSink(), false))
+		loadFile("template_with_settings.yaml"),
+		"template_with_settings.yaml:10:7: test-domain.tier_gold: rate limit using template 'gold_tier' cannot have any other settings")
+}
+
+func TestBadLimitTemplate(t *testing.T) {
+	expectConfigError(
+		t,
+		loadFile("bad_limit_template.yaml"),
+		"bad_limit_template.yaml:3:5: limit_templates.gold_tier: invalid rate limit unit 'fortnight'")
+}
+
+func TestBackends(t *testing.T) {
+	assert := assert.New(t)
+	stats := stats.NewStore(stats.NewNullSink(), false)
+
+	// Limits can name any backend the cache has.
+	rlConfig, err := config.NewRateLimitConfigImplForBackends(
+		loadFile("basic_config.yaml"), stats, []string{"default", "persistent"})
+	assert.NoError(err)
+	assert.NotNil(rlConfig)
+
+	// A limit naming a backend the cache does not have is rejected, even if the cache has no named backends.
+	for _, backends := range [][]string{{"default", "persistent"}, {}} {
+		_, err = config.NewRateLimitConfigImplForBackends(loadFile("unknown_backend.yaml"), stats, backends)
+		if assert.Error(err) {
+			assert.Equal(
+				"unknown_backend.yaml:8:11: test-domain.account.tier_gold: unknown cache backend 'persistant'",
+				err.Error())
+		}
+	}
+
+	_, err = config.NewRateLimitConfigImplForBackends(loadFile("unknown_template_backend.yaml"), stats, []string{})
+	if assert.Error(err) {
+		assert.Equal(
+			"unknown_template_backend.yaml:3:5: limit_templates.billing: unknown cache backend 'persistant'",
+			err.Error())
+	}
+
+	// The loader checks the backends it was created with.
+	_, err = config.NewRateLimitConfigLoaderImplForBackends([]string{"default"}).Load(
+		loadFile("basic_config.yaml"), stats)
+	assert.Error(err)
+	_, err = config.NewRateLimitConfigLoaderImpl().Load(loadFile("unknown_backend.yaml"), stats)
+	assert.NoError(err)
+}
+
+func TestAlgorithms(t *testing.T) {
+	assert := assert.New(t)
+	stats := stats.NewStore(stats.NewNullSink(), false)
+	algorithms := []config.RateLimitAlgorithm{config.FixedWindow, config.SlidingWindow}
+
+	// Limits using an algorithm the cache does not support are rejected.
+	_, err := config.NewRateLimitConfigImplForCache(
+		loadFile("basic_config.yaml"), stats, []string{"default", "persistent"}, algorithms)
+	if assert.Error(err) {
+		assert.Equal(
+			"basic_config.yaml:68:7: test-domain.key7: rate limit algorithm 'token_bucket' is not supported by the cache",
+			err.Error())
+	}
+
+	_, err = config.NewRateLimitConfigImplForCache(
+		loadFile("concurrency_limit_config.yaml"), stats, []string{}, algorithms)
+	if assert.Error(err) {
+		assert.Equal(
+			"concurrency_limit_config.yaml:11:7: test-domain.key2: concurrency limits are not supported by the cache",
+			err.Error())
+	}
+
+	_, err = config.NewRateLimitConfigImplForCache(
+		loadFile("unsupported_template_algorithm.yaml"), stats, []string{}, algorithms)
+	if assert.Error(err) {
+		assert.Equal(
+			"unsupported_template_algorithm.yaml:3:5: limit_templates.smooth: rate limit algorithm 'gcra' is not supported by the cache",
+			err.Error())
+	}
+
+	// Every algorithm is supported if none are given, and the loader checks the algorithms it was created with.
+	_, err = config.NewRateLimitConfigImplForCache(loadFile("concurrency_limit_config.yaml"), stats, []string{}, nil)
+	assert.NoError(err)
+	_, err = config.NewRateLimitConfigLoaderImplForCache([]string{}, algorithms).Load(
+		loadFile("concurrency_limit_config.yaml"), stats)
+	assert.Error(err)
+	_, err = config.NewRateLimitConfigLoaderImplForCache(
+		[]string{}, append(algorithms, config.Concurrency)).Load(loadFile("concurrency_limit_config.yaml"), stats)
+	assert.NoError(err)
+}
+
+func TestConfigErrorPosition(t *testing.T) {
+	assert := assert.New(t)
+	_, err := config.NewRateLimitConfigImpl(
+		loadFile("nested_misspelled_key.yaml"), stats.NewStore(stats.NewNullSink(), false))
+	assert.Equal(
+		config.RateLimitConfigError{
+			File:    "nested_misspelled_key.yaml",
+			Line:    13,
+			Column:  9,
+			Path:    "messaging.message_type_marketing.to_number_2061234567",
+			Message: "config error, unknown key 'rate_limts'",
 		},
-		"non_map_list.yaml: config error, yaml file contains list of type other than map: a")
+		err)
 }
@@ -48,6 +48,18 @@ func (mr *MockRateLimitConfigMockRecorder) Dump() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Dump", reflect.TypeOf((*MockRateLimitConfig)(nil).Dump))
 }
 
+// GetFailureMode mocks base method
+func (m *MockRateLimitConfig) GetFailureMode(arg0 string) config.FailureMode {
+	ret := m.ctrl.Call(m, "GetFailureMode", arg0)
+	ret0, _ := ret[0].(config.FailureMode)
+	return ret0
+}
+
+// GetFailureMode indicates an expected call of GetFailureMode
+func (mr *MockRateLimitConfigMockRecorder) GetFailureMode(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetFailureMode", reflect.TypeOf((*MockRateLimitConfig)(nil).GetFailureMode), arg0)
+}
+
 // GetLimit mocks base method
 func (m *MockRateLimitConfig) GetLimit(arg0 context.Context, arg1 string, arg2 *ratelimit.RateLimitDescriptor) *config.RateLimit {
 	ret := m.ctrl.Call(m, "GetLimit", arg0, arg1, arg2)
@@ -60,6 +72,18 @@ func (mr *MockRateLimitConfigMockRecorder) GetLimit(arg0, arg1, arg2 interface{}
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLimit", reflect.TypeOf((*MockRateLimitConfig)(nil).GetLimit), arg0, arg1, arg2)
 }
 
+// GetLimits mocks base method
+func (m *MockRateLimitConfig) GetLimits(arg0 context.Context, arg1 string, arg2 *ratelimit.RateLimitDescriptor) []*config.RateLimit {
+	ret := m.ctrl.Call(m, "GetLimits", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]*config.RateLimit)
+	return ret0
+}
+
+// GetLimits indicates an expected call of GetLimits
+func (mr *MockRateLimitConfigMockRecorder) GetLimits(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLimits", reflect.TypeOf((*MockRateLimitConfig)(nil).GetLimits), arg0, arg1, arg2)
+}
+
 // MockRateLimitConfigLoader is a mock of RateLimitConfigLoader interface
 type MockRateLimitConfigLoader struct {
 	ctrl     *gomock.Controller
@@ -84,10 +108,11 @@ func (m *MockRateLimitConfigLoader) EXPECT() *MockRateLimitConfigLoaderMockRecor
 }
 
 // Load mocks base method
-func (m *MockRateLimitConfigLoader) Load(arg0 []config.RateLimitConfigToLoad, arg1 gostats.Scope) config.RateLimitConfig {
+func (m *MockRateLimitConfigLoader) Load(arg0 []config.RateLimitConfigToLoad, arg1 gostats.Scope) (config.RateLimitConfig, error) {
 	ret := m.ctrl.Call(m, "Load", arg0, arg1)
 	ret0, _ := ret[0].(config.RateLimitConfig)
-	return ret0
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 // Load indicates an expected call of Load
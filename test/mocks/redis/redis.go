@@ -1,9 +1,12 @@
 // Automatically generated by MockGen. DO NOT EDIT!
-// Source: github.com/lyft/ratelimit/src/redis (interfaces: RateLimitCache,Pool,Connection,Response,TimeSource,JitterRandSource)
+// Source: github.com/lyft/ratelimit/src/redis (interfaces: RateLimitCache,Pool,Connection,Response,TimeSource,JitterRandSource,MemcachedClient)
 
 package mock_redis
 
 import (
+	time "time"
+
+	memcache "github.com/bradfitz/gomemcache/memcache"
 	ratelimit "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
 	gomock "github.com/golang/mock/gomock"
 	config "github.com/lyft/ratelimit/src/config"
@@ -32,14 +35,26 @@ func (_m *MockRateLimitCache) EXPECT() *_MockRateLimitCacheRecorder {
 	return _m.recorder
 }
 
-func (_m *MockRateLimitCache) DoLimit(_param0 context.Context, _param1 *ratelimit.RateLimitRequest, _param2 []*config.RateLimit) []*ratelimit.RateLimitResponse_DescriptorStatus {
-	ret := _m.ctrl.Call(_m, "DoLimit", _param0, _param1, _param2)
+func (_m *MockRateLimitCache) DoLimit(_param0 context.Context, _param1 *ratelimit.RateLimitRequest, _param2 []*config.RateLimit, _param3 string) ([]*ratelimit.RateLimitResponse_DescriptorStatus, error) {
+	ret := _m.ctrl.Call(_m, "DoLimit", _param0, _param1, _param2, _param3)
 	ret0, _ := ret[0].([]*ratelimit.RateLimitResponse_DescriptorStatus)
-	return ret0
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockRateLimitCacheRecorder) DoLimit(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "DoLimit", arg0, arg1, arg2, arg3)
+}
+
+func (_m *MockRateLimitCache) Release(_param0 context.Context, _param1 *ratelimit.RateLimitRequest, _param2 []*config.RateLimit, _param3 string) ([]*ratelimit.RateLimitResponse_DescriptorStatus, error) {
+	ret := _m.ctrl.Call(_m, "Release", _param0, _param1, _param2, _param3)
+	ret0, _ := ret[0].([]*ratelimit.RateLimitResponse_DescriptorStatus)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
-func (_mr *_MockRateLimitCacheRecorder) DoLimit(arg0, arg1, arg2 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCall(_mr.mock, "DoLimit", arg0, arg1, arg2)
+func (_mr *_MockRateLimitCacheRecorder) Release(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Release", arg0, arg1, arg2, arg3)
 }
 
 // Mock of Pool interface
@@ -63,10 +78,11 @@ func (_m *MockPool) EXPECT() *_MockPoolRecorder {
 	return _m.recorder
 }
 
-func (_m *MockPool) Get() redis.Connection {
+func (_m *MockPool) Get() (redis.Connection, error) {
 	ret := _m.ctrl.Call(_m, "Get")
 	ret0, _ := ret[0].(redis.Connection)
-	return ret0
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 func (_mr *_MockPoolRecorder) Get() *gomock.Call {
@@ -115,10 +131,19 @@ func (_mr *_MockConnectionRecorder) PipeAppend(arg0 interface{}, arg1 ...interfa
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "PipeAppend", _s...)
 }
 
-func (_m *MockConnection) PipeResponse() redis.Response {
+func (_m *MockConnection) SetDeadline(_param0 time.Time) {
+	_m.ctrl.Call(_m, "SetDeadline", _param0)
+}
+
+func (_mr *_MockConnectionRecorder) SetDeadline(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetDeadline", arg0)
+}
+
+func (_m *MockConnection) PipeResponse() (redis.Response, error) {
 	ret := _m.ctrl.Call(_m, "PipeResponse")
 	ret0, _ := ret[0].(redis.Response)
-	return ret0
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 func (_mr *_MockConnectionRecorder) PipeResponse() *gomock.Call {
@@ -146,10 +171,11 @@ func (_m *MockResponse) EXPECT() *_MockResponseRecorder {
 	return _m.recorder
 }
 
-func (_m *MockResponse) Int() int64 {
+func (_m *MockResponse) Int() (int64, error) {
 	ret := _m.ctrl.Call(_m, "Int")
 	ret0, _ := ret[0].(int64)
-	return ret0
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 func (_mr *_MockResponseRecorder) Int() *gomock.Call {
@@ -225,3 +251,56 @@ func (_m *MockJitterRandSource) Seed(_param0 int64) {
 func (_mr *_MockJitterRandSourceRecorder) Seed(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Seed", arg0)
 }
+
+// Mock of MemcachedClient interface
+type MockMemcachedClient struct {
+	ctrl     *gomock.Controller
+	recorder *_MockMemcachedClientRecorder
+}
+
+// Recorder for MockMemcachedClient (not exported)
+type _MockMemcachedClientRecorder struct {
+	mock *MockMemcachedClient
+}
+
+func NewMockMemcachedClient(ctrl *gomock.Controller) *MockMemcachedClient {
+	mock := &MockMemcachedClient{ctrl: ctrl}
+	mock.recorder = &_MockMemcachedClientRecorder{mock}
+	return mock
+}
+
+func (_m *MockMemcachedClient) EXPECT() *_MockMemcachedClientRecorder {
+	return _m.recorder
+}
+
+func (_m *MockMemcachedClient) Increment(_param0 string, _param1 uint64) (uint64, error) {
+	ret := _m.ctrl.Call(_m, "Increment", _param0, _param1)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMemcachedClientRecorder) Increment(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Increment", arg0, arg1)
+}
+
+func (_m *MockMemcachedClient) Add(_param0 *memcache.Item) error {
+	ret := _m.ctrl.Call(_m, "Add", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockMemcachedClientRecorder) Add(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Add", arg0)
+}
+
+func (_m *MockMemcachedClient) Get(_param0 string) (*memcache.Item, error) {
+	ret := _m.ctrl.Call(_m, "Get", _param0)
+	ret0, _ := ret[0].(*memcache.Item)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockMemcachedClientRecorder) Get(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Get", arg0)
+}
@@ -2,6 +2,7 @@ package redis_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/coocood/freecache"
 
@@ -16,8 +17,29 @@ import (
 	"github.com/lyft/ratelimit/test/common"
 	mock_redis "github.com/lyft/ratelimit/test/mocks/redis"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 )
 
+// Call DoLimit and check that it succeeds.
+func doLimit(
+	assert *assert.Assertions, cache redis.RateLimitCache, request *pb.RateLimitRequest,
+	limits []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
+
+	statuses, err := cache.DoLimit(nil, request, limits, "")
+	assert.NoError(err)
+	return statuses
+}
+
+// Call Release and check that it succeeds.
+func release(
+	assert *assert.Assertions, cache redis.RateLimitCache, request *pb.RateLimitRequest,
+	limits []*config.RateLimit, leaseID string) []*pb.RateLimitResponse_DescriptorStatus {
+
+	statuses, err := cache.Release(nil, request, limits, leaseID)
+	assert.NoError(err)
+	return statuses
+}
+
 func TestRedis(t *testing.T) {
 	t.Run("WithoutPerSecondRedis", testRedis(false))
 	t.Run("WithPerSecondRedis", testRedis(true))
@@ -45,9 +67,11 @@ func testRedis(usePerSecondRedis bool) func(*testing.T) {
 		}
 
 		if usePerSecondRedis {
-			perSecondPool.EXPECT().Get().Return(perSecondConnection)
+			perSecondPool.EXPECT().Get().Return(perSecondConnection, nil)
+			perSecondConnection.EXPECT().SetDeadline(time.Time{})
 		} else {
-			pool.EXPECT().Get().Return(connection)
+			pool.EXPECT().Get().Return(connection, nil)
+			connection.EXPECT().SetDeadline(time.Time{})
 		}
 		timeSource.EXPECT().UnixNow().Return(int64(1234))
 		var connUsed *mock_redis.MockConnection
@@ -58,8 +82,8 @@ func testRedis(usePerSecondRedis bool) func(*testing.T) {
 		}
 		connUsed.EXPECT().PipeAppend("INCRBY", "domain_key_value_1234", uint32(1))
 		connUsed.EXPECT().PipeAppend("EXPIRE", "domain_key_value_1234", int64(1))
-		connUsed.EXPECT().PipeResponse().Return(response)
-		response.EXPECT().Int().Return(int64(5))
+		connUsed.EXPECT().PipeResponse().Return(response, nil)
+		response.EXPECT().Int().Return(int64(5), nil)
 		connUsed.EXPECT().PipeResponse()
 		if usePerSecondRedis {
 			perSecondPool.EXPECT().Put(perSecondConnection)
@@ -72,18 +96,19 @@ func testRedis(usePerSecondRedis bool) func(*testing.T) {
 
 		assert.Equal(
 			[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 5}},
-			cache.DoLimit(nil, request, limits))
+			doLimit(assert, cache, request, limits))
 		assert.Equal(uint64(1), limits[0].Stats.TotalHits.Value())
 		assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
 		assert.Equal(uint64(0), limits[0].Stats.NearLimit.Value())
 
-		pool.EXPECT().Get().Return(connection)
+		pool.EXPECT().Get().Return(connection, nil)
+		connection.EXPECT().SetDeadline(time.Time{})
 		timeSource.EXPECT().UnixNow().Return(int64(1234))
 		connection.EXPECT().PipeAppend("INCRBY", "domain_key2_value2_subkey2_subvalue2_1200", uint32(1))
 		connection.EXPECT().PipeAppend(
 			"EXPIRE", "domain_key2_value2_subkey2_subvalue2_1200", int64(60))
-		connection.EXPECT().PipeResponse().Return(response)
-		response.EXPECT().Int().Return(int64(11))
+		connection.EXPECT().PipeResponse().Return(response, nil)
+		response.EXPECT().Int().Return(int64(11), nil)
 		connection.EXPECT().PipeResponse()
 		pool.EXPECT().Put(connection)
 
@@ -99,12 +124,13 @@ func testRedis(usePerSecondRedis bool) func(*testing.T) {
 		assert.Equal(
 			[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0},
 				{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[1].Limit, LimitRemaining: 0}},
-			cache.DoLimit(nil, request, limits))
+			doLimit(assert, cache, request, limits))
 		assert.Equal(uint64(1), limits[1].Stats.TotalHits.Value())
 		assert.Equal(uint64(1), limits[1].Stats.OverLimit.Value())
 		assert.Equal(uint64(0), limits[1].Stats.NearLimit.Value())
 
-		pool.EXPECT().Get().Return(connection)
+		pool.EXPECT().Get().Return(connection, nil)
+		connection.EXPECT().SetDeadline(time.Time{})
 		timeSource.EXPECT().UnixNow().Return(int64(1000000))
 		connection.EXPECT().PipeAppend("INCRBY", "domain_key3_value3_997200", uint32(1))
 		connection.EXPECT().PipeAppend(
@@ -112,11 +138,11 @@ func testRedis(usePerSecondRedis bool) func(*testing.T) {
 		connection.EXPECT().PipeAppend("INCRBY", "domain_key3_value3_subkey3_subvalue3_950400", uint32(1))
 		connection.EXPECT().PipeAppend(
 			"EXPIRE", "domain_key3_value3_subkey3_subvalue3_950400", int64(86400))
-		connection.EXPECT().PipeResponse().Return(response)
-		response.EXPECT().Int().Return(int64(11))
+		connection.EXPECT().PipeResponse().Return(response, nil)
+		response.EXPECT().Int().Return(int64(11), nil)
 		connection.EXPECT().PipeResponse()
-		connection.EXPECT().PipeResponse().Return(response)
-		response.EXPECT().Int().Return(int64(13))
+		connection.EXPECT().PipeResponse().Return(response, nil)
+		response.EXPECT().Int().Return(int64(13), nil)
 		connection.EXPECT().PipeResponse()
 		pool.EXPECT().Put(connection)
 
@@ -133,7 +159,7 @@ func testRedis(usePerSecondRedis bool) func(*testing.T) {
 			[]*pb.RateLimitResponse_DescriptorStatus{
 				{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0},
 				{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[1].Limit, LimitRemaining: 0}},
-			cache.DoLimit(nil, request, limits))
+			doLimit(assert, cache, request, limits))
 		assert.Equal(uint64(1), limits[0].Stats.TotalHits.Value())
 		assert.Equal(uint64(1), limits[0].Stats.OverLimit.Value())
 		assert.Equal(uint64(0), limits[0].Stats.NearLimit.Value())
@@ -197,13 +223,14 @@ func TestOverLimitWithLocalCache(t *testing.T) {
 	localCacheStats := redis.NewLocalCacheStats(localCache, statsStore.Scope("localcache"))
 
 	// Test Near Limit Stats. Under Near Limit Ratio
-	pool.EXPECT().Get().Return(connection)
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
 	timeSource.EXPECT().UnixNow().Return(int64(1000000))
 	connection.EXPECT().PipeAppend("INCRBY", "domain_key4_value4_997200", uint32(1))
 	connection.EXPECT().PipeAppend(
 		"EXPIRE", "domain_key4_value4_997200", int64(3600))
-	connection.EXPECT().PipeResponse().Return(response)
-	response.EXPECT().Int().Return(int64(11))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(11), nil)
 	connection.EXPECT().PipeResponse()
 	pool.EXPECT().Put(connection)
 
@@ -215,7 +242,7 @@ func TestOverLimitWithLocalCache(t *testing.T) {
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{
 			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 4}},
-		cache.DoLimit(nil, request, limits))
+		doLimit(assert, cache, request, limits))
 	assert.Equal(uint64(1), limits[0].Stats.TotalHits.Value())
 	assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
 	assert.Equal(uint64(0), limits[0].Stats.OverLimitWithLocalCache.Value())
@@ -225,20 +252,21 @@ func TestOverLimitWithLocalCache(t *testing.T) {
 	testLocalCacheStats(localCacheStats, statsStore, sink, 0, 1, 1, 0, 0)
 
 	// Test Near Limit Stats. At Near Limit Ratio, still OK
-	pool.EXPECT().Get().Return(connection)
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
 	timeSource.EXPECT().UnixNow().Return(int64(1000000))
 	connection.EXPECT().PipeAppend("INCRBY", "domain_key4_value4_997200", uint32(1))
 	connection.EXPECT().PipeAppend(
 		"EXPIRE", "domain_key4_value4_997200", int64(3600))
-	connection.EXPECT().PipeResponse().Return(response)
-	response.EXPECT().Int().Return(int64(13))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(13), nil)
 	connection.EXPECT().PipeResponse()
 	pool.EXPECT().Put(connection)
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{
 			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 2}},
-		cache.DoLimit(nil, request, limits))
+		doLimit(assert, cache, request, limits))
 	assert.Equal(uint64(2), limits[0].Stats.TotalHits.Value())
 	assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
 	assert.Equal(uint64(0), limits[0].Stats.OverLimitWithLocalCache.Value())
@@ -248,20 +276,21 @@ func TestOverLimitWithLocalCache(t *testing.T) {
 	testLocalCacheStats(localCacheStats, statsStore, sink, 0, 2, 2, 0, 0)
 
 	// Test Over limit stats
-	pool.EXPECT().Get().Return(connection)
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
 	timeSource.EXPECT().UnixNow().Return(int64(1000000))
 	connection.EXPECT().PipeAppend("INCRBY", "domain_key4_value4_997200", uint32(1))
 	connection.EXPECT().PipeAppend(
 		"EXPIRE", "domain_key4_value4_997200", int64(3600))
-	connection.EXPECT().PipeResponse().Return(response)
-	response.EXPECT().Int().Return(int64(16))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(16), nil)
 	connection.EXPECT().PipeResponse()
 	pool.EXPECT().Put(connection)
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{
 			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0}},
-		cache.DoLimit(nil, request, limits))
+		doLimit(assert, cache, request, limits))
 	assert.Equal(uint64(3), limits[0].Stats.TotalHits.Value())
 	assert.Equal(uint64(1), limits[0].Stats.OverLimit.Value())
 	assert.Equal(uint64(0), limits[0].Stats.OverLimitWithLocalCache.Value())
@@ -275,7 +304,7 @@ func TestOverLimitWithLocalCache(t *testing.T) {
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{
 			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0}},
-		cache.DoLimit(nil, request, limits))
+		doLimit(assert, cache, request, limits))
 	assert.Equal(uint64(4), limits[0].Stats.TotalHits.Value())
 	assert.Equal(uint64(2), limits[0].Stats.OverLimit.Value())
 	assert.Equal(uint64(1), limits[0].Stats.OverLimitWithLocalCache.Value())
@@ -299,13 +328,14 @@ func TestNearLimit(t *testing.T) {
 	cache := redis.NewRateLimitCacheImpl(pool, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, latencyStat)
 
 	// Test Near Limit Stats. Under Near Limit Ratio
-	pool.EXPECT().Get().Return(connection)
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
 	timeSource.EXPECT().UnixNow().Return(int64(1000000))
 	connection.EXPECT().PipeAppend("INCRBY", "domain_key4_value4_997200", uint32(1))
 	connection.EXPECT().PipeAppend(
 		"EXPIRE", "domain_key4_value4_997200", int64(3600))
-	connection.EXPECT().PipeResponse().Return(response)
-	response.EXPECT().Int().Return(int64(11))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(11), nil)
 	connection.EXPECT().PipeResponse()
 	pool.EXPECT().Put(connection)
 
@@ -317,58 +347,61 @@ func TestNearLimit(t *testing.T) {
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{
 			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 4}},
-		cache.DoLimit(nil, request, limits))
+		doLimit(assert, cache, request, limits))
 	assert.Equal(uint64(1), limits[0].Stats.TotalHits.Value())
 	assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
 	assert.Equal(uint64(0), limits[0].Stats.NearLimit.Value())
 
 	// Test Near Limit Stats. At Near Limit Ratio, still OK
-	pool.EXPECT().Get().Return(connection)
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
 	timeSource.EXPECT().UnixNow().Return(int64(1000000))
 	connection.EXPECT().PipeAppend("INCRBY", "domain_key4_value4_997200", uint32(1))
 	connection.EXPECT().PipeAppend(
 		"EXPIRE", "domain_key4_value4_997200", int64(3600))
-	connection.EXPECT().PipeResponse().Return(response)
-	response.EXPECT().Int().Return(int64(13))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(13), nil)
 	connection.EXPECT().PipeResponse()
 	pool.EXPECT().Put(connection)
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{
 			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 2}},
-		cache.DoLimit(nil, request, limits))
+		doLimit(assert, cache, request, limits))
 	assert.Equal(uint64(2), limits[0].Stats.TotalHits.Value())
 	assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
 	assert.Equal(uint64(1), limits[0].Stats.NearLimit.Value())
 
 	// Test Near Limit Stats. We went OVER_LIMIT, but the near_limit counter only increases
 	// when we are near limit, not after we have passed the limit.
-	pool.EXPECT().Get().Return(connection)
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
 	timeSource.EXPECT().UnixNow().Return(int64(1000000))
 	connection.EXPECT().PipeAppend("INCRBY", "domain_key4_value4_997200", uint32(1))
 	connection.EXPECT().PipeAppend(
 		"EXPIRE", "domain_key4_value4_997200", int64(3600))
-	connection.EXPECT().PipeResponse().Return(response)
-	response.EXPECT().Int().Return(int64(16))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(16), nil)
 	connection.EXPECT().PipeResponse()
 	pool.EXPECT().Put(connection)
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{
 			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0}},
-		cache.DoLimit(nil, request, limits))
+		doLimit(assert, cache, request, limits))
 	assert.Equal(uint64(3), limits[0].Stats.TotalHits.Value())
 	assert.Equal(uint64(1), limits[0].Stats.OverLimit.Value())
 	assert.Equal(uint64(1), limits[0].Stats.NearLimit.Value())
 
 	// Now test hitsAddend that is greater than 1
 	// All of it under limit, under near limit
-	pool.EXPECT().Get().Return(connection)
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
 	timeSource.EXPECT().UnixNow().Return(int64(1234))
 	connection.EXPECT().PipeAppend("INCRBY", "domain_key5_value5_1234", uint32(3))
 	connection.EXPECT().PipeAppend("EXPIRE", "domain_key5_value5_1234", int64(1))
-	connection.EXPECT().PipeResponse().Return(response)
-	response.EXPECT().Int().Return(int64(5))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(5), nil)
 	connection.EXPECT().PipeResponse()
 	pool.EXPECT().Put(connection)
 
@@ -377,18 +410,19 @@ func TestNearLimit(t *testing.T) {
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 15}},
-		cache.DoLimit(nil, request, limits))
+		doLimit(assert, cache, request, limits))
 	assert.Equal(uint64(3), limits[0].Stats.TotalHits.Value())
 	assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
 	assert.Equal(uint64(0), limits[0].Stats.NearLimit.Value())
 
 	// All of it under limit, some over near limit
-	pool.EXPECT().Get().Return(connection)
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
 	timeSource.EXPECT().UnixNow().Return(int64(1234))
 	connection.EXPECT().PipeAppend("INCRBY", "domain_key6_value6_1234", uint32(2))
 	connection.EXPECT().PipeAppend("EXPIRE", "domain_key6_value6_1234", int64(1))
-	connection.EXPECT().PipeResponse().Return(response)
-	response.EXPECT().Int().Return(int64(7))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(7), nil)
 	connection.EXPECT().PipeResponse()
 	pool.EXPECT().Put(connection)
 
@@ -397,18 +431,19 @@ func TestNearLimit(t *testing.T) {
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 1}},
-		cache.DoLimit(nil, request, limits))
+		doLimit(assert, cache, request, limits))
 	assert.Equal(uint64(2), limits[0].Stats.TotalHits.Value())
 	assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
 	assert.Equal(uint64(1), limits[0].Stats.NearLimit.Value())
 
 	// All of it under limit, all of it over near limit
-	pool.EXPECT().Get().Return(connection)
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
 	timeSource.EXPECT().UnixNow().Return(int64(1234))
 	connection.EXPECT().PipeAppend("INCRBY", "domain_key7_value7_1234", uint32(3))
 	connection.EXPECT().PipeAppend("EXPIRE", "domain_key7_value7_1234", int64(1))
-	connection.EXPECT().PipeResponse().Return(response)
-	response.EXPECT().Int().Return(int64(19))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(19), nil)
 	connection.EXPECT().PipeResponse()
 	pool.EXPECT().Put(connection)
 
@@ -417,18 +452,19 @@ func TestNearLimit(t *testing.T) {
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 1}},
-		cache.DoLimit(nil, request, limits))
+		doLimit(assert, cache, request, limits))
 	assert.Equal(uint64(3), limits[0].Stats.TotalHits.Value())
 	assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
 	assert.Equal(uint64(3), limits[0].Stats.NearLimit.Value())
 
 	// Some of it over limit, all of it over near limit
-	pool.EXPECT().Get().Return(connection)
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
 	timeSource.EXPECT().UnixNow().Return(int64(1234))
 	connection.EXPECT().PipeAppend("INCRBY", "domain_key8_value8_1234", uint32(3))
 	connection.EXPECT().PipeAppend("EXPIRE", "domain_key8_value8_1234", int64(1))
-	connection.EXPECT().PipeResponse().Return(response)
-	response.EXPECT().Int().Return(int64(22))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(22), nil)
 	connection.EXPECT().PipeResponse()
 	pool.EXPECT().Put(connection)
 
@@ -437,18 +473,19 @@ func TestNearLimit(t *testing.T) {
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0}},
-		cache.DoLimit(nil, request, limits))
+		doLimit(assert, cache, request, limits))
 	assert.Equal(uint64(3), limits[0].Stats.TotalHits.Value())
 	assert.Equal(uint64(2), limits[0].Stats.OverLimit.Value())
 	assert.Equal(uint64(1), limits[0].Stats.NearLimit.Value())
 
 	// Some of it in all three places
-	pool.EXPECT().Get().Return(connection)
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
 	timeSource.EXPECT().UnixNow().Return(int64(1234))
 	connection.EXPECT().PipeAppend("INCRBY", "domain_key9_value9_1234", uint32(7))
 	connection.EXPECT().PipeAppend("EXPIRE", "domain_key9_value9_1234", int64(1))
-	connection.EXPECT().PipeResponse().Return(response)
-	response.EXPECT().Int().Return(int64(22))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(22), nil)
 	connection.EXPECT().PipeResponse()
 	pool.EXPECT().Put(connection)
 
@@ -457,18 +494,19 @@ func TestNearLimit(t *testing.T) {
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0}},
-		cache.DoLimit(nil, request, limits))
+		doLimit(assert, cache, request, limits))
 	assert.Equal(uint64(7), limits[0].Stats.TotalHits.Value())
 	assert.Equal(uint64(2), limits[0].Stats.OverLimit.Value())
 	assert.Equal(uint64(4), limits[0].Stats.NearLimit.Value())
 
 	// all of it over limit
-	pool.EXPECT().Get().Return(connection)
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
 	timeSource.EXPECT().UnixNow().Return(int64(1234))
 	connection.EXPECT().PipeAppend("INCRBY", "domain_key10_value10_1234", uint32(3))
 	connection.EXPECT().PipeAppend("EXPIRE", "domain_key10_value10_1234", int64(1))
-	connection.EXPECT().PipeResponse().Return(response)
-	response.EXPECT().Int().Return(int64(30))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(30), nil)
 	connection.EXPECT().PipeResponse()
 	pool.EXPECT().Put(connection)
 
@@ -477,7 +515,7 @@ func TestNearLimit(t *testing.T) {
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0}},
-		cache.DoLimit(nil, request, limits))
+		doLimit(assert, cache, request, limits))
 	assert.Equal(uint64(3), limits[0].Stats.TotalHits.Value())
 	assert.Equal(uint64(3), limits[0].Stats.OverLimit.Value())
 	assert.Equal(uint64(0), limits[0].Stats.NearLimit.Value())
@@ -497,13 +535,14 @@ func TestRedisWithJitter(t *testing.T) {
 	latencyStat := statsStore.Scope("cache")
 	cache := redis.NewRateLimitCacheImpl(pool, nil, timeSource, rand.New(jitterSource), 3600, nil, latencyStat)
 
-	pool.EXPECT().Get().Return(connection)
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
 	timeSource.EXPECT().UnixNow().Return(int64(1234))
 	jitterSource.EXPECT().Int63().Return(int64(100))
 	connection.EXPECT().PipeAppend("INCRBY", "domain_key_value_1234", uint32(1))
 	connection.EXPECT().PipeAppend("EXPIRE", "domain_key_value_1234", int64(101))
-	connection.EXPECT().PipeResponse().Return(response)
-	response.EXPECT().Int().Return(int64(5))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(5), nil)
 	connection.EXPECT().PipeResponse()
 	pool.EXPECT().Put(connection)
 
@@ -512,8 +551,843 @@ func TestRedisWithJitter(t *testing.T) {
 
 	assert.Equal(
 		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 5}},
-		cache.DoLimit(nil, request, limits))
+		doLimit(assert, cache, request, limits))
 	assert.Equal(uint64(1), limits[0].Stats.TotalHits.Value())
 	assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
 	assert.Equal(uint64(0), limits[0].Stats.NearLimit.Value())
 }
+
+func TestCustomWindow(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	pool := mock_redis.NewMockPool(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	connection := mock_redis.NewMockConnection(controller)
+	response := mock_redis.NewMockResponse(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewRateLimitCacheImpl(pool, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	// A 15 minute window is bucketed and expired on 900 second boundaries.
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connection.EXPECT().PipeAppend("INCRBY", "domain_key_value_900", uint32(1))
+	connection.EXPECT().PipeAppend("EXPIRE", "domain_key_value_900", int64(900))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(5), nil)
+	connection.EXPECT().PipeResponse()
+	pool.EXPECT().Put(connection)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimitWithWindow(10, 15*60, "key_value", statsStore)}
+
+	assert.Equal(pb.RateLimitResponse_RateLimit_MINUTE, limits[0].Limit.Unit)
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 5}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(1), limits[0].Stats.TotalHits.Value())
+	assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
+}
+
+func TestShadowMode(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	pool := mock_redis.NewMockPool(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	connection := mock_redis.NewMockConnection(controller)
+	response := mock_redis.NewMockResponse(controller)
+	localCache := freecache.NewCache(100)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewRateLimitCacheImpl(pool, nil, timeSource, rand.New(rand.NewSource(1)), 0, localCache, statsStore.Scope("cache"))
+
+	// Over the limit hits are counted but let through.
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connection.EXPECT().PipeAppend("INCRBY", "domain_key_value_1234", uint32(3))
+	connection.EXPECT().PipeAppend("EXPIRE", "domain_key_value_1234", int64(1))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(12), nil)
+	connection.EXPECT().PipeResponse()
+	pool.EXPECT().Put(connection)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 3)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, "key_value", statsStore)}
+	limits[0].ShadowMode = true
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 0}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(3), limits[0].Stats.TotalHits.Value())
+	assert.Equal(uint64(2), limits[0].Stats.OverLimit.Value())
+	assert.Equal(uint64(2), limits[0].Stats.ShadowMode.Value())
+	assert.Equal(uint64(1), limits[0].Stats.NearLimit.Value())
+
+	// The local cache is not used, so the next hit is still counted in redis.
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connection.EXPECT().PipeAppend("INCRBY", "domain_key_value_1234", uint32(3))
+	connection.EXPECT().PipeAppend("EXPIRE", "domain_key_value_1234", int64(1))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(15), nil)
+	connection.EXPECT().PipeResponse()
+	pool.EXPECT().Put(connection)
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 0}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(5), limits[0].Stats.OverLimit.Value())
+	assert.Equal(uint64(5), limits[0].Stats.ShadowMode.Value())
+	assert.Equal(uint64(0), limits[0].Stats.OverLimitWithLocalCache.Value())
+}
+
+func TestUnlimited(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	pool := mock_redis.NewMockPool(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewRateLimitCacheImpl(pool, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	// Unlimited rules never touch redis.
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 3)
+	limits := []*config.RateLimit{config.NewUnlimitedRateLimit("key_value", statsStore)}
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(3), limits[0].Stats.TotalHits.Value())
+	assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
+}
+
+func TestMultipleLimitsCacheKeys(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	pool := mock_redis.NewMockPool(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	connection := mock_redis.NewMockConnection(controller)
+	response := mock_redis.NewMockResponse(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewRateLimitCacheImpl(pool, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	// Limits on the same descriptor with the same window are counted under different keys.
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connection.EXPECT().PipeAppend("INCRBY", "domain_key_value_1234", uint32(1))
+	connection.EXPECT().PipeAppend("EXPIRE", "domain_key_value_1234", int64(1))
+	connection.EXPECT().PipeAppend("INCRBY", "domain_key_value_#1_1234", uint32(1))
+	connection.EXPECT().PipeAppend("EXPIRE", "domain_key_value_#1_1234", int64(1))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(5), nil)
+	connection.EXPECT().PipeResponse()
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(21), nil)
+	connection.EXPECT().PipeResponse()
+	pool.EXPECT().Put(connection)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}, {{"key", "value"}}}, 1)
+	limits := []*config.RateLimit{
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, "key_value", statsStore),
+		config.NewRateLimit(20, pb.RateLimitResponse_RateLimit_SECOND, "key_value#1", statsStore)}
+	limits[1].Index = 1
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 5},
+			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[1].Limit, LimitRemaining: 0}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
+	assert.Equal(uint64(1), limits[1].Stats.OverLimit.Value())
+
+	// A '#' in a request value is doubled so that the key cannot collide with the key of a further limit.
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connection.EXPECT().PipeAppend("INCRBY", "domain_key_value_##1_1234", uint32(1))
+	connection.EXPECT().PipeAppend("EXPIRE", "domain_key_value_##1_1234", int64(1))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(1), nil)
+	connection.EXPECT().PipeResponse()
+	pool.EXPECT().Put(connection)
+
+	request = common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value_#1"}}}, 1)
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 9}},
+		doLimit(assert, cache, request, limits[:1]))
+}
+
+func TestAggregate(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	pool := mock_redis.NewMockPool(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	connection := mock_redis.NewMockConnection(controller)
+	response := mock_redis.NewMockResponse(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewRateLimitCacheImpl(pool, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	// Different values of an aggregate limit share the key built from the limit's full key.
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connection.EXPECT().PipeAppend("INCRBY", "domain.database_1234", uint32(1)).Times(2)
+	connection.EXPECT().PipeAppend("EXPIRE", "domain.database_1234", int64(1)).Times(2)
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(1), nil)
+	connection.EXPECT().PipeResponse()
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(2), nil)
+	connection.EXPECT().PipeResponse()
+	pool.EXPECT().Put(connection)
+
+	request := common.NewRateLimitRequest(
+		"domain", [][][2]string{{{"database", "users"}}, {{"database", "orders"}}}, 1)
+	limit := config.NewRateLimit(500, pb.RateLimitResponse_RateLimit_SECOND, "domain.database", statsStore)
+	limit.Aggregate = true
+	limits := []*config.RateLimit{limit, limit}
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limit.Limit, LimitRemaining: 499},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limit.Limit, LimitRemaining: 498}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(2), limit.Stats.TotalHits.Value())
+}
+
+func TestMatchPrefix(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	pool := mock_redis.NewMockPool(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	connection := mock_redis.NewMockConnection(controller)
+	response := mock_redis.NewMockResponse(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewRateLimitCacheImpl(pool, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	// A match_prefix limit counts the entries its descriptor matched and ignores the ones after them.
+	request := common.NewRateLimitRequest(
+		"domain", [][][2]string{{{"key", "value"}, {"subkey", "a"}}, {{"key", "value"}, {"subkey", "b"}}}, 1)
+	limit := config.NewRateLimit(300, pb.RateLimitResponse_RateLimit_SECOND, "domain.key", statsStore)
+	limit.Depth = 1
+	limits := []*config.RateLimit{limit, limit}
+
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connection.EXPECT().PipeAppend("INCRBY", "domain_key_value_1234", uint32(1)).Times(2)
+	connection.EXPECT().PipeAppend("EXPIRE", "domain_key_value_1234", int64(1)).Times(2)
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(1), nil)
+	connection.EXPECT().PipeResponse()
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(2), nil)
+	connection.EXPECT().PipeResponse()
+	pool.EXPECT().Put(connection)
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limit.Limit, LimitRemaining: 299},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limit.Limit, LimitRemaining: 298}},
+		doLimit(assert, cache, request, limits))
+
+	// The matched value is still part of the key, so each value is counted separately.
+	request = common.NewRateLimitRequest(
+		"domain", [][][2]string{{{"key", "a"}, {"subkey", "a"}}, {{"key", "b"}, {"subkey", "a"}}}, 1)
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connection.EXPECT().PipeAppend("INCRBY", "domain_key_a_1234", uint32(1))
+	connection.EXPECT().PipeAppend("EXPIRE", "domain_key_a_1234", int64(1))
+	connection.EXPECT().PipeAppend("INCRBY", "domain_key_b_1234", uint32(1))
+	connection.EXPECT().PipeAppend("EXPIRE", "domain_key_b_1234", int64(1))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(1), nil)
+	connection.EXPECT().PipeResponse()
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(1), nil)
+	connection.EXPECT().PipeResponse()
+	pool.EXPECT().Put(connection)
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limit.Limit, LimitRemaining: 299},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limit.Limit, LimitRemaining: 299}},
+		doLimit(assert, cache, request, limits))
+
+	// With aggregate, every value shares one counter.
+	limit.Aggregate = true
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connection.EXPECT().PipeAppend("INCRBY", "domain.key_1234", uint32(1)).Times(2)
+	connection.EXPECT().PipeAppend("EXPIRE", "domain.key_1234", int64(1)).Times(2)
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(1), nil)
+	connection.EXPECT().PipeResponse()
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(2), nil)
+	connection.EXPECT().PipeResponse()
+	pool.EXPECT().Put(connection)
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limit.Limit, LimitRemaining: 299},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limit.Limit, LimitRemaining: 298}},
+		doLimit(assert, cache, request, limits))
+}
+
+func TestSlidingWindow(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	pool := mock_redis.NewMockPool(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	connection := mock_redis.NewMockConnection(controller)
+	response := mock_redis.NewMockResponse(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewRateLimitCacheImpl(pool, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	// 34 seconds into the window, so 26/60 of the previous window's count still applies.
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connection.EXPECT().PipeAppend("INCRBY", "domain_key_value_1200", uint32(1))
+	connection.EXPECT().PipeAppend("EXPIRE", "domain_key_value_1200", int64(120))
+	connection.EXPECT().PipeAppend("GET", "domain_key_value_1140")
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(5), nil)
+	connection.EXPECT().PipeResponse()
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(10), nil)
+	pool.EXPECT().Put(connection)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, "key_value", statsStore)}
+	limits[0].Algorithm = config.SlidingWindow
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 1}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(1), limits[0].Stats.TotalHits.Value())
+	assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
+	assert.Equal(uint64(1), limits[0].Stats.NearLimit.Value())
+
+	// Early in the next window the previous window is still mostly counted.
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1266))
+	connection.EXPECT().PipeAppend("INCRBY", "domain_key_value_1260", uint32(1))
+	connection.EXPECT().PipeAppend("EXPIRE", "domain_key_value_1260", int64(120))
+	connection.EXPECT().PipeAppend("GET", "domain_key_value_1200")
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(1), nil)
+	connection.EXPECT().PipeResponse()
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(12), nil)
+	pool.EXPECT().Put(connection)
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(2), limits[0].Stats.TotalHits.Value())
+	assert.Equal(uint64(1), limits[0].Stats.OverLimit.Value())
+}
+
+func TestTokenBucket(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	pool := mock_redis.NewMockPool(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	connection := mock_redis.NewMockConnection(controller)
+	response := mock_redis.NewMockResponse(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewRateLimitCacheImpl(pool, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	// A bucket of 20 tokens refilling at 10 per minute takes 2 minutes to refill from empty.
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connection.EXPECT().PipeAppend(
+		"EVAL", gomock.Any(), 1, "domain_key_value_token_bucket", uint32(20), uint32(10), int64(60), uint32(2),
+		int64(120))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(12), nil)
+	pool.EXPECT().Put(connection)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 2)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, "key_value", statsStore)}
+	limits[0].Algorithm = config.TokenBucket
+	limits[0].Burst = 20
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 8}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(2), limits[0].Stats.TotalHits.Value())
+	assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
+	assert.Equal(uint64(0), limits[0].Stats.NearLimit.Value())
+
+	// The script reports the tokens that would be in use if the rejected hits had been taken.
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1240))
+	connection.EXPECT().PipeAppend(
+		"EVAL", gomock.Any(), 1, "domain_key_value_token_bucket", uint32(20), uint32(10), int64(60), uint32(2),
+		int64(120))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(21), nil)
+	pool.EXPECT().Put(connection)
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(4), limits[0].Stats.TotalHits.Value())
+	assert.Equal(uint64(1), limits[0].Stats.OverLimit.Value())
+	assert.Equal(uint64(1), limits[0].Stats.NearLimit.Value())
+}
+
+func TestGCRA(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	pool := mock_redis.NewMockPool(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	connection := mock_redis.NewMockConnection(controller)
+	response := mock_redis.NewMockResponse(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewRateLimitCacheImpl(pool, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connection.EXPECT().PipeAppend(
+		"EVAL", gomock.Any(), 1, "domain_to_number_2061234567_gcra", uint32(5), int64(86400), uint32(1), uint32(1))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(1), nil)
+	pool.EXPECT().Put(connection)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"to_number", "2061234567"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(5, pb.RateLimitResponse_RateLimit_DAY, "to_number", statsStore)}
+	limits[0].Algorithm = config.GCRA
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 0}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(1), limits[0].Stats.TotalHits.Value())
+	assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
+	assert.Equal(uint64(0), limits[0].Stats.NearLimit.Value())
+
+	// A second message in the same emission interval is rejected.
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1235))
+	connection.EXPECT().PipeAppend(
+		"EVAL", gomock.Any(), 1, "domain_to_number_2061234567_gcra", uint32(5), int64(86400), uint32(1), uint32(1))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(2), nil)
+	pool.EXPECT().Put(connection)
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(2), limits[0].Stats.TotalHits.Value())
+	assert.Equal(uint64(1), limits[0].Stats.OverLimit.Value())
+	assert.Equal(uint64(0), limits[0].Stats.NearLimit.Value())
+
+	// With a larger burst, hits that use most of it are near the limit.
+	limits[0].Burst = 5
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1236))
+	connection.EXPECT().PipeAppend(
+		"EVAL", gomock.Any(), 1, "domain_to_number_2061234567_gcra", uint32(5), int64(86400), uint32(5), uint32(1))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(3), nil)
+	pool.EXPECT().Put(connection)
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 2}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(0), limits[0].Stats.NearLimit.Value())
+
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1237))
+	connection.EXPECT().PipeAppend(
+		"EVAL", gomock.Any(), 1, "domain_to_number_2061234567_gcra", uint32(5), int64(86400), uint32(5), uint32(1))
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(5), nil)
+	pool.EXPECT().Put(connection)
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 0}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(1), limits[0].Stats.NearLimit.Value())
+}
+
+func TestConcurrency(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	pool := mock_redis.NewMockPool(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	connection := mock_redis.NewMockConnection(controller)
+	response := mock_redis.NewMockResponse(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewRateLimitCacheImpl(pool, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connection.EXPECT().PipeAppend(
+		"EVAL", gomock.Any(), 1, "domain_tenant_a_concurrency", uint32(3), int64(30), uint32(2), "lease-a")
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(2), nil)
+	pool.EXPECT().Put(connection)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"tenant", "a"}}, {{"other", "b"}}}, 2)
+	limits := []*config.RateLimit{config.NewConcurrencyLimit(3, 30, "tenant", statsStore), nil}
+
+	statuses, err := cache.DoLimit(nil, request, limits, "lease-a")
+	assert.NoError(err)
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 1},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0}},
+		statuses)
+	assert.Equal(uint64(2), limits[0].Stats.TotalHits.Value())
+	assert.Equal(uint64(0), limits[0].Stats.OverLimit.Value())
+
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1235))
+	connection.EXPECT().PipeAppend(
+		"EVAL", gomock.Any(), 1, "domain_tenant_a_concurrency", uint32(3), int64(30), uint32(2), "lease-b")
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(4), nil)
+	pool.EXPECT().Put(connection)
+
+	statuses, err = cache.DoLimit(nil, request, limits, "lease-b")
+	assert.NoError(err)
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0}},
+		statuses)
+	assert.Equal(uint64(4), limits[0].Stats.TotalHits.Value())
+	assert.Equal(uint64(1), limits[0].Stats.OverLimit.Value())
+
+	// Releasing skips descriptors without a concurrency limit and only removes the leases with the given ID.
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1236))
+	connection.EXPECT().PipeAppend("EVAL", gomock.Any(), 1, "domain_tenant_a_concurrency", uint32(2), "lease-a")
+	connection.EXPECT().PipeResponse().Return(response, nil)
+	response.EXPECT().Int().Return(int64(0), nil)
+	pool.EXPECT().Put(connection)
+
+	limits[1] = config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, "other", statsStore)
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 3},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0}},
+		release(assert, cache, request, limits, "lease-a"))
+}
+
+func TestRedisError(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	pool := mock_redis.NewMockPool(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	connection := mock_redis.NewMockConnection(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewRateLimitCacheImpl(pool, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, "key_value", statsStore)}
+
+	// An error fetching a response is returned and the connection is still put back.
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connection.EXPECT().PipeAppend("INCRBY", "domain_key_value_1234", uint32(1))
+	connection.EXPECT().PipeAppend("EXPIRE", "domain_key_value_1234", int64(1))
+	connection.EXPECT().PipeResponse().Return(nil, redis.RedisError("connection reset"))
+	pool.EXPECT().Put(connection)
+
+	statuses, err := cache.DoLimit(nil, request, limits, "")
+	assert.Nil(statuses)
+	assert.Equal(redis.RedisError("connection reset"), err)
+
+	// An error getting a connection is returned.
+	pool.EXPECT().Get().Return(nil, redis.RedisError("pool exhausted"))
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+
+	statuses, err = cache.DoLimit(nil, request, limits, "")
+	assert.Nil(statuses)
+	assert.Equal(redis.RedisError("pool exhausted"), err)
+}
+
+func TestContextDeadline(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	pool := mock_redis.NewMockPool(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	connection := mock_redis.NewMockConnection(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewRateLimitCacheImpl(pool, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, "key_value", statsStore)}
+
+	// The context's deadline is passed on to the connection, and a timeout is returned as such.
+	deadline := time.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(deadline)
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connection.EXPECT().PipeAppend("INCRBY", "domain_key_value_1234", uint32(1))
+	connection.EXPECT().PipeAppend("EXPIRE", "domain_key_value_1234", int64(1))
+	connection.EXPECT().PipeResponse().Return(nil, redis.RedisTimeoutError("i/o timeout"))
+	pool.EXPECT().Put(connection)
+
+	statuses, err := cache.DoLimit(ctx, request, limits, "")
+	assert.Nil(statuses)
+	assert.Equal(redis.RedisTimeoutError("i/o timeout"), err)
+
+	// Redis is not called once the context is done.
+	cancel()
+	statuses, err = cache.DoLimit(ctx, request, limits, "")
+	assert.Nil(statuses)
+	assert.Equal(context.Canceled, err)
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	statuses, err = cache.Release(ctx, request, limits, "")
+	assert.Nil(statuses)
+	assert.Equal(redis.RedisTimeoutError("deadline exceeded before calling redis"), err)
+}
+
+func TestContextCanceled(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	pool := mock_redis.NewMockPool(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	connection := mock_redis.NewMockConnection(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewRateLimitCacheImpl(pool, nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, "key_value", statsStore)}
+
+	// The call returns as soon as it is cancelled while waiting for redis, and the connection only goes
+	// back to the pool once its responses have been read.
+	ctx, cancel := context.WithCancel(context.Background())
+	responded := make(chan struct{})
+	put := make(chan struct{})
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connection.EXPECT().PipeAppend("INCRBY", "domain_key_value_1234", uint32(1))
+	connection.EXPECT().PipeAppend("EXPIRE", "domain_key_value_1234", int64(1))
+	connection.EXPECT().PipeResponse().Do(func() {
+		cancel()
+		<-responded
+	}).Return(nil, redis.RedisTimeoutError("i/o timeout"))
+	pool.EXPECT().Put(connection).Do(func(redis.Connection) { close(put) })
+
+	statuses, err := cache.DoLimit(ctx, request, limits, "")
+	assert.Nil(statuses)
+	assert.Equal(context.Canceled, err)
+	select {
+	case <-put:
+		t.Error("connection was put back while its responses were being read")
+	default:
+	}
+
+	close(responded)
+	select {
+	case <-put:
+	case <-time.After(time.Second):
+		t.Error("connection was not put back")
+	}
+}
+
+func TestSharding(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	poolA := mock_redis.NewMockPool(controller)
+	poolB := mock_redis.NewMockPool(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	connectionA := mock_redis.NewMockConnection(controller)
+	connectionB := mock_redis.NewMockConnection(controller)
+	responseA := mock_redis.NewMockResponse(controller)
+	responseB := mock_redis.NewMockResponse(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewRoutedRateLimitCacheImpl(
+		map[string][]redis.Shard{redis.DefaultBackend: {{Name: "a", Pool: poolA}, {Name: "b", Pool: poolB}}},
+		nil, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	request := common.NewRateLimitRequest(
+		"domain", [][][2]string{{{"key", "value"}}, {{"key2", "value2"}}, {{"key3", "value3"}}}, 1)
+	limits := []*config.RateLimit{
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, "key_value", statsStore),
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, "key2_value2", statsStore),
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, "key3_value3", statsStore)}
+
+	// Each shard gets a pipeline with the keys it owns.
+	poolA.EXPECT().Get().Return(connectionA, nil)
+	connectionA.EXPECT().SetDeadline(time.Time{})
+	poolB.EXPECT().Get().Return(connectionB, nil)
+	connectionB.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connectionA.EXPECT().PipeAppend("INCRBY", "domain_key_value_1234", uint32(1))
+	connectionA.EXPECT().PipeAppend("EXPIRE", "domain_key_value_1234", int64(1))
+	connectionB.EXPECT().PipeAppend("INCRBY", "domain_key2_value2_1234", uint32(1))
+	connectionB.EXPECT().PipeAppend("EXPIRE", "domain_key2_value2_1234", int64(1))
+	connectionB.EXPECT().PipeAppend("INCRBY", "domain_key3_value3_1234", uint32(1))
+	connectionB.EXPECT().PipeAppend("EXPIRE", "domain_key3_value3_1234", int64(1))
+	connectionA.EXPECT().PipeResponse().Return(responseA, nil)
+	responseA.EXPECT().Int().Return(int64(5), nil)
+	connectionA.EXPECT().PipeResponse()
+	connectionB.EXPECT().PipeResponse().Return(responseB, nil)
+	responseB.EXPECT().Int().Return(int64(11), nil)
+	connectionB.EXPECT().PipeResponse()
+	connectionB.EXPECT().PipeResponse().Return(responseB, nil)
+	responseB.EXPECT().Int().Return(int64(3), nil)
+	connectionB.EXPECT().PipeResponse()
+	poolA.EXPECT().Put(connectionA)
+	poolB.EXPECT().Put(connectionB)
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 5},
+			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[1].Limit, LimitRemaining: 0},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[2].Limit, LimitRemaining: 7}},
+		doLimit(assert, cache, request, limits))
+
+	// An error on one shard fails the call, and every connection is put back.
+	poolA.EXPECT().Get().Return(connectionA, nil)
+	connectionA.EXPECT().SetDeadline(time.Time{})
+	poolB.EXPECT().Get().Return(connectionB, nil)
+	connectionB.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	connectionA.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), gomock.Any()).Times(2)
+	connectionB.EXPECT().PipeAppend(gomock.Any(), gomock.Any(), gomock.Any()).Times(4)
+	connectionA.EXPECT().PipeResponse().Return(responseA, nil)
+	responseA.EXPECT().Int().Return(int64(6), nil)
+	connectionA.EXPECT().PipeResponse()
+	connectionB.EXPECT().PipeResponse().Return(nil, redis.RedisError("connection reset"))
+	poolA.EXPECT().Put(connectionA)
+	poolB.EXPECT().Put(connectionB)
+
+	statuses, err := cache.DoLimit(nil, request, limits, "")
+	assert.Nil(statuses)
+	assert.Equal(redis.RedisError("connection reset"), err)
+}
+
+func TestBackendRouting(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	pool := mock_redis.NewMockPool(controller)
+	volatilePool := mock_redis.NewMockPool(controller)
+	persistentPool := mock_redis.NewMockPool(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	connection := mock_redis.NewMockConnection(controller)
+	volatileConnection := mock_redis.NewMockConnection(controller)
+	persistentConnection := mock_redis.NewMockConnection(controller)
+	response := mock_redis.NewMockResponse(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewRoutedRateLimitCacheImpl(
+		map[string][]redis.Shard{
+			redis.DefaultBackend: {{Name: "default", Pool: pool}},
+			"volatile":           {{Name: "volatile", Pool: volatilePool}},
+			"persistent":         {{Name: "persistent", Pool: persistentPool}}},
+		map[pb.RateLimitResponse_RateLimit_Unit]string{
+			pb.RateLimitResponse_RateLimit_SECOND: "volatile",
+			pb.RateLimitResponse_RateLimit_DAY:    "persistent"},
+		timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	request := common.NewRateLimitRequest(
+		"domain", [][][2]string{{{"key", "value"}}, {{"key2", "value2"}}, {{"key3", "value3"}}, {{"key4", "value4"}}}, 1)
+	limits := []*config.RateLimit{
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, "key_value", statsStore),
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_DAY, "key2_value2", statsStore),
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, "key3_value3", statsStore),
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_HOUR, "key4_value4", statsStore)}
+	// A backend named by the limit wins over the backend of its unit.
+	limits[3].Backend = "persistent"
+
+	// Units without a route go to the default backend.
+	volatilePool.EXPECT().Get().Return(volatileConnection, nil)
+	volatileConnection.EXPECT().SetDeadline(time.Time{})
+	persistentPool.EXPECT().Get().Return(persistentConnection, nil)
+	persistentConnection.EXPECT().SetDeadline(time.Time{})
+	pool.EXPECT().Get().Return(connection, nil)
+	connection.EXPECT().SetDeadline(time.Time{})
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	volatileConnection.EXPECT().PipeAppend("INCRBY", "domain_key_value_1234", uint32(1))
+	volatileConnection.EXPECT().PipeAppend("EXPIRE", "domain_key_value_1234", int64(1))
+	persistentConnection.EXPECT().PipeAppend("INCRBY", "domain_key2_value2_0", uint32(1))
+	persistentConnection.EXPECT().PipeAppend("EXPIRE", "domain_key2_value2_0", int64(86400))
+	connection.EXPECT().PipeAppend("INCRBY", "domain_key3_value3_1200", uint32(1))
+	connection.EXPECT().PipeAppend("EXPIRE", "domain_key3_value3_1200", int64(60))
+	persistentConnection.EXPECT().PipeAppend("INCRBY", "domain_key4_value4_0", uint32(1))
+	persistentConnection.EXPECT().PipeAppend("EXPIRE", "domain_key4_value4_0", int64(3600))
+	for _, c := range []*mock_redis.MockConnection{volatileConnection, persistentConnection, connection, persistentConnection} {
+		c.EXPECT().PipeResponse().Return(response, nil)
+		c.EXPECT().PipeResponse()
+	}
+	response.EXPECT().Int().Return(int64(1), nil).Times(4)
+	volatilePool.EXPECT().Put(volatileConnection)
+	persistentPool.EXPECT().Put(persistentConnection)
+	pool.EXPECT().Put(connection)
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 9},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[1].Limit, LimitRemaining: 9},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[2].Limit, LimitRemaining: 9},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[3].Limit, LimitRemaining: 9}},
+		doLimit(assert, cache, request, limits))
+
+	// A limit that names a backend that does not exist fails the call.
+	request = common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limits = []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, "key_value", statsStore)}
+	limits[0].Backend = "missing"
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+
+	statuses, err := cache.DoLimit(nil, request, limits, "")
+	assert.Nil(statuses)
+	assert.Equal(redis.RedisError("unknown redis backend 'missing'"), err)
+}
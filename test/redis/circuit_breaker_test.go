@@ -0,0 +1,123 @@
+package redis_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	stats "github.com/lyft/gostats"
+	"github.com/lyft/ratelimit/src/redis"
+	mock_redis "github.com/lyft/ratelimit/test/mocks/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTimeSource struct {
+	now int64
+}
+
+func (this *fakeTimeSource) UnixNow() int64 {
+	return this.now
+}
+
+type circuitBreakerTestSuite struct {
+	assert     *assert.Assertions
+	controller *gomock.Controller
+	pool       *mock_redis.MockPool
+	connection *mock_redis.MockConnection
+	timeSource *fakeTimeSource
+	statsStore stats.Store
+	breaker    redis.CircuitBreakerPool
+}
+
+func newCircuitBreakerTestSuite(t *testing.T) circuitBreakerTestSuite {
+	ret := circuitBreakerTestSuite{}
+	ret.assert = assert.New(t)
+	ret.controller = gomock.NewController(t)
+	ret.pool = mock_redis.NewMockPool(ret.controller)
+	ret.connection = mock_redis.NewMockConnection(ret.controller)
+	ret.timeSource = &fakeTimeSource{1000}
+	ret.statsStore = stats.NewStore(stats.NewNullSink(), false)
+	ret.breaker = redis.NewCircuitBreakerPoolImpl(
+		ret.pool, ret.statsStore.Scope("circuit_breaker"), ret.timeSource, 0.5, 2, 10*time.Second,
+		5*time.Second, 1)
+	return ret
+}
+
+// Get a connection through the breaker, run a command on it and put it back.
+func (this *circuitBreakerTestSuite) call(err error) {
+	this.pool.EXPECT().Get().Return(this.connection, nil)
+	this.connection.EXPECT().PipeAppend("INCR", "key")
+	this.connection.EXPECT().PipeResponse().Return(nil, err)
+	this.pool.EXPECT().Put(this.connection)
+
+	c, getErr := this.breaker.Get()
+	this.assert.NoError(getErr)
+	c.PipeAppend("INCR", "key")
+	_, pipeErr := c.PipeResponse()
+	this.assert.Equal(err, pipeErr)
+	this.breaker.Put(c)
+}
+
+func (this *circuitBreakerTestSuite) expectRejected() {
+	c, err := this.breaker.Get()
+	this.assert.Nil(c)
+	this.assert.Equal(redis.RedisError("redis circuit breaker is open"), err)
+}
+
+func TestCircuitBreakerTrips(t *testing.T) {
+	suite := newCircuitBreakerTestSuite(t)
+	defer suite.controller.Finish()
+	assert := suite.assert
+
+	// A window needs enough connections before its error rate can trip the breaker.
+	suite.pool.EXPECT().Get().Return(nil, redis.RedisError("timed out"))
+	_, err := suite.breaker.Get()
+	assert.Equal(redis.RedisError("timed out"), err)
+	assert.Equal(redis.CircuitBreakerClosed, suite.breaker.State())
+
+	// Errors from an earlier window are not counted.
+	suite.timeSource.now = 1010
+	suite.call(redis.RedisError("connection reset"))
+	assert.Equal(redis.CircuitBreakerClosed, suite.breaker.State())
+	suite.call(nil)
+	assert.Equal(redis.CircuitBreakerOpen, suite.breaker.State())
+	assert.EqualValues(1, suite.statsStore.NewCounter("circuit_breaker.tripped").Value())
+	assert.EqualValues(redis.CircuitBreakerOpen, suite.statsStore.NewGauge("circuit_breaker.state").Value())
+
+	// Calls fail fast without waiting for redis during the cool-down window.
+	suite.timeSource.now = 1014
+	suite.expectRejected()
+	assert.EqualValues(1, suite.statsStore.NewCounter("circuit_breaker.rejected").Value())
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	suite := newCircuitBreakerTestSuite(t)
+	defer suite.controller.Finish()
+	assert := suite.assert
+
+	suite.call(redis.RedisError("connection reset"))
+	suite.call(redis.RedisError("connection reset"))
+	assert.Equal(redis.CircuitBreakerOpen, suite.breaker.State())
+
+	// A failed probe opens the breaker for another cool-down window.
+	suite.timeSource.now = 1005
+	suite.call(redis.RedisError("connection reset"))
+	assert.Equal(redis.CircuitBreakerOpen, suite.breaker.State())
+	assert.EqualValues(2, suite.statsStore.NewCounter("circuit_breaker.tripped").Value())
+	suite.expectRejected()
+
+	// Only the probe is let through while half open, and the breaker closes once it succeeds.
+	suite.timeSource.now = 1010
+	suite.pool.EXPECT().Get().Return(suite.connection, nil)
+	probe, err := suite.breaker.Get()
+	assert.NoError(err)
+	assert.Equal(redis.CircuitBreakerHalfOpen, suite.breaker.State())
+	assert.EqualValues(redis.CircuitBreakerHalfOpen, suite.statsStore.NewGauge("circuit_breaker.state").Value())
+	suite.expectRejected()
+
+	suite.pool.EXPECT().Put(suite.connection)
+	suite.breaker.Put(probe)
+	assert.Equal(redis.CircuitBreakerClosed, suite.breaker.State())
+	suite.call(nil)
+	assert.EqualValues(2, suite.statsStore.NewCounter("circuit_breaker.rejected").Value())
+}
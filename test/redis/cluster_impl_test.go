@@ -0,0 +1,325 @@
+package redis_test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	stats "github.com/lyft/gostats"
+	"github.com/lyft/ratelimit/src/redis"
+	radix "github.com/mediocregopher/radix.v2/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// A fake redis node that answers each command with the response of a handler. A nil response is
+// never sent, so the client waits for it.
+type fakeNode struct {
+	listener net.Listener
+	handle   func(args []string) *radix.Resp
+	mutex    sync.Mutex
+	commands [][]string
+	// Connections that are open, which pushed responses are written to.
+	conns map[net.Conn]bool
+}
+
+func newFakeNode(t *testing.T, handle func(args []string) *radix.Resp) *fakeNode {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := &fakeNode{listener: listener, handle: handle, conns: map[net.Conn]bool{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go ret.serve(conn)
+		}
+	}()
+	return ret
+}
+
+func (this *fakeNode) serve(conn net.Conn) {
+	this.mutex.Lock()
+	this.conns[conn] = true
+	this.mutex.Unlock()
+	defer func() {
+		this.mutex.Lock()
+		delete(this.conns, conn)
+		this.mutex.Unlock()
+		conn.Close()
+	}()
+
+	reader := radix.NewRespReader(conn)
+	for {
+		args, err := reader.Read().List()
+		if err != nil {
+			return
+		}
+		this.mutex.Lock()
+		this.commands = append(this.commands, args)
+		this.mutex.Unlock()
+		if resp := this.handle(args); resp != nil {
+			this.mutex.Lock()
+			resp.WriteTo(conn)
+			this.mutex.Unlock()
+		}
+	}
+}
+
+// Write a response that no command asked for, e.g. a pubsub message, to every open connection.
+func (this *fakeNode) push(resp *radix.Resp) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for conn := range this.conns {
+		resp.WriteTo(conn)
+	}
+}
+
+// Stop accepting connections and close the open ones.
+func (this *fakeNode) close() {
+	this.listener.Close()
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	for conn := range this.conns {
+		conn.Close()
+	}
+}
+
+// @return the number of open connections.
+func (this *fakeNode) open() int {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return len(this.conns)
+}
+
+func (this *fakeNode) addr() string {
+	return this.listener.Addr().String()
+}
+
+// @return the names of the commands the node received.
+func (this *fakeNode) received() []string {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	ret := []string{}
+	for _, command := range this.commands {
+		ret = append(ret, command[0])
+	}
+	return ret
+}
+
+// @return how many times the node received a command.
+func (this *fakeNode) count(cmd string) int {
+	ret := 0
+	for _, received := range this.received() {
+		if received == cmd {
+			ret++
+		}
+	}
+	return ret
+}
+
+// Wait for a condition that is met in the background.
+// @return whether the condition was met within a second.
+func eventually(condition func() bool) bool {
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(5 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return false
+}
+
+// A fake cluster topology that maps each key to the node given for it.
+type fakeTopology struct {
+	addrs  map[string]string
+	mutex  sync.Mutex
+	puts   []string
+	resets chan struct{}
+}
+
+func (this *fakeTopology) GetAddrForKey(key string) string {
+	return this.addrs[key]
+}
+
+func (this *fakeTopology) GetForKey(key string) (*radix.Client, error) {
+	return radix.Dial("tcp", this.addrs[key])
+}
+
+func (this *fakeTopology) Put(client *radix.Client) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.puts = append(this.puts, client.Addr)
+	client.Close()
+}
+
+func (this *fakeTopology) Reset() error {
+	this.resets <- struct{}{}
+	return nil
+}
+
+func newFakeClusterPool(addrs map[string]string) (redis.Pool, *fakeTopology) {
+	topology := &fakeTopology{addrs: addrs, resets: make(chan struct{}, 1)}
+	pool := redis.NewClusterPoolImplWithTopology(
+		stats.NewStore(stats.NewNullSink(), false), topology, radix.Dial, 0)
+	return pool, topology
+}
+
+// Send a single command and read its response as an integer.
+func clusterCommand(assert *assert.Assertions, c redis.Connection, cmd string, args ...interface{}) (int64, error) {
+	c.PipeAppend(cmd, args...)
+	response, err := c.PipeResponse()
+	if err != nil {
+		return 0, err
+	}
+	value, err := response.Int()
+	assert.NoError(err)
+	return value, nil
+}
+
+func TestClusterPipelinesByNode(t *testing.T) {
+	assert := assert.New(t)
+
+	nodeA := newFakeNode(t, func(args []string) *radix.Resp {
+		if args[0] == "INCRBY" {
+			return radix.NewResp(int64(10))
+		}
+		return radix.NewResp(int64(1))
+	})
+	defer nodeA.listener.Close()
+	nodeB := newFakeNode(t, func(args []string) *radix.Resp { return radix.NewResp(int64(20)) })
+	defer nodeB.listener.Close()
+	pool, topology := newFakeClusterPool(map[string]string{"a_key": nodeA.addr(), "b_key": nodeB.addr()})
+
+	// Scripts go to the node of their first key, which comes after the script and the number of keys.
+	c, err := pool.Get()
+	assert.NoError(err)
+	c.SetDeadline(time.Now().Add(time.Second))
+	c.PipeAppend("INCRBY", "a_key", 1)
+	c.PipeAppend("EVAL", "return 1", 1, "b_key", 5)
+	c.PipeAppend("EXPIRE", "a_key", 60)
+	c.PipeAppend("evalsha", "abc123", 1, "a_key")
+	c.PipeAppend("GET", "b_key")
+
+	// Responses come back in the order the commands were appended.
+	for _, expected := range []int64{10, 20, 1, 1, 20} {
+		response, err := c.PipeResponse()
+		assert.NoError(err)
+		value, err := response.Int()
+		assert.NoError(err)
+		assert.Equal(expected, value)
+	}
+	assert.Equal([]string{"INCRBY", "EXPIRE", "evalsha"}, nodeA.received())
+	assert.Equal([]string{"EVAL", "GET"}, nodeB.received())
+
+	// Each node's connection goes back to the cluster.
+	pool.Put(c)
+	assert.Len(topology.puts, 2)
+	assert.Contains(topology.puts, nodeA.addr())
+	assert.Contains(topology.puts, nodeB.addr())
+}
+
+func TestClusterMoved(t *testing.T) {
+	assert := assert.New(t)
+
+	nodeB := newFakeNode(t, func(args []string) *radix.Resp { return radix.NewResp(int64(7)) })
+	defer nodeB.listener.Close()
+	nodeA := newFakeNode(t, func(args []string) *radix.Resp {
+		return radix.NewResp(errors.New("MOVED 3999 " + nodeB.addr()))
+	})
+	defer nodeA.listener.Close()
+	pool, topology := newFakeClusterPool(map[string]string{"key": nodeA.addr()})
+
+	c, err := pool.Get()
+	assert.NoError(err)
+	c.SetDeadline(time.Now().Add(time.Second))
+	value, err := clusterCommand(assert, c, "INCRBY", "key", 1)
+	assert.NoError(err)
+	assert.Equal(int64(7), value)
+	assert.Equal([]string{"INCRBY"}, nodeB.received())
+
+	// The topology is reloaded for later calls.
+	select {
+	case <-topology.resets:
+	case <-time.After(time.Second):
+		t.Error("cluster topology was not reloaded")
+	}
+	pool.Put(c)
+}
+
+func TestClusterAsk(t *testing.T) {
+	assert := assert.New(t)
+
+	nodeB := newFakeNode(t, func(args []string) *radix.Resp {
+		if args[0] == "ASKING" {
+			return radix.NewRespSimple("OK")
+		}
+		return radix.NewResp(int64(8))
+	})
+	defer nodeB.listener.Close()
+	nodeA := newFakeNode(t, func(args []string) *radix.Resp {
+		return radix.NewResp(errors.New("ASK 3999 " + nodeB.addr()))
+	})
+	defer nodeA.listener.Close()
+	pool, topology := newFakeClusterPool(map[string]string{"key": nodeA.addr()})
+
+	c, err := pool.Get()
+	assert.NoError(err)
+	value, err := clusterCommand(assert, c, "INCRBY", "key", 1)
+	assert.NoError(err)
+	assert.Equal(int64(8), value)
+	assert.Equal([]string{"ASKING", "INCRBY"}, nodeB.received())
+
+	// An ASK only applies to one command, so the topology is not reloaded.
+	assert.Len(topology.resets, 0)
+	pool.Put(c)
+}
+
+func TestClusterErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	node := newFakeNode(t, func(args []string) *radix.Resp {
+		if args[1] == "malformed" {
+			return radix.NewResp(errors.New("MOVED 3999"))
+		}
+		return radix.NewResp(errors.New("ERR unknown command"))
+	})
+	defer node.listener.Close()
+	pool, topology := newFakeClusterPool(map[string]string{"malformed": node.addr(), "key": node.addr()})
+
+	// Errors that are not redirections, and redirections that cannot be parsed, are returned as is.
+	c, err := pool.Get()
+	assert.NoError(err)
+	_, err = clusterCommand(assert, c, "INCRBY", "key", 1)
+	assert.Equal(redis.RedisError("ERR unknown command"), err)
+	_, err = clusterCommand(assert, c, "INCRBY", "malformed", 1)
+	assert.Equal(redis.RedisError("MOVED 3999"), err)
+	assert.Equal([]string{"INCRBY", "INCRBY"}, node.received())
+	assert.Len(topology.resets, 0)
+	pool.Put(c)
+}
+
+func TestClusterRedirectDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	// The node a command is redirected to never answers.
+	nodeB := newFakeNode(t, func(args []string) *radix.Resp { return nil })
+	defer nodeB.listener.Close()
+	nodeA := newFakeNode(t, func(args []string) *radix.Resp {
+		return radix.NewResp(errors.New("MOVED 3999 " + nodeB.addr()))
+	})
+	defer nodeA.listener.Close()
+	pool, _ := newFakeClusterPool(map[string]string{"key": nodeA.addr()})
+
+	c, err := pool.Get()
+	assert.NoError(err)
+	c.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	start := time.Now()
+	_, err = clusterCommand(assert, c, "INCRBY", "key", 1)
+	assert.IsType(redis.RedisTimeoutError(""), err)
+	assert.True(time.Since(start) < time.Second)
+	pool.Put(c)
+}
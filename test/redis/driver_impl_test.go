@@ -0,0 +1,55 @@
+package redis_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	stats "github.com/lyft/gostats"
+	"github.com/lyft/ratelimit/src/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolSocketType(t *testing.T) {
+	assert := assert.New(t)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+
+	_, err := redis.NewPoolImpl(statsStore, "unix", true, "", "/tmp/redis.sock", 1, 0, 0, 0, 0, 0)
+	assert.Equal(redis.RedisError("redis TLS is not supported over unix sockets"), err)
+	_, err = redis.NewPoolImpl(statsStore, "udp", false, "", "localhost:6379", 1, 0, 0, 0, 0, 0)
+	assert.Equal(redis.RedisError("unknown redis socket type 'udp'"), err)
+}
+
+func TestPoolUnixSocket(t *testing.T) {
+	assert := assert.New(t)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+
+	dir, err := ioutil.TempDir("", "ratelimit")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "redis.sock")
+	listener, err := net.Listen("unix", path)
+	assert.NoError(err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// Each connection is held open until the client closes it.
+			go func(conn net.Conn) {
+				defer conn.Close()
+				ioutil.ReadAll(conn)
+			}(conn)
+		}
+	}()
+
+	pool, err := redis.NewPoolImpl(statsStore, "unix", false, "", path, 2, 0, 0, 0, 0, 0)
+	assert.NoError(err)
+	c, err := pool.Get()
+	assert.NoError(err)
+	pool.Put(c)
+}
@@ -0,0 +1,246 @@
+package redis_test
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/coocood/freecache"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
+	"github.com/golang/mock/gomock"
+	stats "github.com/lyft/gostats"
+	"github.com/lyft/ratelimit/src/config"
+	"github.com/lyft/ratelimit/src/redis"
+	"github.com/lyft/ratelimit/test/common"
+	mock_redis "github.com/lyft/ratelimit/test/mocks/redis"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestMemcached(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	client := mock_redis.NewMockMemcachedClient(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewMemcachedRateLimitCacheImpl(client, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	// The first hit of a window adds the counter.
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	client.EXPECT().Increment("domain_key_value_1234", uint64(1)).Return(uint64(0), memcache.ErrCacheMiss)
+	client.EXPECT().Add(&memcache.Item{Key: "domain_key_value_1234", Value: []byte("1"), Expiration: 1})
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, "key_value", statsStore)}
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 9}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(1), limits[0].Stats.TotalHits.Value())
+
+	// Later hits increment it.
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	client.EXPECT().Increment("domain_key_value_1234", uint64(1)).Return(uint64(11), nil)
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(2), limits[0].Stats.TotalHits.Value())
+	assert.Equal(uint64(1), limits[0].Stats.OverLimit.Value())
+
+	// A counter added by another call between the increment and the add is incremented.
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	client.EXPECT().Increment("domain_key2_value2_subkey2_subvalue2_1200", uint64(2)).Return(uint64(0), memcache.ErrCacheMiss)
+	client.EXPECT().Add(&memcache.Item{Key: "domain_key2_value2_subkey2_subvalue2_1200", Value: []byte("2"), Expiration: 60}).
+		Return(memcache.ErrNotStored)
+	client.EXPECT().Increment("domain_key2_value2_subkey2_subvalue2_1200", uint64(2)).Return(uint64(7), nil)
+
+	request = common.NewRateLimitRequest(
+		"domain",
+		[][][2]string{
+			{{"key2", "value2"}},
+			{{"key2", "value2"}, {"subkey2", "subvalue2"}},
+		}, 2)
+	limits = []*config.RateLimit{
+		nil,
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, "key2_value2_subkey2_subvalue2", statsStore)}
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[1].Limit, LimitRemaining: 3}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(2), limits[1].Stats.TotalHits.Value())
+	assert.Equal(uint64(0), limits[1].Stats.NearLimit.Value())
+}
+
+func TestMemcachedSlidingWindow(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	client := mock_redis.NewMockMemcachedClient(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewMemcachedRateLimitCacheImpl(client, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	// 34 seconds into the window, so 26/60 of the previous window's count still applies. memcached
+	// pads counters that got shorter with spaces.
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	client.EXPECT().Increment("domain_key_value_1200", uint64(1)).Return(uint64(5), nil)
+	client.EXPECT().Get("domain_key_value_1140").Return(&memcache.Item{Value: []byte("10 ")}, nil)
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, "key_value", statsStore)}
+	limits[0].Algorithm = config.SlidingWindow
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 1}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(1), limits[0].Stats.NearLimit.Value())
+
+	// A previous window without hits has no counter.
+	timeSource.EXPECT().UnixNow().Return(int64(1266))
+	client.EXPECT().Increment("domain_key_value_1260", uint64(1)).Return(uint64(0), memcache.ErrCacheMiss)
+	client.EXPECT().Add(&memcache.Item{Key: "domain_key_value_1260", Value: []byte("1"), Expiration: 120})
+	client.EXPECT().Get("domain_key_value_1200").Return(nil, memcache.ErrCacheMiss)
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 9}},
+		doLimit(assert, cache, request, limits))
+}
+
+func TestMemcachedKeysAndExpiration(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	client := mock_redis.NewMockMemcachedClient(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	jitterSource := mock_redis.NewMockJitterRandSource(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewMemcachedRateLimitCacheImpl(client, timeSource, rand.New(jitterSource), 3000000, nil, statsStore.Scope("cache"))
+
+	// Keys memcached does not accept are hashed, and expirations longer than 30 days are sent as a
+	// unix time.
+	timeSource.EXPECT().UnixNow().Return(int64(1234)).Times(2)
+	jitterSource.EXPECT().Int63().Return(int64(2600000))
+	client.EXPECT().Increment("md5_a30568a4c2967ae941782ee5279124e4", uint64(1)).Return(uint64(0), memcache.ErrCacheMiss)
+	client.EXPECT().Add(&memcache.Item{Key: "md5_a30568a4c2967ae941782ee5279124e4", Value: []byte("1"), Expiration: 1234 + 3600 + 2600000})
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "a value"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_HOUR, "key_a value", statsStore)}
+
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 9}},
+		doLimit(assert, cache, request, limits))
+}
+
+func TestMemcachedErrors(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	client := mock_redis.NewMockMemcachedClient(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewMemcachedRateLimitCacheImpl(client, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, "key_value", statsStore)}
+
+	// Errors are handled like redis errors.
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	client.EXPECT().Increment("domain_key_value_1234", uint64(1)).Return(uint64(0), &memcache.ConnectTimeoutError{Addr: &net.TCPAddr{}})
+	_, err := cache.DoLimit(nil, request, limits, "")
+	assert.IsType(redis.RedisTimeoutError(""), err)
+
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	client.EXPECT().Increment("domain_key_value_1234", uint64(1)).Return(uint64(0), memcache.ErrServerError)
+	_, err = cache.DoLimit(nil, request, limits, "")
+	assert.Equal(redis.RedisError(memcache.ErrServerError.Error()), err)
+
+	// Algorithms that need scripts are not supported.
+	limits[0].Algorithm = config.TokenBucket
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	_, err = cache.DoLimit(nil, request, limits, "")
+	assert.Equal(redis.RedisError("rate limit algorithm 'token_bucket' is not supported by memcached"), err)
+
+	limits[0].Algorithm = config.Concurrency
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	_, err = cache.Release(nil, request, limits, "")
+	assert.Equal(redis.RedisError("concurrency limits are not supported by memcached"), err)
+}
+
+func TestMemcachedContext(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	client := mock_redis.NewMockMemcachedClient(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewMemcachedRateLimitCacheImpl(client, timeSource, rand.New(rand.NewSource(1)), 0, nil, statsStore.Scope("cache"))
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, "key_value", statsStore)}
+
+	// The call returns as soon as it is cancelled while waiting for memcached.
+	ctx, cancel := context.WithCancel(context.Background())
+	responded := make(chan struct{})
+	defer close(responded)
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	client.EXPECT().Increment("domain_key_value_1234", uint64(1)).Do(func(string, uint64) {
+		cancel()
+		<-responded
+	}).Return(uint64(1), nil)
+
+	statuses, err := cache.DoLimit(ctx, request, limits, "")
+	assert.Nil(statuses)
+	assert.Equal(context.Canceled, err)
+
+	// A call that reaches its deadline while waiting for memcached fails like a memcached timeout.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	timeSource.EXPECT().UnixNow().Return(int64(1234))
+	client.EXPECT().Increment("domain_key_value_1234", uint64(1)).Do(func(string, uint64) {
+		<-responded
+	}).Return(uint64(1), nil)
+
+	statuses, err = cache.DoLimit(ctx, request, limits, "")
+	assert.Nil(statuses)
+	assert.Equal(redis.RedisTimeoutError("deadline exceeded while calling memcached"), err)
+}
+
+func TestMemcachedWithLocalCache(t *testing.T) {
+	assert := assert.New(t)
+	controller := gomock.NewController(t)
+	defer controller.Finish()
+
+	client := mock_redis.NewMockMemcachedClient(controller)
+	timeSource := mock_redis.NewMockTimeSource(controller)
+	localCache := freecache.NewCache(100)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+	cache := redis.NewMemcachedRateLimitCacheImpl(client, timeSource, rand.New(rand.NewSource(1)), 0, localCache, statsStore.Scope("cache"))
+
+	request := common.NewRateLimitRequest("domain", [][][2]string{{{"key", "value"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_HOUR, "key_value", statsStore)}
+
+	timeSource.EXPECT().UnixNow().Return(int64(1000000))
+	client.EXPECT().Increment("domain_key_value_997200", uint64(1)).Return(uint64(11), nil)
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0}},
+		doLimit(assert, cache, request, limits))
+
+	// Over limit keys are answered from the local cache without calling memcached.
+	timeSource.EXPECT().UnixNow().Return(int64(1000000))
+	assert.Equal(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0}},
+		doLimit(assert, cache, request, limits))
+	assert.Equal(uint64(2), limits[0].Stats.OverLimit.Value())
+	assert.Equal(uint64(1), limits[0].Stats.OverLimitWithLocalCache.Value())
+}
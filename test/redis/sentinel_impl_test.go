@@ -0,0 +1,219 @@
+package redis_test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	stats "github.com/lyft/gostats"
+	"github.com/lyft/ratelimit/src/redis"
+	radix "github.com/mediocregopher/radix.v2/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// A fake sentinel that knows the address of a single master and announces its failovers.
+type fakeSentinel struct {
+	*fakeNode
+	mutex  sync.Mutex
+	master string
+}
+
+// @param master supplies the address of the master, or empty if the sentinel does not know it.
+// @param subscribe supplies whether the sentinel accepts subscriptions.
+func newFakeSentinel(t *testing.T, master string, subscribe bool) *fakeSentinel {
+	ret := &fakeSentinel{master: master}
+	ret.fakeNode = newFakeNode(t, func(args []string) *radix.Resp {
+		switch args[0] {
+		case "SENTINEL":
+			ret.mutex.Lock()
+			defer ret.mutex.Unlock()
+			if ret.master == "" {
+				return radix.NewResp(nil)
+			}
+			host, port, _ := net.SplitHostPort(ret.master)
+			return radix.NewResp([]string{host, port})
+		case "SUBSCRIBE":
+			if !subscribe {
+				return radix.NewResp(errors.New("ERR unknown command 'SUBSCRIBE'"))
+			}
+			return radix.NewResp([]interface{}{"subscribe", args[1], 1})
+		}
+		return radix.NewRespSimple("PONG")
+	})
+	return ret
+}
+
+// Announce a failover of a master.
+// @param masterName supplies the name of the master.
+// @param master supplies the address of the new master.
+func (this *fakeSentinel) failover(masterName string, master string) {
+	this.mutex.Lock()
+	oldHost, oldPort, _ := net.SplitHostPort(this.master)
+	if masterName == "mymaster" {
+		this.master = master
+	}
+	this.mutex.Unlock()
+
+	host, port, _ := net.SplitHostPort(master)
+	this.push(radix.NewResp([]interface{}{
+		"message", "+switch-master", masterName + " " + oldHost + " " + oldPort + " " + host + " " + port}))
+}
+
+// @return whether the sentinel is being watched for failovers.
+func (this *fakeSentinel) watched() bool {
+	return this.count("SUBSCRIBE") > 0
+}
+
+// Create a fake master that answers every command with its ID.
+func newFakeMaster(t *testing.T, id int64) *fakeNode {
+	return newFakeNode(t, func(args []string) *radix.Resp { return radix.NewResp(id) })
+}
+
+// @return the ID of the master a sentinel pool sends commands to.
+func currentMaster(assert *assert.Assertions, pool redis.Pool) int64 {
+	c, err := pool.Get()
+	if !assert.NoError(err) {
+		return 0
+	}
+	defer pool.Put(c)
+	value, err := clusterCommand(assert, c, "GET", "key")
+	assert.NoError(err)
+	return value
+}
+
+// @return the address of a port that nothing listens on.
+func closedAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	return listener.Addr().String()
+}
+
+func newSentinelPool(scope stats.Scope, sentinels ...string) (redis.Pool, error) {
+	url := "mymaster"
+	for _, sentinel := range sentinels {
+		url += "," + sentinel
+	}
+	return redis.NewSentinelPoolImpl(scope, false, "", url, 1, 0, 0, 0, 0, 0)
+}
+
+func TestSentinelPoolErrors(t *testing.T) {
+	assert := assert.New(t)
+	scope := stats.NewStore(stats.NewNullSink(), false).Scope("redis_pool")
+
+	_, err := newSentinelPool(scope)
+	assert.Equal(
+		redis.RedisError("redis sentinel url must be the master name followed by the sentinel addresses"), err)
+
+	// No sentinel can be reached.
+	_, err = newSentinelPool(scope, closedAddr(t), closedAddr(t))
+	assert.IsType(redis.RedisError(""), err)
+
+	// The sentinel does not know the master.
+	sentinel := newFakeSentinel(t, "", true)
+	defer sentinel.close()
+	_, err = newSentinelPool(scope, sentinel.addr())
+	assert.IsType(redis.RedisError(""), err)
+
+	// The master cannot be reached.
+	unreachable := newFakeSentinel(t, closedAddr(t), true)
+	defer unreachable.close()
+	_, err = newSentinelPool(scope, unreachable.addr())
+	assert.IsType(redis.RedisError(""), err)
+}
+
+func TestSentinelMasterDiscovery(t *testing.T) {
+	assert := assert.New(t)
+	scope := stats.NewStore(stats.NewNullSink(), false).Scope("redis_pool")
+
+	master := newFakeMaster(t, 1)
+	defer master.close()
+	sentinel := newFakeSentinel(t, master.addr(), true)
+	defer sentinel.close()
+
+	// The master is asked from the first sentinel that can be reached, which is then watched.
+	pool, err := newSentinelPool(scope, closedAddr(t), sentinel.addr())
+	assert.NoError(err)
+	assert.Equal(int64(1), currentMaster(assert, pool))
+	assert.True(eventually(sentinel.watched))
+	assert.Equal(2, sentinel.count("SENTINEL"))
+}
+
+func TestSentinelWatch(t *testing.T) {
+	assert := assert.New(t)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+
+	masterA := newFakeMaster(t, 1)
+	defer masterA.close()
+	masterB := newFakeMaster(t, 2)
+	defer masterB.close()
+	sentinel := newFakeSentinel(t, masterA.addr(), true)
+	defer sentinel.close()
+
+	pool, err := newSentinelPool(statsStore.Scope("redis_pool"), sentinel.addr())
+	assert.NoError(err)
+	assert.Equal(int64(1), currentMaster(assert, pool))
+	assert.True(eventually(sentinel.watched))
+	oldConnection, err := pool.Get()
+	assert.NoError(err)
+
+	// Failovers of other masters are ignored, and the pool moves to the new master of its own.
+	sentinel.failover("othermaster", masterB.addr())
+	sentinel.failover("mymaster", masterB.addr())
+	assert.True(eventually(func() bool { return currentMaster(assert, pool) == 2 }))
+	assert.Equal(uint64(1), statsStore.NewCounter("redis_pool.failover").Value())
+
+	// A connection to the old master is closed when it is put back instead of going back to a pool.
+	assert.Equal(1, masterA.open())
+	pool.Put(oldConnection)
+	assert.True(eventually(func() bool { return masterA.open() == 0 }))
+}
+
+func TestSentinelReconnect(t *testing.T) {
+	assert := assert.New(t)
+	statsStore := stats.NewStore(stats.NewNullSink(), false)
+
+	masterA := newFakeMaster(t, 1)
+	defer masterA.close()
+	masterB := newFakeMaster(t, 2)
+	defer masterB.close()
+	sentinelA := newFakeSentinel(t, masterA.addr(), true)
+	defer sentinelA.close()
+	sentinelB := newFakeSentinel(t, masterB.addr(), true)
+	defer sentinelB.close()
+
+	pool, err := newSentinelPool(statsStore.Scope("redis_pool"), sentinelA.addr(), sentinelB.addr())
+	assert.NoError(err)
+	assert.Equal(int64(1), currentMaster(assert, pool))
+	assert.True(eventually(sentinelA.watched))
+
+	// When the watched sentinel goes away the next one is watched, and the master it knows is used
+	// since a failover may have been missed in the meantime.
+	sentinelA.close()
+	assert.True(eventually(sentinelB.watched))
+	assert.True(eventually(func() bool { return currentMaster(assert, pool) == 2 }))
+	assert.Equal(uint64(1), statsStore.NewCounter("redis_pool.failover").Value())
+}
+
+func TestSentinelSubscribeRetry(t *testing.T) {
+	assert := assert.New(t)
+	scope := stats.NewStore(stats.NewNullSink(), false).Scope("redis_pool")
+
+	master := newFakeMaster(t, 1)
+	defer master.close()
+	sentinel := newFakeSentinel(t, master.addr(), false)
+	defer sentinel.close()
+
+	// A sentinel that does not accept the subscription is not asked again right away.
+	pool, err := newSentinelPool(scope, sentinel.addr())
+	assert.NoError(err)
+	assert.True(eventually(sentinel.watched))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(1, sentinel.count("SUBSCRIBE"))
+	assert.Equal(2, sentinel.count("SENTINEL"))
+	assert.Equal(int64(1), currentMaster(assert, pool))
+}
@@ -3,6 +3,7 @@ package ratelimit_test
 import (
 	"testing"
 
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	pb_struct "github.com/envoyproxy/go-control-plane/envoy/api/v2/ratelimit"
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
 	"github.com/golang/mock/gomock"
@@ -14,7 +15,6 @@ import (
 	"github.com/lyft/ratelimit/src/service"
 	"github.com/lyft/ratelimit/test/common"
 	"github.com/stretchr/testify/assert"
-	"golang.org/x/net/context"
 )
 
 func convertRatelimit(ratelimit *pb.RateLimitResponse_RateLimit) (*pb_legacy.RateLimit, error) {
@@ -69,9 +69,9 @@ func TestServiceLegacy(test *testing.T) {
 	if err != nil {
 		t.assert.FailNow(err.Error())
 	}
-	t.config.EXPECT().GetLimit(nil, "test-domain", req.Descriptors[0]).Return(nil)
-	t.cache.EXPECT().DoLimit(nil, req, []*config.RateLimit{nil}).Return(
-		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0}})
+	t.config.EXPECT().GetLimits(nil, "test-domain", req.Descriptors[0]).Return(nil)
+	t.cache.EXPECT().DoLimit(nil, req, []*config.RateLimit{nil}, "").Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0}}, nil)
 
 	response, err := service.GetLegacyService().ShouldRateLimit(nil, legacyRequest)
 	t.assert.Equal(
@@ -85,7 +85,7 @@ func TestServiceLegacy(test *testing.T) {
 	barrier := newBarrier()
 	t.configLoader.EXPECT().Load(
 		[]config.RateLimitConfigToLoad{{"config.basic_config", "fake_yaml"}}, gomock.Any()).Do(
-		func([]config.RateLimitConfigToLoad, stats.Scope) { barrier.signal() }).Return(t.config)
+		func([]config.RateLimitConfigToLoad, stats.Scope) { barrier.signal() }).Return(t.config, nil)
 	t.runtimeUpdateCallback <- 1
 	barrier.wait()
 
@@ -105,11 +105,11 @@ func TestServiceLegacy(test *testing.T) {
 		t.assert.FailNow(err.Error())
 	}
 
-	t.config.EXPECT().GetLimit(nil, "different-domain", req.Descriptors[0]).Return(limits[0])
-	t.config.EXPECT().GetLimit(nil, "different-domain", req.Descriptors[1]).Return(limits[1])
-	t.cache.EXPECT().DoLimit(nil, req, limits).Return(
+	t.config.EXPECT().GetLimits(nil, "different-domain", req.Descriptors[0]).Return([]*config.RateLimit{limits[0]})
+	t.config.EXPECT().GetLimits(nil, "different-domain", req.Descriptors[1]).Return([]*config.RateLimit{limits[1]})
+	t.cache.EXPECT().DoLimit(nil, req, limits, "").Return(
 		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0},
-			{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0}})
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0}}, nil)
 	response, err = service.GetLegacyService().ShouldRateLimit(nil, legacyRequest)
 	t.assert.Equal(
 		&pb_legacy.RateLimitResponse{
@@ -124,10 +124,8 @@ func TestServiceLegacy(test *testing.T) {
 	// Config load failure.
 	t.configLoader.EXPECT().Load(
 		[]config.RateLimitConfigToLoad{{"config.basic_config", "fake_yaml"}}, gomock.Any()).Do(
-		func([]config.RateLimitConfigToLoad, stats.Scope) {
-			barrier.signal()
-			panic(config.RateLimitConfigError("load error"))
-		})
+		func([]config.RateLimitConfigToLoad, stats.Scope) { barrier.signal() }).Return(
+		nil, config.RateLimitConfigError{Message: "load error"})
 	t.runtimeUpdateCallback <- 1
 	barrier.wait()
 
@@ -140,11 +138,11 @@ func TestServiceLegacy(test *testing.T) {
 		t.assert.FailNow(err.Error())
 	}
 
-	t.config.EXPECT().GetLimit(nil, "different-domain", req.Descriptors[0]).Return(limits[0])
-	t.config.EXPECT().GetLimit(nil, "different-domain", req.Descriptors[1]).Return(limits[1])
-	t.cache.EXPECT().DoLimit(nil, req, limits).Return(
+	t.config.EXPECT().GetLimits(nil, "different-domain", req.Descriptors[0]).Return([]*config.RateLimit{limits[0]})
+	t.config.EXPECT().GetLimits(nil, "different-domain", req.Descriptors[1]).Return([]*config.RateLimit{limits[1]})
+	t.cache.EXPECT().DoLimit(nil, req, limits, "").Return(
 		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0},
-			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[1].Limit, LimitRemaining: 0}})
+			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[1].Limit, LimitRemaining: 0}}, nil)
 	response, err = service.GetLegacyService().ShouldRateLimit(nil, legacyRequest)
 	t.assert.Equal(
 		&pb_legacy.RateLimitResponse{
@@ -197,11 +195,9 @@ func TestCacheErrorLegacy(test *testing.T) {
 		t.assert.FailNow(err.Error())
 	}
 	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, "key", t.statStore)}
-	t.config.EXPECT().GetLimit(nil, "different-domain", req.Descriptors[0]).Return(limits[0])
-	t.cache.EXPECT().DoLimit(nil, req, limits).Do(
-		func(context.Context, *pb.RateLimitRequest, []*config.RateLimit) {
-			panic(redis.RedisError("cache error"))
-		})
+	t.config.EXPECT().GetLimits(nil, "different-domain", req.Descriptors[0]).Return([]*config.RateLimit{limits[0]})
+	t.cache.EXPECT().DoLimit(nil, req, limits, "").Return(nil, redis.RedisError("cache error"))
+	t.config.EXPECT().GetFailureMode("different-domain").Return(config.FailureModeNone)
 
 	response, err := service.GetLegacyService().ShouldRateLimit(nil, legacyRequest)
 	t.assert.Nil(response)
@@ -220,11 +216,8 @@ func TestInitialLoadErrorLegacy(test *testing.T) {
 	t.snapshot.EXPECT().Keys().Return([]string{"foo", "config.basic_config"}).MinTimes(1)
 	t.snapshot.EXPECT().Get("config.basic_config").Return("fake_yaml").MinTimes(1)
 	t.configLoader.EXPECT().Load(
-		[]config.RateLimitConfigToLoad{{"config.basic_config", "fake_yaml"}}, gomock.Any()).Do(
-		func([]config.RateLimitConfigToLoad, stats.Scope) {
-			panic(config.RateLimitConfigError("load error"))
-		})
-	service := ratelimit.NewService(t.runtime, t.cache, t.configLoader, t.statStore)
+		[]config.RateLimitConfigToLoad{{"config.basic_config", "fake_yaml"}}, gomock.Any()).Return(nil, config.RateLimitConfigError{Message: "load error"})
+	service := ratelimit.NewService(t.runtime, t.cache, t.configLoader, t.statStore, config.FailureModeNone)
 
 	request := common.NewRateLimitRequestLegacy("test-domain", [][][2]string{{{"hello", "world"}}}, 1)
 	response, err := service.GetLegacyService().ShouldRateLimit(nil, request)
@@ -370,9 +363,11 @@ func TestConvertResponse(test *testing.T) {
 		},
 	}
 
+	// The legacy response has no headers, so they are dropped.
 	response := &pb.RateLimitResponse{
 		OverallCode: pb.RateLimitResponse_OVER_LIMIT,
 		Statuses:    statuses,
+		Headers:     []*core.HeaderValue{{Key: ratelimit.LeaseIDHeader, Value: "lease-a"}},
 	}
 
 	expectedRl := &pb_legacy.RateLimit{
@@ -4,6 +4,7 @@ import (
 	"sync"
 	"testing"
 
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v2"
 	"github.com/golang/mock/gomock"
 	"github.com/lyft/gostats"
@@ -17,6 +18,7 @@ import (
 	"github.com/lyft/ratelimit/test/mocks/runtime/snapshot"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/metadata"
 )
 
 type barrier struct {
@@ -56,6 +58,7 @@ type rateLimitServiceTestSuite struct {
 	config                *mock_config.MockRateLimitConfig
 	runtimeUpdateCallback chan<- int
 	statStore             stats.Store
+	failureMode           config.FailureMode
 }
 
 func commonSetup(t *testing.T) rateLimitServiceTestSuite {
@@ -81,8 +84,8 @@ func (this *rateLimitServiceTestSuite) setupBasicService() ratelimit.RateLimitSe
 	this.snapshot.EXPECT().Get("config.basic_config").Return("fake_yaml").MinTimes(1)
 	this.configLoader.EXPECT().Load(
 		[]config.RateLimitConfigToLoad{{"config.basic_config", "fake_yaml"}},
-		gomock.Any()).Return(this.config)
-	return ratelimit.NewService(this.runtime, this.cache, this.configLoader, this.statStore)
+		gomock.Any()).Return(this.config, nil)
+	return ratelimit.NewService(this.runtime, this.cache, this.configLoader, this.statStore, this.failureMode)
 }
 
 func TestService(test *testing.T) {
@@ -92,9 +95,9 @@ func TestService(test *testing.T) {
 
 	// First request, config should be loaded.
 	request := common.NewRateLimitRequest("test-domain", [][][2]string{{{"hello", "world"}}}, 1)
-	t.config.EXPECT().GetLimit(nil, "test-domain", request.Descriptors[0]).Return(nil)
-	t.cache.EXPECT().DoLimit(nil, request, []*config.RateLimit{nil}).Return(
-		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0}})
+	t.config.EXPECT().GetLimits(nil, "test-domain", request.Descriptors[0]).Return(nil)
+	t.cache.EXPECT().DoLimit(nil, request, []*config.RateLimit{nil}, "").Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0}}, nil)
 
 	response, err := service.ShouldRateLimit(nil, request)
 	t.assert.Equal(
@@ -108,7 +111,7 @@ func TestService(test *testing.T) {
 	barrier := newBarrier()
 	t.configLoader.EXPECT().Load(
 		[]config.RateLimitConfigToLoad{{"config.basic_config", "fake_yaml"}}, gomock.Any()).Do(
-		func([]config.RateLimitConfigToLoad, stats.Scope) { barrier.signal() }).Return(t.config)
+		func([]config.RateLimitConfigToLoad, stats.Scope) { barrier.signal() }).Return(t.config, nil)
 	t.runtimeUpdateCallback <- 1
 	barrier.wait()
 
@@ -118,11 +121,11 @@ func TestService(test *testing.T) {
 	limits := []*config.RateLimit{
 		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, "key", t.statStore),
 		nil}
-	t.config.EXPECT().GetLimit(nil, "different-domain", request.Descriptors[0]).Return(limits[0])
-	t.config.EXPECT().GetLimit(nil, "different-domain", request.Descriptors[1]).Return(limits[1])
-	t.cache.EXPECT().DoLimit(nil, request, limits).Return(
+	t.config.EXPECT().GetLimits(nil, "different-domain", request.Descriptors[0]).Return([]*config.RateLimit{limits[0]})
+	t.config.EXPECT().GetLimits(nil, "different-domain", request.Descriptors[1]).Return([]*config.RateLimit{limits[1]})
+	t.cache.EXPECT().DoLimit(nil, request, limits, "").Return(
 		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0},
-			{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0}})
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0}}, nil)
 	response, err = service.ShouldRateLimit(nil, request)
 	t.assert.Equal(
 		&pb.RateLimitResponse{
@@ -137,10 +140,8 @@ func TestService(test *testing.T) {
 	// Config load failure.
 	t.configLoader.EXPECT().Load(
 		[]config.RateLimitConfigToLoad{{"config.basic_config", "fake_yaml"}}, gomock.Any()).Do(
-		func([]config.RateLimitConfigToLoad, stats.Scope) {
-			barrier.signal()
-			panic(config.RateLimitConfigError("load error"))
-		})
+		func([]config.RateLimitConfigToLoad, stats.Scope) { barrier.signal() }).Return(
+		nil, config.RateLimitConfigError{Message: "load error"})
 	t.runtimeUpdateCallback <- 1
 	barrier.wait()
 
@@ -148,11 +149,11 @@ func TestService(test *testing.T) {
 	limits = []*config.RateLimit{
 		nil,
 		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, "key", t.statStore)}
-	t.config.EXPECT().GetLimit(nil, "different-domain", request.Descriptors[0]).Return(limits[0])
-	t.config.EXPECT().GetLimit(nil, "different-domain", request.Descriptors[1]).Return(limits[1])
-	t.cache.EXPECT().DoLimit(nil, request, limits).Return(
+	t.config.EXPECT().GetLimits(nil, "different-domain", request.Descriptors[0]).Return([]*config.RateLimit{limits[0]})
+	t.config.EXPECT().GetLimits(nil, "different-domain", request.Descriptors[1]).Return([]*config.RateLimit{limits[1]})
+	t.cache.EXPECT().DoLimit(nil, request, limits, "").Return(
 		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0},
-			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[1].Limit, LimitRemaining: 0}})
+			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[1].Limit, LimitRemaining: 0}}, nil)
 	response, err = service.ShouldRateLimit(nil, request)
 	t.assert.Equal(
 		&pb.RateLimitResponse{
@@ -199,16 +200,235 @@ func TestCacheError(test *testing.T) {
 
 	request := common.NewRateLimitRequest("different-domain", [][][2]string{{{"foo", "bar"}}}, 1)
 	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, "key", t.statStore)}
-	t.config.EXPECT().GetLimit(nil, "different-domain", request.Descriptors[0]).Return(limits[0])
-	t.cache.EXPECT().DoLimit(nil, request, limits).Do(
-		func(context.Context, *pb.RateLimitRequest, []*config.RateLimit) {
-			panic(redis.RedisError("cache error"))
-		})
+	t.config.EXPECT().GetLimits(nil, "different-domain", request.Descriptors[0]).Return([]*config.RateLimit{limits[0]})
+	t.cache.EXPECT().DoLimit(nil, request, limits, "").Return(nil, redis.RedisError("cache error"))
+	t.config.EXPECT().GetFailureMode("different-domain").Return(config.FailureModeNone)
 
 	response, err := service.ShouldRateLimit(nil, request)
 	t.assert.Nil(response)
 	t.assert.Equal("cache error", err.Error())
 	t.assert.EqualValues(1, t.statStore.NewCounter("call.should_rate_limit.redis_error").Value())
+	t.assert.EqualValues(0, t.statStore.NewCounter("call.should_rate_limit.failure_mode_applied").Value())
+}
+
+func TestCacheTimeout(test *testing.T) {
+	t := commonSetup(test)
+	defer t.controller.Finish()
+	service := t.setupBasicService()
+
+	request := common.NewRateLimitRequest("different-domain", [][][2]string{{{"foo", "bar"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, "key", t.statStore)}
+	t.config.EXPECT().GetLimits(nil, "different-domain", request.Descriptors[0]).Return([]*config.RateLimit{limits[0]})
+	t.cache.EXPECT().DoLimit(nil, request, limits, "").Return(nil, redis.RedisTimeoutError("i/o timeout"))
+	t.config.EXPECT().GetFailureMode("different-domain").Return(config.FailureModeNone)
+
+	response, err := service.ShouldRateLimit(nil, request)
+	t.assert.Nil(response)
+	t.assert.Equal("i/o timeout", err.Error())
+	t.assert.EqualValues(1, t.statStore.NewCounter("call.should_rate_limit.redis_timeout").Value())
+	t.assert.EqualValues(0, t.statStore.NewCounter("call.should_rate_limit.redis_error").Value())
+}
+
+func TestCacheCanceled(test *testing.T) {
+	t := commonSetup(test)
+	defer t.controller.Finish()
+	t.failureMode = config.FailureModeAllow
+	service := t.setupBasicService()
+
+	// A cancelled call is counted as such and the failure mode does not apply.
+	request := common.NewRateLimitRequest("different-domain", [][][2]string{{{"foo", "bar"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, "key", t.statStore)}
+	t.config.EXPECT().GetLimits(nil, "different-domain", request.Descriptors[0]).Return([]*config.RateLimit{limits[0]})
+	t.cache.EXPECT().DoLimit(nil, request, limits, "").Return(nil, context.Canceled)
+
+	response, err := service.ShouldRateLimit(nil, request)
+	t.assert.Nil(response)
+	t.assert.Equal(context.Canceled, err)
+	t.assert.EqualValues(1, t.statStore.NewCounter("call.should_rate_limit.canceled").Value())
+	t.assert.EqualValues(0, t.statStore.NewCounter("call.should_rate_limit.failure_mode_applied").Value())
+}
+
+func TestCacheErrorFailureMode(test *testing.T) {
+	t := commonSetup(test)
+	defer t.controller.Finish()
+	t.failureMode = config.FailureModeAllow
+	service := t.setupBasicService()
+
+	// The server-wide failure mode lets the request through.
+	request := common.NewRateLimitRequest("analytics", [][][2]string{{{"foo", "bar"}}, {{"hello", "world"}}}, 1)
+	limits := []*config.RateLimit{config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_MINUTE, "key", t.statStore), nil}
+	t.config.EXPECT().GetLimits(nil, "analytics", request.Descriptors[0]).Return([]*config.RateLimit{limits[0]})
+	t.config.EXPECT().GetLimits(nil, "analytics", request.Descriptors[1]).Return(nil)
+	t.cache.EXPECT().DoLimit(nil, request, limits, "").Return(nil, redis.RedisError("cache error"))
+	t.config.EXPECT().GetFailureMode("analytics").Return(config.FailureModeNone)
+
+	response, err := service.ShouldRateLimit(nil, request)
+	t.assert.Equal(
+		&pb.RateLimitResponse{
+			OverallCode: pb.RateLimitResponse_OK,
+			Statuses: []*pb.RateLimitResponse_DescriptorStatus{
+				{Code: pb.RateLimitResponse_OK}, {Code: pb.RateLimitResponse_OK}}},
+		response)
+	t.assert.Nil(err)
+
+	// The domain's failure mode overrides the server-wide one.
+	request = common.NewRateLimitRequest("login", [][][2]string{{{"foo", "bar"}}}, 1)
+	t.config.EXPECT().GetLimits(nil, "login", request.Descriptors[0]).Return([]*config.RateLimit{limits[0]})
+	t.cache.EXPECT().DoLimit(nil, request, limits[:1], "").Return(nil, redis.RedisError("cache error"))
+	t.config.EXPECT().GetFailureMode("login").Return(config.FailureModeDeny)
+
+	response, err = service.ShouldRateLimit(nil, request)
+	t.assert.Equal(
+		&pb.RateLimitResponse{
+			OverallCode: pb.RateLimitResponse_OVER_LIMIT,
+			Statuses:    []*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT}}},
+		response)
+	t.assert.Nil(err)
+	t.assert.EqualValues(2, t.statStore.NewCounter("call.should_rate_limit.redis_error").Value())
+	t.assert.EqualValues(2, t.statStore.NewCounter("call.should_rate_limit.failure_mode_applied").Value())
+
+	// Service errors are still returned to the caller.
+	response, err = service.ShouldRateLimit(nil, &pb.RateLimitRequest{})
+	t.assert.Nil(response)
+	t.assert.Equal("rate limit domain must not be empty", err.Error())
+	t.assert.EqualValues(2, t.statStore.NewCounter("call.should_rate_limit.failure_mode_applied").Value())
+}
+
+func TestConcurrencyLease(test *testing.T) {
+	t := commonSetup(test)
+	defer t.controller.Finish()
+	service := t.setupBasicService()
+
+	// The leases acquired for concurrency limits get a new ID, which is returned in a header.
+	request := common.NewRateLimitRequest("test-domain", [][][2]string{{{"tenant", "a"}}}, 1)
+	limits := []*config.RateLimit{config.NewConcurrencyLimit(3, 60, "tenant", t.statStore)}
+	t.config.EXPECT().GetLimits(nil, "test-domain", request.Descriptors[0]).Return(limits)
+	var leaseID string
+	t.cache.EXPECT().DoLimit(nil, request, limits, gomock.Any()).Do(
+		func(_ context.Context, _ *pb.RateLimitRequest, _ []*config.RateLimit, id string) { leaseID = id }).Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 2}}, nil)
+
+	response, err := service.ShouldRateLimit(nil, request)
+	t.assert.Nil(err)
+	t.assert.Len(leaseID, 32)
+	t.assert.Equal([]*core.HeaderValue{{Key: ratelimit.LeaseIDHeader, Value: leaseID}}, response.Headers)
+
+	// Every call gets its own ID.
+	t.config.EXPECT().GetLimits(nil, "test-domain", request.Descriptors[0]).Return(limits)
+	t.cache.EXPECT().DoLimit(nil, request, limits, gomock.Any()).Do(
+		func(_ context.Context, _ *pb.RateLimitRequest, _ []*config.RateLimit, id string) {
+			t.assert.NotEqual(leaseID, id)
+		}).Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 1}}, nil)
+
+	_, err = service.ShouldRateLimit(nil, request)
+	t.assert.Nil(err)
+
+	// No lease ID is returned if the concurrency limit is over the limit, since nothing was acquired.
+	t.config.EXPECT().GetLimits(nil, "test-domain", request.Descriptors[0]).Return(limits)
+	t.cache.EXPECT().DoLimit(nil, request, limits, gomock.Any()).Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[0].Limit, LimitRemaining: 0}}, nil)
+
+	response, err = service.ShouldRateLimit(nil, request)
+	t.assert.Nil(err)
+	t.assert.Equal(pb.RateLimitResponse_OVER_LIMIT, response.OverallCode)
+	t.assert.Nil(response.Headers)
+}
+
+func TestConcurrencyLeaseOverLimit(test *testing.T) {
+	t := commonSetup(test)
+	defer t.controller.Finish()
+	service := t.setupBasicService()
+
+	// The leases acquired by a call that another limit rejects are released right away.
+	request := common.NewRateLimitRequest("test-domain", [][][2]string{{{"tenant", "a"}}, {{"user", "b"}}}, 1)
+	limits := []*config.RateLimit{
+		config.NewConcurrencyLimit(3, 60, "tenant", t.statStore),
+		config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, "user", t.statStore)}
+	t.config.EXPECT().GetLimits(nil, "test-domain", request.Descriptors[0]).Return(limits[:1])
+	t.config.EXPECT().GetLimits(nil, "test-domain", request.Descriptors[1]).Return(limits[1:])
+	var leaseID string
+	t.cache.EXPECT().DoLimit(nil, request, limits, gomock.Any()).Do(
+		func(_ context.Context, _ *pb.RateLimitRequest, _ []*config.RateLimit, id string) { leaseID = id }).Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 2},
+			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[1].Limit, LimitRemaining: 0}}, nil)
+	t.cache.EXPECT().Release(nil, request, limits, gomock.Any()).Do(
+		func(_ context.Context, _ *pb.RateLimitRequest, _ []*config.RateLimit, id string) {
+			t.assert.Equal(leaseID, id)
+		}).Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 3},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0}}, nil)
+
+	response, err := service.ShouldRateLimit(nil, request)
+	t.assert.Nil(err)
+	t.assert.Equal(
+		&pb.RateLimitResponse{
+			OverallCode: pb.RateLimitResponse_OVER_LIMIT,
+			Statuses: []*pb.RateLimitResponse_DescriptorStatus{
+				{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 2},
+				{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[1].Limit, LimitRemaining: 0},
+			}},
+		response)
+
+	// The rejection stands even if the leases cannot be released, and they expire instead.
+	t.config.EXPECT().GetLimits(nil, "test-domain", request.Descriptors[0]).Return(limits[:1])
+	t.config.EXPECT().GetLimits(nil, "test-domain", request.Descriptors[1]).Return(limits[1:])
+	t.cache.EXPECT().DoLimit(nil, request, limits, gomock.Any()).Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 2},
+			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: limits[1].Limit, LimitRemaining: 0}}, nil)
+	t.cache.EXPECT().Release(nil, request, limits, gomock.Any()).Return(nil, redis.RedisError("cache error"))
+
+	response, err = service.ShouldRateLimit(nil, request)
+	t.assert.Nil(err)
+	t.assert.Equal(pb.RateLimitResponse_OVER_LIMIT, response.OverallCode)
+	t.assert.Nil(response.Headers)
+}
+
+func TestRelease(test *testing.T) {
+	t := commonSetup(test)
+	defer t.controller.Finish()
+	service := t.setupBasicService()
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(ratelimit.LeaseIDHeader, "lease-a"))
+	request := common.NewRateLimitRequest("test-domain", [][][2]string{{{"tenant", "a"}}, {{"hello", "world"}}}, 1)
+	limits := []*config.RateLimit{config.NewConcurrencyLimit(3, 60, "tenant", t.statStore), nil}
+	t.config.EXPECT().GetLimits(ctx, "test-domain", request.Descriptors[0]).Return([]*config.RateLimit{limits[0]})
+	t.config.EXPECT().GetLimits(ctx, "test-domain", request.Descriptors[1]).Return([]*config.RateLimit{limits[1]})
+	t.cache.EXPECT().Release(ctx, request, limits, "lease-a").Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 3},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0}}, nil)
+
+	response, err := service.Release(ctx, request)
+	t.assert.Equal(
+		&pb.RateLimitResponse{
+			OverallCode: pb.RateLimitResponse_OK,
+			Statuses: []*pb.RateLimitResponse_DescriptorStatus{
+				{Code: pb.RateLimitResponse_OK, CurrentLimit: limits[0].Limit, LimitRemaining: 3},
+				{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0},
+			}},
+		response)
+	t.assert.Nil(err)
+
+	// Errors are counted separately from ShouldRateLimit.
+	t.config.EXPECT().GetLimits(ctx, "test-domain", request.Descriptors[0]).Return([]*config.RateLimit{limits[0]})
+	t.config.EXPECT().GetLimits(ctx, "test-domain", request.Descriptors[1]).Return([]*config.RateLimit{limits[1]})
+	t.cache.EXPECT().Release(ctx, request, limits, "lease-a").Return(nil, redis.RedisError("cache error"))
+
+	response, err = service.Release(ctx, request)
+	t.assert.Nil(response)
+	t.assert.Equal("cache error", err.Error())
+	t.assert.EqualValues(1, t.statStore.NewCounter("call.release.redis_error").Value())
+	t.assert.EqualValues(0, t.statStore.NewCounter("call.should_rate_limit.redis_error").Value())
+
+	// A release without a lease ID is rejected.
+	response, err = service.Release(nil, request)
+	t.assert.Nil(response)
+	t.assert.Equal(
+		"release needs the lease id returned by ShouldRateLimit in the x-ratelimit-lease-id metadata", err.Error())
+	t.assert.EqualValues(1, t.statStore.NewCounter("call.release.service_error").Value())
 }
 
 func TestInitialLoadError(test *testing.T) {
@@ -221,11 +441,8 @@ func TestInitialLoadError(test *testing.T) {
 	t.snapshot.EXPECT().Keys().Return([]string{"foo", "config.basic_config"}).MinTimes(1)
 	t.snapshot.EXPECT().Get("config.basic_config").Return("fake_yaml").MinTimes(1)
 	t.configLoader.EXPECT().Load(
-		[]config.RateLimitConfigToLoad{{"config.basic_config", "fake_yaml"}}, gomock.Any()).Do(
-		func([]config.RateLimitConfigToLoad, stats.Scope) {
-			panic(config.RateLimitConfigError("load error"))
-		})
-	service := ratelimit.NewService(t.runtime, t.cache, t.configLoader, t.statStore)
+		[]config.RateLimitConfigToLoad{{"config.basic_config", "fake_yaml"}}, gomock.Any()).Return(nil, config.RateLimitConfigError{Message: "load error"})
+	service := ratelimit.NewService(t.runtime, t.cache, t.configLoader, t.statStore, config.FailureModeNone)
 
 	request := common.NewRateLimitRequest("test-domain", [][][2]string{{{"hello", "world"}}}, 1)
 	response, err := service.ShouldRateLimit(nil, request)
@@ -233,3 +450,57 @@ func TestInitialLoadError(test *testing.T) {
 	t.assert.Equal("no rate limit configuration loaded", err.Error())
 	t.assert.EqualValues(1, t.statStore.NewCounter("call.should_rate_limit.service_error").Value())
 }
+
+func TestMultipleLimits(test *testing.T) {
+	t := commonSetup(test)
+	defer t.controller.Finish()
+	service := t.setupBasicService()
+
+	// Every limit of a descriptor is checked in one cache call and the most restrictive status wins.
+	request := common.NewRateLimitRequest(
+		"test-domain", [][][2]string{{{"plan", "gold"}}, {{"hello", "world"}}}, 1)
+	perSecond := config.NewRateLimit(10, pb.RateLimitResponse_RateLimit_SECOND, "key", t.statStore)
+	perDay := config.NewRateLimit(1000, pb.RateLimitResponse_RateLimit_DAY, "key#1", t.statStore)
+	perDay.Index = 1
+	t.config.EXPECT().GetLimits(nil, "test-domain", request.Descriptors[0]).Return([]*config.RateLimit{perSecond, perDay})
+	t.config.EXPECT().GetLimits(nil, "test-domain", request.Descriptors[1]).Return(nil)
+
+	expandedRequest := common.NewRateLimitRequest(
+		"test-domain", [][][2]string{{{"plan", "gold"}}, {{"plan", "gold"}}, {{"hello", "world"}}}, 1)
+	t.cache.EXPECT().DoLimit(nil, expandedRequest, []*config.RateLimit{perSecond, perDay, nil}, "").Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: perSecond.Limit, LimitRemaining: 9},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: perDay.Limit, LimitRemaining: 5},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0}}, nil)
+
+	response, err := service.ShouldRateLimit(nil, request)
+	t.assert.Equal(
+		&pb.RateLimitResponse{
+			OverallCode: pb.RateLimitResponse_OK,
+			Statuses: []*pb.RateLimitResponse_DescriptorStatus{
+				{Code: pb.RateLimitResponse_OK, CurrentLimit: perDay.Limit, LimitRemaining: 5},
+				{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0},
+			}},
+		response)
+	t.assert.Nil(err)
+
+	// Over the limit on any one limit is over the limit for the descriptor.
+	t.config.EXPECT().GetLimits(nil, "test-domain", request.Descriptors[0]).Return([]*config.RateLimit{perSecond, perDay})
+	t.config.EXPECT().GetLimits(nil, "test-domain", request.Descriptors[1]).Return(nil)
+	t.cache.EXPECT().DoLimit(nil, expandedRequest, []*config.RateLimit{perSecond, perDay, nil}, "").Return(
+		[]*pb.RateLimitResponse_DescriptorStatus{
+			{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: perSecond.Limit, LimitRemaining: 0},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: perDay.Limit, LimitRemaining: 4},
+			{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0}}, nil)
+
+	response, err = service.ShouldRateLimit(nil, request)
+	t.assert.Equal(
+		&pb.RateLimitResponse{
+			OverallCode: pb.RateLimitResponse_OVER_LIMIT,
+			Statuses: []*pb.RateLimitResponse_DescriptorStatus{
+				{Code: pb.RateLimitResponse_OVER_LIMIT, CurrentLimit: perSecond.Limit, LimitRemaining: 0},
+				{Code: pb.RateLimitResponse_OK, CurrentLimit: nil, LimitRemaining: 0},
+			}},
+		response)
+	t.assert.Nil(err)
+}